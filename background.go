@@ -0,0 +1,132 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// taskGroup keeps track of the background tasks which are in progress, so that
+// Drain can wait for them to settle. Unlike a sync.WaitGroup, it can be waited
+// on while tasks keep being started.
+type taskGroup struct {
+	mu   sync.Mutex
+	n    int           // Number of tasks in progress
+	idle chan struct{} // Closed when n drops to zero
+}
+
+// start registers a task as being in progress.
+func (g *taskGroup) start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.n == 0 {
+		g.idle = make(chan struct{})
+	}
+	g.n++
+}
+
+// done marks a task started with start as finished.
+func (g *taskGroup) done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.n == 0 {
+		close(g.idle)
+	}
+}
+
+// wait blocks until no task is in progress, or the context is cancelled.
+func (g *taskGroup) wait(ctx context.Context) error {
+	g.mu.Lock()
+	if g.n == 0 {
+		g.mu.Unlock()
+		return nil
+	}
+	idle := g.idle
+	g.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startBackground starts the background tasks enabled in the options. They run
+// until stopBackground is called.
+func (db *database) startBackground() {
+	db.stop = make(chan struct{})
+	db.scanDone = make(chan struct{})
+	if db.opts.SyncInterval > 0 && !db.readonly {
+		db.workers.Add(1)
+		go db.syncLoop(db.opts.SyncInterval)
+	}
+	if db.opts.BackgroundScan {
+		db.workers.Add(1)
+		db.tasks.start()
+		go db.scanLoop()
+	} else {
+		close(db.scanDone)
+	}
+}
+
+// stopBackground stops the background tasks, and waits for them to exit.
+func (db *database) stopBackground() {
+	close(db.stop)
+	db.workers.Wait()
+}
+
+// syncLoop syncs the shelves every interval, until the database is closed.
+func (db *database) syncLoop(interval time.Duration) {
+	defer db.workers.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			db.tasks.start()
+			db.Sync()
+			db.tasks.done()
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// scanLoop builds the gap-lists of the shelves, which were opened without
+// scanning them because of Options.BackgroundScan, one at a time. It gives up
+// if the database is closed.
+func (db *database) scanLoop() {
+	defer db.workers.Done()
+	defer db.tasks.done()
+	defer close(db.scanDone)
+	for _, shelf := range db.snapshot() {
+		if shelf.scanGapsLive(db.stop) != nil {
+			return
+		}
+	}
+}
+
+// ScanComplete returns a channel which is closed once the gap-lists have been
+// built by the background scan enabled with Options.BackgroundScan, or when the
+// database is closed before that. Without the option, the channel is closed
+// already.
+func (db *database) ScanComplete() <-chan struct{} {
+	return db.scanDone
+}
+
+// Drain waits until the background tasks which are in progress, such as a sync
+// started because of Options.SyncInterval, have completed, or the context is
+// cancelled. The database stays open, and the background tasks keep being
+// scheduled afterwards. It is meant for quiescing the database before taking a
+// backup of its files.
+func (db *database) Drain(ctx context.Context) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return db.tasks.wait(ctx)
+}
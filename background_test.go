@@ -0,0 +1,192 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gatedSyncFS is a memFS whose file syncs block, once armed, until the gate is
+// closed.
+type gatedSyncFS struct {
+	*memFS
+	armed   int32         // Set to 1 (atomically) to make syncs block
+	syncing chan struct{} // Receives a value when a blocking sync starts
+	gate    chan struct{} // Syncs block until this is closed
+}
+
+func (fsys *gatedSyncFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &gatedSyncFile{File: f, fsys: fsys}, nil
+}
+
+type gatedSyncFile struct {
+	File
+	fsys *gatedSyncFS
+}
+
+func (f *gatedSyncFile) Sync() error {
+	if atomic.LoadInt32(&f.fsys.armed) == 0 {
+		return f.File.Sync()
+	}
+	select {
+	case f.fsys.syncing <- struct{}{}:
+	default:
+	}
+	<-f.fsys.gate
+	return f.File.Sync()
+}
+
+func TestDrain(t *testing.T) {
+	fsys := &gatedSyncFS{
+		memFS:   newMemFS("db"),
+		syncing: make(chan struct{}, 1),
+		gate:    make(chan struct{}),
+	}
+	db, err := Open(Options{Path: "db", FS: fsys, SyncInterval: time.Millisecond}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&fsys.armed, 1)
+	if _, err := db.Put([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the background syncer to get stuck in a sync.
+	select {
+	case <-fsys.syncing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background sync not started")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	drained := make(chan error, 1)
+	go func() { drained <- db.Drain(context.Background()) }()
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned while sync in progress, err %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(fsys.gate)
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after sync completed")
+	}
+	// The database is still usable.
+	if _, err := db.Put([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Drain(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
+
+// gatedReadFS is a memFS where, once armed, the first read of a shelf file
+// blocks until the gate is closed.
+type gatedReadFS struct {
+	*memFS
+	armed   int32         // Set to 1 (atomically) to make the next shelf read block
+	reading chan struct{} // Closed when the blocking read starts
+	gate    chan struct{} // The blocking read waits until this is closed
+}
+
+func (fsys *gatedReadFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, ".bag") {
+		return f, err
+	}
+	return &gatedReadFile{File: f, fsys: fsys}, nil
+}
+
+type gatedReadFile struct {
+	File
+	fsys *gatedReadFS
+}
+
+func (f *gatedReadFile) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.CompareAndSwapInt32(&f.fsys.armed, 1, 0) {
+		close(f.fsys.reading)
+		<-f.fsys.gate
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestBackgroundScan(t *testing.T) {
+	fsys := &gatedReadFS{
+		memFS:   newMemFS("db"),
+		reading: make(chan struct{}),
+		gate:    make(chan struct{}),
+	}
+	opts := Options{Path: "db", FS: fsys}
+	db, err := OpenFixed(opts, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put(fill(byte(i), 50))
+	}
+	db.Delete(2)
+	db.Delete(5)
+	db.Close()
+
+	if _, err := OpenFixed(Options{Path: "db", FS: fsys, BackgroundScan: true}, 100, func(uint64, []byte) {}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	atomic.StoreInt32(&fsys.armed, 1)
+	opts.BackgroundScan = true
+	db, err = OpenFixed(opts, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	select {
+	case <-fsys.reading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("background scan not started")
+	}
+	// While the scan is stuck, reads work, and Put appends.
+	select {
+	case <-db.ScanComplete():
+		t.Fatal("scan complete while blocked")
+	default:
+	}
+	if data, err := db.Get(3); err != nil || !bytes.Equal(data, fill(3, 50)) {
+		t.Fatalf("have %x (err %v)", data, err)
+	}
+	if key, _ := db.Put(fill(10, 50)); key != 10 {
+		t.Fatalf("have key %d, want 10", key)
+	}
+	close(fsys.gate)
+	select {
+	case <-db.ScanComplete():
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan did not complete")
+	}
+	// Afterwards, the slots deleted before are reused.
+	for _, want := range []uint64{2, 5, 11} {
+		if key, _ := db.Put(fill(11, 50)); key != want {
+			t.Fatalf("have key %d, want %d", key, want)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The patch written by BackupIncremental has the same framing as the raw
+// export stream, see rawMagic, but a different magic. The manifest and the
+// metadata blob are stored whole. The content of a shelf frame is the number of
+// slots of the shelf, followed by the slots changed since the previous backup:
+// [ uint64: slots | uint64: slot | <slot content> | uint64: slot | ... ]
+const (
+	patchMagic = "billypatch\x01"
+	patchName  = "billy.patch"
+)
+
+// Backup copies the database into dstDir, which must exist and not contain
+// any of its files already, as ImportRaw would recreate it from ExportRaw. It
+// also starts tracking the slots changed from then on, for BackupIncremental.
+// The same caveats as for ExportRaw apply. Values in Options.OverflowDir are not
+// covered, so it fails with ErrInvalidOptions if that is set.
+func (db *database) Backup(dstDir string) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if db.overflow != nil {
+		return fmt.Errorf("%w: backup with OverflowDir", ErrInvalidOptions)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.exportRaw(pw, true))
+	}()
+	err := importRaw(db.fs, pr, dstDir)
+	// Unblocks the export, if the import stopped early
+	pr.CloseWithError(err)
+	return err
+}
+
+// BackupIncremental writes a patch with the slots changed since the previous
+// Backup or BackupIncremental into dstDir, which must exist. ApplyIncremental
+// applies the patch to the previous backup, bringing it up to date. The
+// changes are only tracked in memory, since the last Backup: after the
+// database has been reopened, or after SwapIn, a new full Backup is needed,
+// otherwise ErrNoBackup is returned.
+func (db *database) BackupIncremental(dstDir string) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, shelf := range db.shelves {
+		if !shelf.tracksChanges() {
+			return ErrNoBackup
+		}
+	}
+	f, err := db.fs.OpenFile(filepath.Join(dstDir, datasetFile(db.opts.Name, patchName)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	w := &fileWriter{f: f}
+	if err := db.writePatch(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writePatch writes the patch for BackupIncremental to w. The caller must hold
+// db.mu.
+func (db *database) writePatch(w io.Writer) error {
+	if _, err := io.WriteString(w, patchMagic); err != nil {
+		return err
+	}
+	if err := db.writeMetaFrames(w); err != nil {
+		return err
+	}
+	for _, shelf := range db.shelves {
+		if err := shelf.exportPatch(w); err != nil {
+			return err
+		}
+	}
+	return writeRawFrame(w, 0, "", 0)
+}
+
+// fileWriter writes to a File sequentially.
+type fileWriter struct {
+	f   File
+	off int64
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// tracksChanges reports whether the slots changed are tracked, since a Backup.
+func (s *shelf) tracksChanges() bool {
+	s.dirtyMu.Lock()
+	defer s.dirtyMu.Unlock()
+	return s.dirty != nil
+}
+
+// markDirty records that the content of the slot has changed, if changes are
+// tracked.
+func (s *shelf) markDirty(slot uint64) {
+	s.dirtyMu.Lock()
+	if s.dirty != nil {
+		s.dirty[slot] = true
+	}
+	s.dirtyMu.Unlock()
+}
+
+// exportPatch writes a frame with the slots of the shelf changed since the
+// previous backup, with the gaps marked as deleted, and starts tracking the
+// changes anew. If writing fails, the slots are tracked as changed still.
+func (s *shelf) exportPatch(w io.Writer) error {
+	// Holding compactMu keeps Put, Update and Compact out.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.gapsMu.Lock()
+	var (
+		tail  = s.tail
+		gaps  = append(sortedUniqueInts(nil), s.gaps...)
+		slots []uint64
+	)
+	s.dirtyMu.Lock()
+	for slot := range s.dirty {
+		if slot < tail {
+			slots = append(slots, slot)
+		}
+	}
+	s.dirty = make(map[uint64]bool)
+	s.dirtyMu.Unlock()
+	s.gapsMu.Unlock()
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	err := s.writePatchFrame(w, tail, gaps, slots)
+	if err != nil {
+		for _, slot := range slots {
+			s.markDirty(slot)
+		}
+	}
+	return err
+}
+
+// writePatchFrame writes the frame of exportPatch.
+func (s *shelf) writePatchFrame(w io.Writer, tail uint64, gaps sortedUniqueInts, slots []uint64) error {
+	length := 8 + uint64(len(slots))*(8+uint64(s.slotSize))
+	if err := writeRawFrame(w, s.slotSize, s.id, length); err != nil {
+		return err
+	}
+	buf := make([]byte, 8+s.slotSize)
+	binary.BigEndian.PutUint64(buf, tail)
+	if _, err := w.Write(buf[:8]); err != nil {
+		return err
+	}
+	for _, slot := range slots {
+		binary.BigEndian.PutUint64(buf, slot)
+		if err := s.readChunk(buf[8:], slot); err != nil {
+			return err
+		}
+		if gaps.Contains(slot) {
+			copy(buf[8:], s.tombstone())
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyIncremental applies a patch written by BackupIncremental into patchDir
+// to the backup in backupDir, written by Backup, and updated with the patches
+// of the preceding calls to BackupIncremental, if any. The patches must be
+// applied in the order they were written. The backup must not be open
+// meanwhile.
+func ApplyIncremental(patchDir, backupDir string) error {
+	return applyIncremental(osFS{}, patchDir, backupDir)
+}
+
+func applyIncremental(fsys FS, patchDir, backupDir string) error {
+	entries, err := fsys.ReadDir(patchDir)
+	if err != nil {
+		return err
+	}
+	var applied bool
+	for _, entry := range entries {
+		// The patch of a named dataset is prefixed with the name
+		name := entry.Name()
+		if dataset := strings.TrimSuffix(name, "."+patchName); name != patchName && (dataset == name || !validDatasetName(dataset)) {
+			continue
+		}
+		if err := applyPatchFile(fsys, filepath.Join(patchDir, name), backupDir); err != nil {
+			return err
+		}
+		applied = true
+	}
+	if !applied {
+		return fmt.Errorf("%w: %v", os.ErrNotExist, filepath.Join(patchDir, patchName))
+	}
+	return nil
+}
+
+// applyPatchFile applies the named patch file to the backup in backupDir.
+func applyPatchFile(fsys FS, name, backupDir string) error {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := io.NewSectionReader(f, 0, stat.Size())
+	magic := make([]byte, len(patchMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != patchMagic {
+		return fmt.Errorf("%w: not a patch: %v", ErrCorruptData, name)
+	}
+	hdr := make([]byte, rawFrameHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return fmt.Errorf("%w: reading frame: %v", ErrCorruptData, err)
+		}
+		slotSize := binary.BigEndian.Uint32(hdr)
+		name := make([]byte, int(binary.BigEndian.Uint16(hdr[4:]))+8)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("%w: reading frame: %v", ErrCorruptData, err)
+		}
+		length := binary.BigEndian.Uint64(name[len(name)-8:])
+		name = name[:len(name)-8]
+		if len(name) == 0 {
+			return nil
+		}
+		// The length of a patch frame is checked below
+		if err := checkRawFrame(string(name), slotSize, 0); err != nil {
+			return err
+		}
+		dst := filepath.Join(backupDir, string(name))
+		if slotSize == 0 {
+			err = importRawFile(fsys, io.LimitReader(r, int64(length)), dst+".tmp", length)
+			if err == nil {
+				err = fsys.Rename(dst+".tmp", dst)
+			}
+		} else {
+			err = applyShelfPatch(fsys, io.LimitReader(r, int64(length)), dst, slotSize, length)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// applyShelfPatch applies a shelf frame of a patch, with the given length of
+// content read from r, to the named shelf file.
+func applyShelfPatch(fsys FS, r io.Reader, name string, slotSize uint32, length uint64) error {
+	if length < 8 || (length-8)%(8+uint64(slotSize)) != 0 {
+		return fmt.Errorf("%w: patch of %d bytes for %v, slot size %d", ErrCorruptData, length, name, slotSize)
+	}
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8+slotSize)
+	err = func() error {
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return fmt.Errorf("%w: reading %v: %v", ErrCorruptData, name, err)
+		}
+		tail := binary.BigEndian.Uint64(buf)
+		if err := f.Truncate(int64(tail) * int64(slotSize)); err != nil {
+			return err
+		}
+		for n := (length - 8) / uint64(len(buf)); n > 0; n-- {
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return fmt.Errorf("%w: reading %v: %v", ErrCorruptData, name, err)
+			}
+			slot := binary.BigEndian.Uint64(buf)
+			if slot >= tail {
+				return fmt.Errorf("%w: patch of slot %d beyond %d slots of %v", ErrCorruptData, slot, tail, name)
+			}
+			if _, err := f.WriteAt(buf[8:], int64(slot)*int64(slotSize)); err != nil {
+				return err
+			}
+		}
+		return f.Sync()
+	}()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,87 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupIncremental(t *testing.T) {
+	var (
+		src    = t.TempDir()
+		backup = t.TempDir()
+	)
+	db, err := Open(Options{Path: src, Checksum: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.BackupIncremental(t.TempDir()); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("expected %v, got %v", ErrNoBackup, err)
+	}
+	var keys []uint64
+	for i := 0; i < 50; i++ {
+		key, err := db.Put(fill(byte(i), 10+i*5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := db.Backup(backup); err != nil {
+		t.Fatal(err)
+	}
+	// Two rounds of changes, each with its own patch
+	for round := 0; round < 2; round++ {
+		for i, key := range keys {
+			switch i % 5 {
+			case 0:
+				db.Delete(key)
+			case 1:
+				if _, err := db.Swap(key, fill(byte(i+round), 10+i*5)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for i := 0; i < 10; i++ {
+			key, err := db.Put(fill(byte(100+i), 200))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		if err := db.SetMeta([]byte{byte(round)}); err != nil {
+			t.Fatal(err)
+		}
+		patch := t.TempDir()
+		if err := db.BackupIncremental(patch); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyIncremental(patch, backup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Closing blanks the deleted slots, just like the patch does.
+	db.Close()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		have, err := os.ReadFile(filepath.Join(backup, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := os.ReadFile(filepath.Join(src, entry.Name()))
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%v differs: have %d bytes, want %d", entry.Name(), len(have), len(want))
+		}
+	}
+	if err := ApplyIncremental(t.TempDir(), backup); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected %v, got %v", os.ErrNotExist, err)
+	}
+}
@@ -0,0 +1,56 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// The interfaces below are subsets of Database, for code which only needs one
+// capability of it, and can thus be handed a wrapper or another store as
+// well. Whether a value offers a capability can be found out with a type
+// assertion, e.g.
+//
+//	if s, ok := store.(billy.Syncer); ok {
+//		err = s.Sync()
+//	}
+//
+// A Database, however it was opened (e.g. with Options.FS, or Options.Mmap),
+// has all of them.
+
+// Iterator is the capability to visit the stored items.
+type Iterator interface {
+	Iterate(onData OnDataFn)
+	IterateReverse(onData OnDataFn)
+	IterateRange(lo, hi uint64, onData OnDataFn) error
+}
+
+// Syncer is the capability to flush the stored items to disk.
+type Syncer interface {
+	Sync() error
+}
+
+// Compactor is the capability to free the space of deleted items.
+type Compactor interface {
+	Compact() error
+	CompactShelf(i int) error
+}
+
+// Stater is the capability to report statistics about the stored items.
+type Stater interface {
+	Metrics() Metrics
+	CountByShelf() []uint64
+	Fragmentation() (shelves []float64, total float64)
+}
+
+var (
+	_ Database  = (*database)(nil)
+	_ Iterator  = (*database)(nil)
+	_ Syncer    = (*database)(nil)
+	_ Compactor = (*database)(nil)
+	_ Stater    = (*database)(nil)
+
+	// Every Database has all capabilities
+	_ Iterator  = Database(nil)
+	_ Syncer    = Database(nil)
+	_ Compactor = Database(nil)
+	_ Stater    = Database(nil)
+)
@@ -0,0 +1,45 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "testing"
+
+func TestCapabilities(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("hello"))
+	db.Close()
+
+	for _, tt := range []struct {
+		name string
+		opts Options
+	}{
+		{"os", Options{Path: p}},
+		{"mmap", Options{Path: p, Readonly: true, Mmap: true}},
+		{"memfs", Options{Path: "db", FS: newMemFS("db")}},
+	} {
+		db, err := Open(tt.opts, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		var store interface{} = db
+		if _, ok := store.(Iterator); !ok {
+			t.Errorf("%v: not an Iterator", tt.name)
+		}
+		if _, ok := store.(Syncer); !ok {
+			t.Errorf("%v: not a Syncer", tt.name)
+		}
+		if _, ok := store.(Compactor); !ok {
+			t.Errorf("%v: not a Compactor", tt.name)
+		}
+		if _, ok := store.(Stater); !ok {
+			t.Errorf("%v: not a Stater", tt.name)
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,130 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Codec identifies the compression applied to an item. With
+// Options.Compression, it's stored in the header of every item, so that items
+// compressed in different ways can be mixed in one database. A codec is
+// implemented by the Compressor registered with its id.
+type Codec uint8
+
+const (
+	CodecNone   Codec = iota // Stored as is
+	CodecSnappy              // Snappy; not built in, register a Compressor to use it
+	CodecZstd                // Zstandard; not built in, register a Compressor to use it
+	CodecGzip                // Gzip, from the standard library
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	case CodecGzip:
+		return "gzip"
+	}
+	return fmt.Sprintf("codec(%d)", uint8(c))
+}
+
+// Compressor implements a codec. Its id is stored with every item compressed
+// by it, so it must never change, and must not be reused for another codec.
+type Compressor interface {
+	Compress(data []byte) []byte
+	Decompress(data []byte) ([]byte, error)
+	ID() uint8
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[Codec]Compressor{
+		CodecNone: noopCompressor{},
+		CodecGzip: gzipCompressor{},
+	}
+)
+
+// RegisterCompressor makes a codec available, under the id of the compressor,
+// to all databases. It is meant to be called from an init function, e.g.
+// to add snappy or zstd support (using the ids CodecSnappy and CodecZstd). It
+// panics if a compressor with the same id has already been registered.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, exists := compressors[Codec(c.ID())]; exists {
+		panic(fmt.Sprintf("billy: compressor %v registered twice", Codec(c.ID())))
+	}
+	compressors[Codec(c.ID())] = c
+}
+
+// compressor returns the compressor registered for the codec.
+func (c Codec) compressor() (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	if comp, ok := compressors[c]; ok {
+		return comp, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrUnknownCodec, c)
+}
+
+// compress encodes data with the codec.
+func (c Codec) compress(data []byte) ([]byte, error) {
+	comp, err := c.compressor()
+	if err != nil {
+		return nil, err
+	}
+	return comp.Compress(data), nil
+}
+
+// decompress decodes data which has been encoded with the codec.
+func (c Codec) decompress(data []byte) ([]byte, error) {
+	comp, err := c.compressor()
+	if err != nil {
+		return nil, err
+	}
+	out, err := comp.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptData, err)
+	}
+	return out, nil
+}
+
+// noopCompressor implements CodecNone.
+type noopCompressor struct{}
+
+func (noopCompressor) Compress(data []byte) []byte            { return data }
+func (noopCompressor) Decompress(data []byte) ([]byte, error) { return data, nil }
+func (noopCompressor) ID() uint8                              { return uint8(CodecNone) }
+
+// gzipCompressor implements CodecGzip.
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	// Writing to a bytes.Buffer can't fail
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func (gzipCompressor) ID() uint8 { return uint8(CodecGzip) }
@@ -0,0 +1,245 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPutCompressed(t *testing.T) {
+	var (
+		p    = t.TempDir()
+		opts = Options{Path: p, Compression: true, Checksum: true}
+	)
+	db, err := Open(opts, SlotSizeLinear(200, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		compressible = bytes.Repeat([]byte("billy "), 200) // 1200 bytes
+		random       = []byte("short, and not worth compressing")
+		want         = make(map[uint64][]byte)
+	)
+	for _, codec := range []Codec{CodecNone, CodecGzip} {
+		for _, data := range [][]byte{compressible, random} {
+			key, err := db.PutCompressed(data, codec)
+			if err != nil {
+				t.Fatalf("codec %v: %v", codec, err)
+			}
+			want[key] = data
+		}
+	}
+	// The compressed item fits a much smaller slot.
+	gzKey, _ := db.PutCompressed(compressible, CodecGzip)
+	if shelf := gzKey >> slotBits; shelf != 0 {
+		t.Fatalf("compressed item stored in shelf %d, want 0", shelf)
+	}
+	want[gzKey] = compressible
+	for _, codec := range []Codec{CodecSnappy, CodecZstd, Codec(200)} {
+		if _, err := db.PutCompressed(random, codec); !errors.Is(err, ErrUnknownCodec) {
+			t.Fatalf("codec %v: expected %v, got %v", codec, ErrUnknownCodec, err)
+		}
+	}
+	check := func(db Database) {
+		t.Helper()
+		for key, data := range want {
+			have, err := db.Get(key)
+			if err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("key %x: have %d bytes (err %v), want %d", key, len(have), err, len(data))
+			}
+		}
+		n := 0
+		db.Iterate(func(key uint64, data []byte) {
+			if !bytes.Equal(data, want[key]) {
+				t.Errorf("iterate key %x: have %d bytes, want %d", key, len(data), len(want[key]))
+			}
+			n++
+		})
+		if n != len(want) {
+			t.Fatalf("iterated %d items, want %d", n, len(want))
+		}
+	}
+	check(db)
+	if bad, err := db.Scrub(); err != nil || len(bad) != 0 {
+		t.Fatalf("scrub: bad %v, err %v", bad, err)
+	}
+	db.Close()
+
+	// Reopen with gzip as the default codec.
+	opts.DefaultCodec = CodecGzip
+	db, err = Open(opts, SlotSizeLinear(200, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+	key, err := db.Put(compressible)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := db.Len(key); n >= len(compressible) {
+		t.Fatalf("have stored length %d, expected compression", n)
+	}
+	want[key] = compressible
+	check(db)
+}
+
+func TestCompressionOptions(t *testing.T) {
+	p := t.TempDir()
+	if _, err := Open(Options{Path: p, DefaultCodec: CodecGzip}, SlotSizeLinear(200, 3), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	db, err := Open(Options{Path: p}, SlotSizeLinear(200, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PutCompressed([]byte("data"), CodecGzip); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	if _, err := db.PutCompressed([]byte("data"), CodecNone); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// The setting can't be changed for an existing database.
+	if _, err := Open(Options{Path: p, Compression: true}, SlotSizeLinear(200, 3), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+}
+
+// reverseCompressor is a custom codec, which stores data backwards.
+type reverseCompressor struct{}
+
+func (reverseCompressor) Compress(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[len(data)-1-i] = b
+	}
+	return out
+}
+
+func (c reverseCompressor) Decompress(data []byte) ([]byte, error) {
+	return c.Compress(data), nil
+}
+
+func (reverseCompressor) ID() uint8 { return 100 }
+
+func init() {
+	RegisterCompressor(reverseCompressor{})
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), Compression: true, DefaultCodec: Codec(100)}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, err := db.Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(key); err != nil || string(data) != "hello" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "hello")
+	}
+	// The data is stored reversed.
+	sh := db.(*database).shelves[0]
+	if data, codec, err := sh.readFile(key); err != nil || string(data) != "olleh" || codec != 100 {
+		t.Fatalf("have stored %q with codec %v (err %v)", data, codec, err)
+	}
+	// Items with an unregistered codec can't be read.
+	hdr := make([]byte, sh.hdrSize)
+	if _, err := sh.f.ReadAt(hdr, 0); err != nil {
+		t.Fatal(err)
+	}
+	hdr[sh.codecOff] = 101
+	if _, err := sh.f.WriteAt(hdr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("expected %v, got %v", ErrUnknownCodec, err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic on duplicate registration")
+		}
+	}()
+	RegisterCompressor(reverseCompressor{})
+}
+
+func TestShelfCodecFn(t *testing.T) {
+	var (
+		p = t.TempDir()
+		// Only the shelves with slots of 1000 bytes or more compress.
+		codecFn = func(index int, slotSize uint32) Codec {
+			if slotSize >= 1000 {
+				return CodecGzip
+			}
+			return CodecNone
+		}
+	)
+	if _, err := Open(Options{Path: p, ShelfCodecFn: codecFn}, SlotSizeLinear(200, 10), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	opts := Options{Path: p, Compression: true, ShelfCodecFn: codecFn}
+	db, err := Open(opts, SlotSizeLinear(200, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		small = bytes.Repeat([]byte("b"), 150)
+		large = bytes.Repeat([]byte("billy "), 200) // 1200 bytes
+		want  = make(map[uint64][]byte)
+	)
+	check := func(db Database) {
+		t.Helper()
+		for key, data := range want {
+			have, err := db.Get(key)
+			if err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("key %x: have %d bytes (err %v), want %d", key, len(have), err, len(data))
+			}
+		}
+	}
+	smallKey, err := db.Put(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	largeKey, err := db.Put(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[smallKey], want[largeKey] = small, large
+	// The small item is stored as is, the large one compressed, after
+	// which it fits the first shelf.
+	for _, tc := range []struct {
+		key   uint64
+		codec Codec
+	}{{smallKey, CodecNone}, {largeKey, CodecGzip}} {
+		if shelf := tc.key >> slotBits; shelf != 0 {
+			t.Fatalf("key %x: stored in shelf %d, want 0", tc.key, shelf)
+		}
+		if _, codec, err := db.(*database).shelves[0].readFile(tc.key); err != nil || codec != tc.codec {
+			t.Fatalf("key %x: stored with codec %v (err %v), want %v", tc.key, codec, err, tc.codec)
+		}
+	}
+	check(db)
+	db.Close()
+
+	// The codecs are recorded, so the function can be left out.
+	db, err = Open(Options{Path: p, Compression: true}, SlotSizeLinear(200, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sh := db.(*database).shelves[8]; sh.codec != CodecGzip {
+		t.Fatalf("shelf 8 has codec %v, want %v", sh.codec, CodecGzip)
+	}
+	check(db)
+	db.Close()
+	// But they can't be changed.
+	opts.ShelfCodecFn = func(int, uint32) Codec { return CodecGzip }
+	if _, err := Open(opts, SlotSizeLinear(200, 10), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+}
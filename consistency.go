@@ -0,0 +1,109 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "io"
+
+// ConsistencyReport lists the differences found by CheckConsistency between the
+// in-memory state of the shelves and their files.
+type ConsistencyReport struct {
+	// FreeButLive are the keys in the gap-list whose slot holds an item on
+	// disk. They are only looked for with DeleteTombstone, since otherwise
+	// the headers of deleted slots are only blanked on Close.
+	FreeButLive []uint64
+	// LiveButFree are the keys below the high-water mark, not in the
+	// gap-list, whose slot is empty on disk. This is expected for slots
+	// deleted while the gap-list was full (see Options.MaxGapListEntries).
+	LiveButFree []uint64
+	// BeyondTail are the keys in the gap-list at or above the high-water
+	// mark.
+	BeyondTail []uint64
+	// ShortFiles are the shelves whose file, along with the write buffer,
+	// ends before their high-water mark.
+	ShortFiles []int
+}
+
+// Consistent reports whether no differences were found.
+func (r *ConsistencyReport) Consistent() bool {
+	return len(r.FreeButLive) == 0 && len(r.LiveButFree) == 0 &&
+		len(r.BeyondTail) == 0 && len(r.ShortFiles) == 0
+}
+
+// CheckConsistency compares the gap-list and the high-water mark of every shelf
+// against the item headers in its file, and reports the slots they disagree
+// about. Unlike Scrub, it doesn't read the data, and unlike Repair, it never
+// changes anything. Each shelf is locked while it's checked; slots reserved by
+// a concurrent Put may be reported, so the database should be quiesced.
+// Items in Options.OverflowDir are not checked.
+func (db *database) CheckConsistency() (*ConsistencyReport, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	report := new(ConsistencyReport)
+	for i, shelf := range db.snapshot() {
+		if err := shelf.checkConsistency(i, db.MakeKey, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// checkConsistency adds the differences between the in-memory state of the
+// shelf and its file to the report. The shelf is the i:th one.
+func (s *shelf) checkConsistency(i int, makeKey func(int, uint64) uint64, report *ConsistencyReport) error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	// A partially written last slot counts, its header is checked below.
+	end := (uint64(stat.Size()) + uint64(s.slotSize) - 1) / uint64(s.slotSize)
+	if s.wbuf != nil {
+		s.wbuf.mu.Lock()
+		if len(s.wbuf.buf) > 0 {
+			if bufEnd := s.wbuf.start + uint64(len(s.wbuf.buf))/uint64(s.slotSize); bufEnd > end {
+				end = bufEnd
+			}
+		}
+		s.wbuf.mu.Unlock()
+	}
+	if end < s.tail {
+		report.ShortFiles = append(report.ShortFiles, i)
+	}
+	hdr := make([]byte, s.hdrSize)
+	for slot := uint64(0); slot < s.tail && slot < end; slot++ {
+		n, err := s.readSlot(hdr, slot)
+		if err == io.EOF {
+			// The end of a partially written slot reads as zeroes.
+			for j := n; j < len(hdr); j++ {
+				hdr[j] = 0
+			}
+		} else if err != nil {
+			return err
+		}
+		var (
+			free = s.getSize(hdr) == 0
+			gap  = s.gaps.Contains(slot)
+		)
+		switch {
+		case gap && !free && s.eagerDel:
+			report.FreeButLive = append(report.FreeButLive, makeKey(i, slot))
+		case !gap && free:
+			report.LiveButFree = append(report.LiveButFree, makeKey(i, slot))
+		}
+	}
+	for _, gap := range s.gaps {
+		if gap >= s.tail {
+			report.BeyondTail = append(report.BeyondTail, makeKey(i, gap))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	db, err := OpenFixed(Options{Path: t.TempDir(), DeleteMode: DeleteTombstone}, 64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := db.Put([]byte(fmt.Sprintf("item-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	report, err := db.CheckConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Consistent() {
+		t.Fatalf("unexpected differences: %+v", report)
+	}
+	// Desync the in-memory state from the file.
+	sh := db.(*database).shelves[0]
+	sh.gapsMu.Lock()
+	sh.gaps.Remove(2)
+	sh.gaps.Append(5)
+	sh.gaps.Append(20)
+	sh.tail = 12
+	sh.gapsMu.Unlock()
+
+	if report, err = db.CheckConsistency(); err != nil {
+		t.Fatal(err)
+	}
+	want := &ConsistencyReport{
+		FreeButLive: []uint64{5},
+		LiveButFree: []uint64{2},
+		BeyondTail:  []uint64{20},
+		ShortFiles:  []int{0},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("have %+v, want %+v", report, want)
+	}
+	// Nothing was changed by the check.
+	if data, err := db.Get(5); err != nil || string(data) != "item-5" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "item-5")
+	}
+	sh.gapsMu.Lock()
+	sh.gaps = sortedUniqueInts{2}
+	sh.tail = 10
+	sh.gapsMu.Unlock()
+}
@@ -5,9 +5,14 @@
 package billy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Database interface {
@@ -16,19 +21,278 @@ type Database interface {
 	// Put stores the data to the underlying database, and returns the key needed
 	// for later accessing the data.
 	// The data is copied by the database, and is safe to modify after the method returns
+	// Freed slots are reused lowest first, before the shelf is extended.
 	Put(data []byte) (uint64, error)
 
+	// PutEx is like Put, but also returns the number of bytes wasted in the
+	// slot, that is, the slot size minus the item size including the header.
+	PutEx(data []byte) (key uint64, waste uint32, err error)
+
+	// PutCompressed is like Put, but compresses the data with the given
+	// codec. It requires Options.Compression.
+	PutCompressed(data []byte, codec Codec) (uint64, error)
+
+	// PutAt stores the data at the given key, e.g. to restore items at
+	// their original keys.
+	PutAt(key uint64, data []byte) error
+
+	// ReserveBlock reserves count contiguous slots at the end of the shelf
+	// for items of the given size, and returns their keys, for PutAt.
+	ReserveBlock(count int, size int) ([]uint64, error)
+
+	// AddShelf appends a shelf with the given slot size, larger than those
+	// of the existing shelves, and returns its index.
+	AddShelf(slotSize uint32) (index int, err error)
+
 	// Get retrieves the data stored at the given key.
 	Get(key uint64) ([]byte, error)
 
+	// GetContext is like Get, but returns the context's error if it's done
+	// before the data has been read. The read itself can't be interrupted,
+	// and goes on in the background until the disk responds. The number of
+	// such reads per database is limited: when they're all stuck, GetContext
+	// returns the context's error without reading.
+	GetContext(ctx context.Context, key uint64) ([]byte, error)
+
+	// GetTimeout is like Get, but returns context.DeadlineExceeded if the
+	// data has not been read within the given duration.
+	GetTimeout(key uint64, d time.Duration) ([]byte, error)
+
+	// Len returns the length of the data stored at the given key, without
+	// reading the data itself. For compressed items, that's the compressed
+	// length.
+	Len(key uint64) (int, error)
+
+	// Locate returns where the item with the given key is stored.
+	Locate(key uint64) (Location, error)
+
+	// CreatedAt returns the time the item with the given key was written. It
+	// requires Options.Timestamps.
+	CreatedAt(key uint64) (time.Time, error)
+
+	// MakeKey returns the key of the given slot of the i:th shelf.
+	MakeKey(shelf int, slot uint64) uint64
+
+	// ParseKey splits the key into the index of the shelf and the slot
+	// within it.
+	ParseKey(key uint64) (shelf int, slot uint64)
+
 	// Delete marks the data for deletion, which means it will (eventually) be
 	// overwritten by other data. After calling Delete with a given key, the results
 	// from doing Get(key) is undefined -- it may return the same data, or some other
-	// data, or fail with an error.
+	// data, or fail with an error. With DeleteTombstone, Get returns ErrDeleted
+	// until the slot is reused.
 	Delete(key uint64) error
 
+	// Append appends extra to the data stored at the given key. If the slot
+	// has room for it, the data is extended in place and the same key is
+	// returned. Otherwise, the data is moved to a shelf with larger slots, and
+	// the new key is returned.
+	Append(key uint64, extra []byte) (uint64, error)
+
+	// Shrink moves the data stored at the given key to the shelf with the
+	// smallest slots it fits in, and returns the new key. The same key is
+	// returned if the data is there already.
+	Shrink(key uint64) (uint64, error)
+
+	// Swap replaces the data stored at the given key in place, and returns
+	// the data it replaces. The read and the write are atomic with respect to
+	// other writes.
+	Swap(key uint64, data []byte) (old []byte, err error)
+
+	// Iterate iterates through all the data in the database, and invokes the
+	// given onData method for every element.
+	Iterate(onData OnDataFn)
+
+	// IterateReverse is like Iterate, but visits the items in descending key
+	// order.
+	IterateReverse(onData OnDataFn)
+
+	// IterateRange is like Iterate, but only visits the items with keys in
+	// [lo, hi].
+	IterateRange(lo, hi uint64, onData OnDataFn) error
+
+	// IterateKeyRange is like IterateRange, for a range returned by
+	// SplitRanges.
+	IterateKeyRange(r KeyRange, onData OnDataFn) error
+
+	// SplitRanges partitions the key space into up to n contiguous ranges,
+	// holding roughly the same number of items each.
+	SplitRanges(n int) []KeyRange
+
+	// IterateShelfRange is like Iterate, but only visits the shelves with ids
+	// in [lo, hi].
+	IterateShelfRange(lo, hi int, onData OnDataFn) error
+
+	// Stream delivers every item in the database on a channel, closing it
+	// when done or when the context is cancelled. Errors are delivered on the
+	// second channel.
+	Stream(ctx context.Context, bufSize int) (<-chan Record, <-chan error)
+
+	// All returns every item in the database, copied into memory. It is
+	// meant for small databases, and tests.
+	All() ([]Record, error)
+
+	// IterateGaps invokes onData for every deleted slot which has not yet been
+	// reused, with whatever content it currently holds. This is a best-effort
+	// API, meant for forensics and testing.
+	IterateGaps(onData OnDataFn)
+
+	// FinishBulkLoad ends bulk-load mode, if the database was opened with
+	// Options.BulkLoad, and makes the database fully operational.
+	FinishBulkLoad() error
+
+	// ReplayInSequence invokes onData for every item, in the order the items
+	// were written. It requires the database to be opened with
+	// Options.Sequence. It holds 16 bytes of memory per item, and reads each
+	// item with a random access. It doesn't lock the database: items deleted
+	// meanwhile are skipped, but items written meanwhile may or may not be
+	// delivered, and a slot reused meanwhile delivers the new item in the
+	// place of the old one.
+	ReplayInSequence(onData OnDataFn) error
+
+	// CopyTo stores every item into the destination database, which may have
+	// a different layout, and reports the old and new key of each item to the
+	// optional remap callback.
+	CopyTo(dst Database, remap func(oldKey, newKey uint64)) error
+
+	// Warmup reads all shelf files sequentially, to pull them into the OS page
+	// cache before the database starts serving requests.
+	Warmup() error
+
+	// WarmupContext is like Warmup, but stops early if the context is
+	// cancelled.
+	WarmupContext(ctx context.Context) error
+
+	// WarmupShelf reads the file of the i:th shelf sequentially, to pull it
+	// into the OS page cache.
+	WarmupShelf(i int) error
+
+	// FreeSlots returns a copy of the free slots of the i:th shelf, in
+	// increasing order.
+	FreeSlots(i int) ([]uint32, error)
+
+	// IterateFreeSlots invokes fn with the free slots of the i:th shelf, in
+	// increasing order, until fn returns false.
+	IterateFreeSlots(i int, fn func(slot uint32) bool) error
+
+	// SetMeta stores a small blob of application metadata, replacing any
+	// previous blob.
+	SetMeta(blob []byte) error
+
+	// GetMeta returns the blob stored by SetMeta, or nil if none has been set.
+	GetMeta() ([]byte, error)
+
+	// Scrub verifies the checksum of every item, and returns the keys of
+	// those which fail. It requires Options.Checksum.
+	Scrub() (badKeys []uint64, err error)
+
+	// ScrubContext is like Scrub, but stops early if the context is
+	// cancelled.
+	ScrubContext(ctx context.Context) (badKeys []uint64, err error)
+
+	// KeyRange returns the smallest and largest key currently in use, or
+	// ok=false if the database is empty.
+	KeyRange() (min, max uint64, ok bool)
+
+	// IsValidKey reports whether the key could refer to a live item: its shelf
+	// exists, and its slot is below the high-water mark and not deleted.
+	IsValidKey(key uint64) bool
+
 	// Limits returns the smallest and largest slot size.
 	Limits() (uint32, uint32)
+
+	// MaxValueSize returns the size of the largest value Put stores in a
+	// shelf, that is, the largest slot size minus the item header.
+	MaxValueSize() int
+
+	// FitsShelf reports whether data of the given size fits in a slot of the
+	// i:th shelf.
+	FitsShelf(i int, size int) bool
+
+	// Fragmentation returns, for each shelf, the ratio of free slots to the
+	// total number of slots below the high-water mark (0 for an empty shelf),
+	// along with the same ratio computed across all shelves, weighted by
+	// slot count.
+	Fragmentation() (shelves []float64, total float64)
+
+	// CountByShelf returns the number of items stored in each shelf, without
+	// reading any data.
+	CountByShelf() []uint64
+
+	// ReclaimableBytes returns, for each shelf, the number of bytes
+	// compacting it would free.
+	ReclaimableBytes() []uint64
+
+	// CompactionPlan returns the indices of the shelves which have space to
+	// reclaim, ordered by ReclaimableBytes, most first.
+	CompactionPlan() []int
+
+	// Metrics returns statistics about the shelves, see
+	// Options.TrackSizeHistogram.
+	Metrics() Metrics
+
+	// Efficiency reports how much of the space taken by the items is used
+	// by their data.
+	Efficiency() EfficiencyReport
+
+	// CheckConsistency compares the gap-list and the high-water mark of
+	// every shelf with the item headers in its file, without changing
+	// anything.
+	CheckConsistency() (*ConsistencyReport, error)
+
+	// Compact moves items from the end of each shelf into its gaps and
+	// truncates the files, while the database stays in use. Every item moved
+	// is reported to Options.OnRelocate.
+	Compact() error
+
+	// CompactParallel is like Compact, but compacts up to the given number of
+	// shelves concurrently.
+	CompactParallel(workers int) error
+
+	// CompactShelf is like Compact, but only compacts the i:th shelf.
+	CompactShelf(i int) error
+
+	// ShrinkTail truncates each shelf file down to its high-water mark,
+	// reclaiming space beyond the last slot in use, and returns the number of
+	// bytes freed.
+	ShrinkTail() (freedBytes uint64, err error)
+
+	// ApplyDeletes applies the deletes queued because of
+	// Options.DeferDeletes.
+	ApplyDeletes() error
+
+	// Sync flushes the shelf files to disk.
+	Sync() error
+
+	// Reload picks up the items appended to the shelf files by another
+	// process, e.g. in a read-only replica. It never changes what is
+	// already known about the shelves.
+	Reload() error
+
+	// Drain waits until the background tasks in progress have completed, or
+	// the context is cancelled, without closing the database.
+	Drain(ctx context.Context) error
+
+	// ScanComplete returns a channel which is closed once the background
+	// scan enabled with Options.BackgroundScan is done.
+	ScanComplete() <-chan struct{}
+
+	// ExportRaw writes the files of the database to w, in a stream which
+	// ImportRaw turns back into a database directory.
+	ExportRaw(w io.Writer) error
+
+	// Backup copies the database into a directory, and starts tracking the
+	// changes for BackupIncremental.
+	Backup(dstDir string) error
+
+	// BackupIncremental writes a patch with the slots changed since the
+	// previous backup into a directory, for ApplyIncremental.
+	BackupIncremental(dstDir string) error
+
+	// SwapIn replaces the entire dataset with the database stored in srcDir,
+	// which must have the same slot sizes and layout options.
+	SwapIn(srcDir string) error
 }
 
 // SlotSizeFn is a method that acts as a "generator": a closure which, at each
@@ -68,16 +332,420 @@ func SlotSizeLinear(size, count int) SlotSizeFn {
 	}
 }
 
+// SlotSizeConcat is a SlotSizeFn which yields the slot sizes of each of the
+// given generators in turn, each run to completion, e.g. a fine linear range of
+// small slots followed by powers of two for the larger ones. It panics if the
+// first size of a generator is not larger than the last size of the one before.
+func SlotSizeConcat(fns ...SlotSizeFn) SlotSizeFn {
+	if len(fns) == 0 { // programming error
+		panic("Bad options, no slot size functions")
+	}
+	var (
+		i    int
+		last uint32 // Last size of the previous generator, until checked
+	)
+	return func() (uint32, bool) {
+		size, done := fns[i]()
+		if last != 0 {
+			if size <= last { // programming error
+				panic(fmt.Sprintf("Bad options, slot size function %d starts at %d, after %d", i, size, last))
+			}
+			last = 0
+		}
+		if !done {
+			return size, false
+		}
+		last = size
+		i++
+		return size, i == len(fns)
+	}
+}
+
+// PayloadSizeFn wraps a SlotSizeFn which yields payload sizes, that is, the
+// largest data the caller intends to store in each shelf, and adds the item
+// header size to each of them. This lets the layout be configured in terms of
+// payload sizes, without having to account for the header.
+func PayloadSizeFn(fn SlotSizeFn) SlotSizeFn {
+	return func() (uint32, bool) {
+		size, done := fn()
+		if uint64(size)+itemHeaderSize > maxSlotSize { // programming error
+			panic(fmt.Sprintf("Bad options, payload size %d too large", size))
+		}
+		return size + itemHeaderSize, done
+	}
+}
+
+// keyBits is the number of key bits used by the key encoding. The shelf id is
+// stored in the upper Options.ShelfBits of them, the slot identifier below.
+const keyBits = 40
+
+// defaultShelfBits is the number of key bits used for the shelf id, unless
+// configured otherwise, and maxShelfBits the most that can be configured.
+const (
+	defaultShelfBits = 12
+	maxShelfBits     = 16
+)
+
+// maxShelves is the number of shelves that can be addressed by the key
+// encoding with the default number of shelf bits.
+const maxShelves = 1 << defaultShelfBits
+
+// slotBits is the number of key bits used for the slot identifier with the
+// default number of shelf bits. The shelf id is stored in the bits above.
+const slotBits = keyBits - defaultShelfBits
+
 type database struct {
-	shelves []*shelf
+	// mu protects the shelves, which are replaced by SwapIn. Operations on
+	// single items hold it for reading, while iterations only hold it when
+	// taking a snapshot of the shelves.
+	mu        sync.RWMutex
+	shelves   []*shelf
+	slotSizes []uint32 // Effective slot sizes of the shelves
+	opts      Options  // Options the database was opened with
+	fs        FS       // Filesystem the database is stored on
+	path      string   // Directory of the database
+	readonly  bool
+	closed    int32  // Set to 1 (atomically) once Close has been called
+	onClose   func() // Optional hook invoked on the first Close
+	tracer    Tracer // Optional tracer, may be nil
+	bulk      int32  // Set to 1 (atomically) while in bulk-load mode
+	seq       uint64 // Last sequence number assigned, if sequence numbers are enabled
+	useSeq    bool   // Whether sequence numbers are enabled
+	checksum  bool   // Whether items carry a checksum
+	slotBits  uint   // Number of key bits used for the slot
+
+	overflow *overflowStore // Store for values too large for the shelves, nil unless enabled
+	counters *counters      // Counters of Metrics
+
+	manifest *manifest   // Manifest as last written, updated by AddShelf
+	shelfCfg shelfConfig // Configuration the shelves were opened with
+
+	timestamps bool  // Whether items carry a timestamp
+	clock      clock // Source of the item timestamps
+
+	lastShelf int32 // Index of the shelf chosen by the last Put (atomic)
+
+	repair     func(key uint64) ([]byte, error) // Optional source of data failing checksum
+	onRelocate func(oldKey, newKey uint64)      // Optional callback for items moved by Compact
+
+	codec       Codec     // Codec used by Put
+	shelfCodecs bool      // Whether the shelves have codecs of their own
+	placement   Placement // Policy for choosing the shelf used by Put
+
+	deferDeletes bool       // Whether deletes are queued until ApplyDeletes
+	pendingMu    sync.Mutex // Protects pending
+	pending      []uint64   // Keys deleted, but not yet applied
+
+	stop     chan struct{}  // Closed to stop the background tasks
+	scanDone chan struct{}  // Closed when the background scan is done
+	workers  sync.WaitGroup // Background goroutines, which run until stop is closed
+	tasks    taskGroup      // Background tasks in progress, waited for by Drain
+
+	getters chan struct{} // Semaphore of the goroutines of GetContext
 }
 
 type Options struct {
 	Path     string
 	Readonly bool
 	Snappy   bool // unused for now
+
+	// CompactHeader makes shelves whose slot size fits in 16 bits use a 2-byte
+	// item header instead of the regular 4-byte one. The setting is recorded
+	// in the manifest, and cannot be changed once the database has been created.
+	CompactHeader bool
+
+	// OnGrow, if set, is invoked whenever a Put extends the backing file of a
+	// shelf, with the number of slots before and after the extension. It is
+	// purely observational, and is called after the data has been written.
+	OnGrow func(shelf int, oldSlots, newSlots uint32)
+
+	// StrictDelete makes Get return ErrDeleted for keys which have been
+	// deleted, until the slot is reused by a later Put. Without it, the result
+	// of a Get after Delete is undefined.
+	// The gap-list is kept sorted anyway, so no extra memory is needed, but
+	// every Get has to take the gap-list lock and search it.
+	StrictDelete bool
+
+	// MaxShelves caps the number of shelves the SlotSizeFn may produce. It
+	// defaults to (and cannot exceed) 1<<ShelfBits, which is the limit
+	// imposed by the key encoding.
+	MaxShelves int
+
+	// ShelfBits is the number of key bits used for the shelf id, out of 40;
+	// the rest identify the slot within the shelf. It defaults to 12, which
+	// allows 4096 shelves of up to 2^28 slots each, and can be at most 16.
+	// The setting is recorded in the manifest, and cannot be changed once
+	// the database has been created. Use ParseKey and MakeKey to take keys
+	// apart.
+	ShelfBits int
+
+	// OnClose, if set, is invoked once, when the database is closed.
+	OnClose func()
+
+	// Tracer, if set, is used to trace database operations. It must be safe
+	// for concurrent use.
+	Tracer Tracer
+
+	// BulkLoad opens the database in bulk-load mode, meant for an initial
+	// import: the shelves are not scanned on open, no gap-list is maintained
+	// and Delete fails with ErrBulkLoad. FinishBulkLoad must be called to
+	// switch to normal operation. An onData callback cannot be used in this
+	// mode.
+	BulkLoad bool
+
+	// Sequence makes every item carry a database-wide, monotonically
+	// increasing sequence number in its header, which makes it possible to
+	// replay the items in the order they were written, using ReplayInSequence.
+	// This adds 8 bytes to the item header. The setting is recorded in the
+	// manifest, and cannot be changed once the database has been created.
+	Sequence bool
+
+	// FS, if set, is the filesystem the database is stored on. It defaults to
+	// the OS filesystem.
+	FS FS
+
+	// SlotAlignment, if set, rounds every slot size produced by the
+	// SlotSizeFn up to a multiple of it, e.g. the page size. Sizes which end
+	// up equal after rounding are merged into a single shelf. The effective
+	// slot sizes are recorded in the manifest.
+	SlotAlignment uint32
+
+	// Checksum stores a CRC32 of the data in every item header, which Get
+	// verifies, returning ErrChecksumMismatch on failure. This adds 4 bytes to
+	// the item header. The setting is recorded in the manifest, and cannot be
+	// changed once the database has been created.
+	Checksum bool
+
+	// TailLength repeats the size of every item in the last 4 bytes of its
+	// slot, and Get verifies that both match, returning ErrTornWrite
+	// otherwise. This detects writes which were cut short, e.g. by a crash,
+	// without the cost of a checksum. The setting is recorded in the
+	// manifest, which is then written in format version 2, and cannot be
+	// changed once the database has been created.
+	TailLength bool
+
+	// Repair, if set, is invoked by Get when an item fails its checksum, to
+	// fetch the correct data from elsewhere, e.g. a replica. The data
+	// returned is written back into the slot (unless in read-only mode) and
+	// returned from Get. It requires Checksum.
+	Repair func(key uint64) ([]byte, error)
+
+	// OnRelocate, if set, is invoked by Compact and CompactParallel for every
+	// item moved, with its old and new key. The old key is invalid once the
+	// item has been moved. With CompactParallel, it is called concurrently
+	// from multiple goroutines, and must be safe for that.
+	OnRelocate func(oldKey, newKey uint64)
+
+	// WriteRetries is the number of times a write failing with a transient
+	// error, such as ENOSPC, is retried before giving up. The retries are
+	// spaced with an exponential backoff, starting at 1ms. A failed sync is
+	// never retried, its error is returned as is.
+	WriteRetries int
+
+	// Journal makes every slot write go through a per-shelf write-ahead
+	// journal: the new slot content is written to the journal and synced
+	// before the slot itself is written, and redone from the journal on open
+	// if a crash interrupted it. This protects against torn writes on storage
+	// without atomic sector writes, at a considerable cost: each write is
+	// done twice and synced twice, and the writes within a shelf are
+	// serialized. Compaction, and the clearing of deleted slots on Close, are
+	// not journaled.
+	Journal bool
+
+	// EncodeSlotSizeInName makes new shelf files be named
+	// shelf_<index>_<slot size>.bin instead of bkt_<slot size>.bag. Existing
+	// shelf files are found by their slot size regardless of the scheme, so
+	// the setting can be changed at any time.
+	EncodeSlotSizeInName bool
+
+	// FixedValueSize, if set, is the size of every value, which are then
+	// stored without item header, in a single shelf with slots of exactly
+	// that size, at least 8 bytes. Open must be passed a nil slotSizeFn, and
+	// writes of any other size fail with ErrWrongSize. Since deleted slots
+	// can't be recognized on disk, the gap-list is saved to a file on
+	// Close; Get of a deleted key returns the old value, unless
+	// StrictDelete is set. It can't be combined with the options which add
+	// to the item header, DeleteTombstone, SlotAlignment or OverflowDir,
+	// and ExportRaw is not supported. The setting is recorded in the
+	// manifest, which is then written in format version 2.
+	FixedValueSize uint32
+
+	// SkipMissingShelves makes Open carry on if a shelf can't be opened, or
+	// its file is missing although the manifest records the shelf. Such a
+	// shelf is left out: operations on its keys, and Put of data which
+	// belongs in it, fail with ErrShelfUnavailable, as do operations on all
+	// shelves, like Compact or Scrub. Iterations skip it. A missing file is
+	// not recreated, until the database is opened without this option.
+	SkipMissingShelves bool
+
+	// Name, if set, is the name of the dataset, which prefixes the names of
+	// all files of the database, e.g. name.bkt_00000100.bag, so that several
+	// databases can share a directory. It may only contain ASCII letters,
+	// digits, '-' and '_'. Databases without a name ignore the files of
+	// named ones, and vice versa. ListDatasets lists the names in use.
+	// Options.OverflowDir is not covered, and must not be shared.
+	Name string
+
+	// MaxGapListEntries, if positive, caps the number of free slots tracked in
+	// memory per shelf. A slot deleted while the gap-list is full is instead
+	// marked as deleted on disk, which costs a write, and is not reused until
+	// the shelf is compacted on the next open (or freed by Compact, if it's at
+	// the end of the file). Until then, the file grows instead, and
+	// Fragmentation and FreeSlots do not account for such slots, and Get
+	// returns empty data for them even with StrictDelete.
+	MaxGapListEntries int
+
+	// SyncInterval, if positive, makes a background goroutine sync all shelf
+	// files to disk at the given interval, bounding the amount of data lost
+	// on a power failure. It is ignored in read-only mode.
+	SyncInterval time.Duration
+
+	// Compression stores the codec of every item in its header, which makes
+	// it possible to compress items individually with PutCompressed. This
+	// adds 1 byte to the item header. The setting is recorded in the
+	// manifest, and cannot be changed once the database has been created.
+	Compression bool
+
+	// DefaultCodec is the codec used by Put, PutEx and Append. It requires
+	// Compression, and a Compressor registered for it. Snappy and zstd are not
+	// built in, see RegisterCompressor.
+	DefaultCodec Codec
+
+	// ShelfCodecFn, if set, assigns the codec used by Put, PutEx and Append
+	// to each shelf, replacing DefaultCodec, e.g. to leave the shelves of
+	// small items uncompressed. Put picks the codec of the shelf which would
+	// hold the data uncompressed; the compressed data may then be stored in a
+	// smaller shelf. It requires Compression. The codecs are recorded in the
+	// manifest when the database is opened for writing, and cannot be
+	// changed afterwards; shelves added later are assigned one then. Once
+	// recorded, the function can be left out.
+	ShelfCodecFn func(index int, slotSize uint32) Codec
+
+	// DeferDeletes makes Delete only queue the key, and apply the queued
+	// deletes at Sync, Close, ApplyDeletes or before compacting. Until then,
+	// the slots are not reused, so Get on a deleted key reliably returns its
+	// data, and reads within a session see the data deleted in it. The queue
+	// costs 8 bytes per pending delete. Deletes which are still queued when
+	// the process crashes are lost.
+	DeferDeletes bool
+
+	// WriteBufferBytes, if positive, gives every shelf a buffer of that size
+	// for appended slots, which are then written to the file in one go when
+	// the buffer is full, as well as on Sync, Close and before compacting.
+	// Reads are served from the buffer, so unflushed data is visible, but it
+	// is lost on a crash. It is not used with Journal.
+	WriteBufferBytes int
+
+	// Mmap maps the shelf files into memory, and serves reads from the
+	// mapping instead of with a syscall per read, which suits e.g. a serving
+	// replica. It requires Readonly. Get and Iterate still hand out copies of
+	// the data. Data appended to the files after opening is not visible.
+	// Files of an FS which are not backed by an OS file are read normally.
+	Mmap bool
+
+	// DirectIO makes Iterate read the shelf files with direct I/O (O_DIRECT),
+	// bypassing the page cache, so that scanning a large database doesn't
+	// evict everything else from it. It requires every slot size to be a
+	// multiple of DirectIOAlignment, see SlotAlignment. Other operations use
+	// the page cache as usual. Where direct I/O is not supported, e.g. on
+	// other platforms than Linux, some filesystems, or an FS which is not
+	// the OS one, the shelves are read normally, and ErrDirectIOUnsupported
+	// is reported to OnWarning.
+	DirectIO bool
+
+	// OnWarning, if set, is invoked for problems which the database works
+	// around, such as DirectIO not being available.
+	OnWarning func(err error)
+
+	// MaxOpenFiles, if positive, is the max number of shelf files kept open
+	// at once, for databases with more shelves than the file descriptor
+	// limit allows. The least recently used files are closed, and reopened
+	// when they are accessed again. Files mapped with Mmap, journals and the
+	// files of Options.OverflowDir are not counted.
+	MaxOpenFiles int
+
+	// Timestamps stores the time every item is written in its header, which
+	// CreatedAt returns. This adds 8 bytes to the item header. The setting is
+	// recorded in the manifest, and cannot be changed once the database has
+	// been created.
+	Timestamps bool
+
+	// OverflowDir, if set, is an existing directory where values too large
+	// for the largest shelf are stored, in a file each, instead of failing
+	// with ErrValueTooLarge. Their keys have the top bit set, and Get, Len,
+	// Delete, Iterate and Stream handle them transparently. They are stored as is,
+	// without compression, and deleted right away even with DeferDeletes.
+	// Other operations, such as Append, Swap, Compact, ExportRaw and SwapIn,
+	// only cover the shelves. Backup and ReplayInSequence, which would miss
+	// them, fail with ErrInvalidOptions.
+	OverflowDir string
+
+	// BackgroundScan opens the shelves without reading them, like SkipScan,
+	// but then builds their gap-lists in the background, after which the
+	// slots deleted in earlier sessions are reused. Until then, Put appends
+	// to the shelves. ScanComplete reports when the scan is done. Unlike the
+	// scan on open, the background scan doesn't compact the shelves. An
+	// onData callback cannot be used in this mode, nor BulkLoad.
+	BackgroundScan bool
+
+	// SkipScan opens the shelves without reading them: the high-water mark
+	// is derived from the file size, and the gap-list starts out empty, so
+	// slots deleted in earlier sessions are not reused, nor compacted on
+	// open. It speeds up opening large databases which see few deletes. An
+	// onData callback cannot be used in this mode.
+	SkipScan bool
+
+	// DeleteMode selects what Delete does on disk. It defaults to DeleteLazy.
+	DeleteMode DeleteMode
+
+	// Placement selects the shelf Put stores an item in, among those it fits
+	// in. It defaults to PlacementSmallestFit.
+	Placement Placement
+
+	// TrackSizeHistogram makes every shelf keep a histogram of the sizes of
+	// the items written to it, for the average and 99th percentile reported
+	// by Metrics. This costs three atomic additions per write. Without
+	// it, Metrics reports no sizes.
+	TrackSizeHistogram bool
+
+	// PersistMetrics makes the counters of Metrics survive restarts. They're
+	// resumed from a file next to the shelves on open, and written to it on
+	// Sync and Close, so periodically with SyncInterval. The counters are
+	// approximate: the increments since the last write are lost on a crash.
+	// It's ignored in read-only mode, except that the counters are resumed.
+	PersistMetrics bool
 }
 
+// DeleteMode selects how deleted slots are marked in the shelf files. Either
+// way, the marker is an item header with size zero, which the scan on open
+// recognizes to rebuild the gap-list.
+type DeleteMode uint8
+
+const (
+	// DeleteLazy only adds the slot to the gap-list on Delete, and blanks
+	// the headers of the slots still in it on Close. If the process exits
+	// without closing the database, the deleted items are back after
+	// reopening.
+	DeleteLazy DeleteMode = iota
+	// DeleteTombstone also blanks the header on disk on Delete, which costs
+	// a small write per delete, but makes the delete persist without Close.
+	DeleteTombstone
+)
+
+// Placement is a policy for choosing the shelf an item is stored in.
+type Placement uint8
+
+const (
+	// PlacementSmallestFit stores an item in the smallest shelf it fits in,
+	// which minimizes the space wasted.
+	PlacementSmallestFit Placement = iota
+	// PlacementSpreadLargest stores an item in the shelf one size above the
+	// smallest it fits in, if there is one, which leaves the item room to
+	// grow in place with Append or Swap, at the cost of more waste. It also
+	// spreads the writes of narrowly distributed sizes over two shelves.
+	PlacementSpreadLargest
+)
+
 // OpenCustom opens a (new or eixsting) database, with configurable limits. The
 // given slotSizeFn will be used to determine both the shelf sizes and the number
 // of shelves.
@@ -86,106 +754,1713 @@ type Options struct {
 // internal gap-list.
 // While doing so, it's a good opportunity for the caller to read the data out,
 // (which is probably desirable), which can be done using the optional onData callback.
+// An existing database may be reopened with shelves added (or dropped) at the
+// end of the layout, but changing the slot size of any other shelf fails with
+// ErrLayoutMismatch.
 func Open(opts Options, slotSizeFn SlotSizeFn, onData OnDataFn) (Database, error) {
-	var (
-		db           = &database{}
-		prevSlotSize uint32
-		prevId       int
-		slotSize     uint32
-		done         bool
-	)
-	for !done {
-		slotSize, done = slotSizeFn()
-		if slotSize <= prevSlotSize {
-			return nil, fmt.Errorf("slot sizes must be in increasing order")
+	db := &database{tracer: opts.Tracer, repair: opts.Repair, onRelocate: opts.OnRelocate, counters: new(counters), getters: make(chan struct{}, maxGetters)}
+	if opts.Repair != nil && !opts.Checksum {
+		return nil, fmt.Errorf("%w: repair requires checksums", ErrInvalidOptions)
+	}
+	if opts.ShelfBits < 0 || opts.ShelfBits > maxShelfBits {
+		return nil, fmt.Errorf("%w: shelf bits %d, must be at most %d", ErrInvalidOptions, opts.ShelfBits, maxShelfBits)
+	}
+	db.slotBits = uint(keyBits - opts.shelfBits())
+	if opts.DeleteMode > DeleteTombstone {
+		return nil, fmt.Errorf("%w: delete mode %d", ErrInvalidOptions, opts.DeleteMode)
+	}
+	if opts.Placement > PlacementSpreadLargest {
+		return nil, fmt.Errorf("%w: placement %d", ErrInvalidOptions, opts.Placement)
+	}
+	if opts.Name != "" && !validDatasetName(opts.Name) {
+		return nil, fmt.Errorf("%w: dataset name %q", ErrInvalidOptions, opts.Name)
+	}
+	if opts.FixedValueSize != 0 {
+		if slotSizeFn != nil {
+			return nil, fmt.Errorf("%w: slot sizes with fixed value size", ErrInvalidOptions)
 		}
-		prevSlotSize = slotSize
-		shelfet, err := openShelf(opts.Path, slotSize, wrapShelfDataFn(len(db.shelves), onData), opts.Readonly)
-		if err != nil {
-			db.Close() // Close shelves
+		if opts.CompactHeader || opts.Sequence || opts.Compression || opts.Timestamps || opts.Checksum || opts.TailLength {
+			return nil, fmt.Errorf("%w: item header fields with fixed value size", ErrInvalidOptions)
+		}
+		if opts.DeleteMode == DeleteTombstone || opts.SlotAlignment > 1 || opts.OverflowDir != "" {
+			return nil, fmt.Errorf("%w: fixed value size with tombstones, slot alignment or overflow", ErrInvalidOptions)
+		}
+		size := opts.FixedValueSize
+		slotSizeFn = func() (uint32, bool) { return size, true }
+	}
+	if opts.MaxOpenFiles < 0 {
+		return nil, fmt.Errorf("%w: max open files %d", ErrInvalidOptions, opts.MaxOpenFiles)
+	}
+	if opts.Mmap && !opts.Readonly {
+		return nil, fmt.Errorf("%w: mmap requires read-only mode", ErrInvalidOptions)
+	}
+	if opts.DefaultCodec != CodecNone && !opts.Compression {
+		return nil, fmt.Errorf("%w: default codec requires compression", ErrInvalidOptions)
+	}
+	if opts.ShelfCodecFn != nil && !opts.Compression {
+		return nil, fmt.Errorf("%w: shelf codecs require compression", ErrInvalidOptions)
+	}
+	if _, err := opts.DefaultCodec.compressor(); err != nil {
+		return nil, err
+	}
+	db.codec = opts.DefaultCodec
+	db.placement = opts.Placement
+	db.deferDeletes = opts.DeferDeletes
+	if (opts.SkipScan || opts.BackgroundScan) && onData != nil {
+		return nil, fmt.Errorf("%w: onData callback without the scan on open", ErrInvalidOptions)
+	}
+	if opts.BackgroundScan && opts.BulkLoad {
+		return nil, fmt.Errorf("%w: background scan in bulk-load mode", ErrInvalidOptions)
+	}
+	if opts.BulkLoad {
+		if onData != nil {
+			return nil, fmt.Errorf("%w: onData callback", ErrBulkLoad)
+		}
+		db.bulk = 1
+	}
+	if opts.FS == nil {
+		opts.FS = osFS{}
+	}
+	db.opts, db.fs, db.path, db.readonly = opts, opts.FS, opts.Path, opts.Readonly
+	if finfo, err := db.fs.Stat(opts.Path); err != nil {
+		return nil, err
+	} else if !finfo.IsDir() {
+		return nil, fmt.Errorf("%w: '%v'", ErrNotDirectory, opts.Path)
+	}
+	sizes, err := slotSizes(slotSizeFn, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Checking the smallest slot suffices: slots too large for the compact
+	// header are far larger than any header, too.
+	if err := opts.checkSlotSize(sizes[0]); err != nil {
+		return nil, err
+	}
+	if opts.DirectIO {
+		for _, size := range sizes {
+			if size%DirectIOAlignment != 0 {
+				return nil, fmt.Errorf("%w: direct I/O needs slot sizes aligned to %d, have %d", ErrInvalidOptions, DirectIOAlignment, size)
+			}
+		}
+	}
+	db.slotSizes = sizes
+	if opts.OverflowDir != "" {
+		if db.overflow, err = openOverflow(db.fs, opts.OverflowDir); err != nil {
 			return nil, err
 		}
-		db.shelves = append(db.shelves, shelfet)
-
-		if id := len(db.shelves) & 0xfff; id < prevId {
-			return nil, fmt.Errorf("too many shelves (%d)", len(db.shelves))
-		} else {
-			prevId = id
+	}
+	if err := db.openShelves(onData); err != nil {
+		return nil, err
+	}
+	if opts.PersistMetrics {
+		if err := db.loadMetrics(); err != nil {
+			for _, shelf := range db.shelves {
+				shelf.Close()
+			}
+			return nil, err
 		}
 	}
+	db.onClose = opts.OnClose
+	db.startBackground()
 	return db, nil
 }
 
-// Put stores the data to the underlying database, and returns the key needed
-// for later accessing the data.
-// The data is copied by the database, and is safe to modify after the method returns
-func (db *database) Put(data []byte) (uint64, error) {
-	// Search uses binary search to find and return the smallest index i
-	// in [0, n) at which f(i) is true,
-	index := sort.Search(len(db.shelves), func(i int) bool {
-		return len(data)+itemHeaderSize <= int(db.shelves[i].slotSize)
-	})
-	if index == len(db.shelves) {
-		return 0, fmt.Errorf("no shelf found for size %d", len(data))
-	}
-	if slot, err := db.shelves[index].Put(data); err != nil {
-		return 0, err
-	} else {
-		return slot | uint64(index)<<28, nil
+// shelfBits returns the number of key bits used for the shelf id.
+func (opts Options) shelfBits() int {
+	if opts.ShelfBits == 0 {
+		return defaultShelfBits
 	}
+	return opts.ShelfBits
 }
 
-// Get retrieves the data stored at the given key.
-func (db *database) Get(key uint64) ([]byte, error) {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].Get(key & 0x0FFFFFFF)
+// ValidateSlotSizeFn runs the generator to completion, and checks that the slot
+// sizes it yields are valid for Open with default options: strictly
+// increasing, at most 4096 of them, and each large enough for the item header
+// and some data. It returns the slot sizes, or an error wrapping
+// ErrInvalidSlotSize (ErrSlotTooSmall for the latter) or ErrTooManyShelves.
+// No files are touched.
+func ValidateSlotSizeFn(fn SlotSizeFn) ([]uint32, error) {
+	opts := Options{}
+	sizes, err := slotSizes(fn, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.checkSlotSize(sizes[0]); err != nil {
+		return nil, err
+	}
+	return sizes, nil
 }
 
-// Delete marks the data for deletion, which means it will (eventually) be
-// overwritten by other data. After calling Delete with a given key, the results
-// from doing Get(key) is undefined -- it may return the same data, or some other
-// data, or fail with an error.
-func (db *database) Delete(key uint64) error {
-	id := int(key>>28) & 0xfff
-	return db.shelves[id].Delete(key & 0x00FFFFFF)
+// checkSlotSize verifies that a slot of the given size can hold the item
+// header configured in the options, and at least one byte of data.
+func (opts Options) checkSlotSize(slotSize uint32) error {
+	if slotSize < minSlotSize {
+		return fmt.Errorf("%w: %d smaller than minimum (%d)", ErrSlotTooSmall, slotSize, minSlotSize)
+	}
+	if hdrSize := opts.headerSize(slotSize); slotSize <= hdrSize {
+		return fmt.Errorf("%w: %d too small for header size %d", ErrSlotTooSmall, slotSize, hdrSize)
+	}
+	return nil
 }
 
-// OnDataFn is used to iterate the entire dataset in the database.
-// After the method returns, the content of 'data' will be modified by
-// the iterator, so it needs to be copied if it is to be used later.
-type OnDataFn func(key uint64, data []byte)
+// headerSize returns the number of bytes of a slot of the given size taken by
+// the item header, and the tail length, with the options.
+func (opts Options) headerSize(slotSize uint32) uint32 {
+	if opts.FixedValueSize != 0 {
+		return 0 // No item header
+	}
+	hdrSize := uint32(itemHeaderSize)
+	if opts.CompactHeader && slotSize <= maxCompactSlotSize {
+		hdrSize = compactItemHeaderSize
+	}
+	if opts.Sequence {
+		hdrSize += seqSize
+	}
+	if opts.Compression {
+		hdrSize += codecSize
+	}
+	if opts.Timestamps {
+		hdrSize += timestampSize
+	}
+	if opts.Checksum {
+		hdrSize += checksumSize
+	}
+	if opts.TailLength {
+		hdrSize += tailLengthSize
+	}
+	return hdrSize
+}
 
-func wrapShelfDataFn(shelfId int, onData OnDataFn) onShelfDataFn {
-	if onData == nil {
-		return nil
+// slotSizes collects the slot sizes yielded by the slotSizeFn, aligned as
+// configured in the options.
+func slotSizes(slotSizeFn SlotSizeFn, opts Options) ([]uint32, error) {
+	var (
+		sizes        []uint32
+		prevSlotSize uint32
+		slotSize     uint32
+		done         bool
+		limit        = opts.maxShelves()
+	)
+	for i := 0; !done; i++ {
+		slotSize, done = slotSizeFn()
+		if slotSize <= prevSlotSize {
+			return nil, &ErrNonIncreasingSlotSizes{Index: i, Prev: prevSlotSize, Size: slotSize}
+		}
+		prevSlotSize = slotSize
+		if align := uint64(opts.SlotAlignment); align > 1 {
+			aligned := (uint64(slotSize) + align - 1) / align * align
+			if aligned > maxSlotSize {
+				return nil, fmt.Errorf("%w: %d overflows when aligned to %d", ErrInvalidSlotSize, slotSize, align)
+			}
+			slotSize = uint32(aligned)
+			if n := len(sizes); n > 0 && sizes[n-1] == slotSize {
+				continue // Merge with the previous shelf
+			}
+		}
+		if len(sizes) == limit {
+			return nil, fmt.Errorf("%w: limit is %d", ErrTooManyShelves, limit)
+		}
+		sizes = append(sizes, slotSize)
 	}
-	return func(slot uint64, data []byte) {
-		key := slot | uint64(shelfId)<<28
-		onData(key, data)
+	return sizes, nil
+}
+
+// maxShelves returns the maximum number of shelves, see Options.MaxShelves.
+func (opts Options) maxShelves() int {
+	if max := 1 << opts.shelfBits(); opts.MaxShelves <= 0 || opts.MaxShelves > max {
+		return max
 	}
+	return opts.MaxShelves
 }
 
-// Iterate iterates through all the data in the database, and invokes the
-// given onData method for every element
-func (db *database) Iterate(onData OnDataFn) {
-	for i, b := range db.shelves {
-		b.Iterate(wrapShelfDataFn(i, onData))
+// openShelves reads the manifest and opens the shelves of the database, with
+// the slot sizes in db.slotSizes. If opening fails, shelves already opened are
+// closed again.
+func (db *database) openShelves(onData OnDataFn) error {
+	opts := db.opts
+	m, err := readLayoutManifest(db.fs, opts.Path, opts.Name)
+	if err != nil {
+		return err
+	}
+	newDb := m == nil
+	if newDb {
+		m = newManifest(opts)
+	} else if err := m.check(opts); err != nil {
+		return err
+	} else if err := m.checkSlotSizes(db.slotSizes); err != nil {
+		return err
+	}
+	cfg := shelfConfig{
+		readonly:      opts.Readonly,
+		compactHeader: m.CompactHeader,
+		strictDelete:  opts.StrictDelete,
+		skipScan:      opts.SkipScan || atomic.LoadInt32(&db.bulk) == 1 || opts.BackgroundScan && db.scanDone == nil,
+		checksum:      m.Checksum,
+		tailLength:    m.TailLength,
+		fixed:         m.FixedValueSize != 0,
+		retries:       opts.WriteRetries,
+		journal:       opts.Journal,
+		fs:            db.fs,
+		maxGaps:       opts.MaxGapListEntries,
+		codecs:        m.Compression,
+		writeBuffer:   opts.WriteBufferBytes,
+		mmap:          opts.Mmap,
+		tombstones:    opts.DeleteMode == DeleteTombstone,
+		directIO:      opts.DirectIO,
+		onWarning:     opts.OnWarning,
+		sizeHistogram: opts.TrackSizeHistogram,
 	}
+	if opts.MaxOpenFiles > 0 {
+		cfg.files = newFilePool(opts.MaxOpenFiles)
+	}
+	codecs, err := m.shelfCodecs(db.slotSizes, opts)
+	if err != nil {
+		return err
+	}
+	db.shelfCodecs = codecs != nil
+	names, err := findShelfFiles(db.fs, opts.Path, opts.Name)
+	if err != nil {
+		return err
+	}
+	db.checksum = m.Checksum
+	if m.Sequence {
+		db.useSeq = true
+		cfg.seq = &db.seq
+	}
+	if m.Timestamps {
+		db.timestamps = true
+		cfg.clock = &db.clock
+	}
+	closeShelves := func() {
+		for _, shelf := range db.shelves {
+			shelf.Close()
+		}
+		db.shelves = nil
+	}
+	for _, slotSize := range db.slotSizes {
+		cfg.onGrow = wrapShelfGrowFn(len(db.shelves), opts.OnGrow)
+		cfg.codec = db.codec
+		if codecs != nil {
+			cfg.codec = codecs[len(db.shelves)]
+		}
+		cfg.name = db.shelfFileName(names, slotSize)
+		if opts.SkipMissingShelves && !newDb && len(db.shelves) < len(m.SlotSizes) && names[slotSize] == "" {
+			// The file existed, since the shelf is recorded in the
+			// manifest. It's not recreated, so that it can be restored.
+			err := fmt.Errorf("%w: shelf %d: file missing", ErrShelfUnavailable, len(db.shelves))
+			db.shelves = append(db.shelves, unavailableShelf(slotSize, opts.headerSize(slotSize), err))
+			continue
+		}
+		span := startSpan(db.tracer, "Compact")
+		shelfet, err := openShelf(opts.Path, slotSize, db.wrapShelfDataFn(len(db.shelves), onData), cfg)
+		span.End()
+		if err != nil && opts.SkipMissingShelves {
+			err = fmt.Errorf("%w: shelf %d: %v", ErrShelfUnavailable, len(db.shelves), err)
+			shelfet = unavailableShelf(slotSize, opts.headerSize(slotSize), err)
+		} else if err != nil {
+			closeShelves()
+			return err
+		}
+		db.shelves = append(db.shelves, shelfet)
+	}
+	if (newDb || !m.hasSlotSizes(db.slotSizes) || codecs != nil && !m.hasShelfCodecs(codecs)) && !opts.Readonly {
+		m.SlotSizes = db.slotSizes
+		m.ShelfCodecs = codecs
+		if err := writeManifest(db.fs, opts.Path, opts.Name, m); err != nil {
+			closeShelves()
+			return err
+		}
+	}
+	db.manifest, db.shelfCfg = m, cfg
+	return nil
 }
 
-func (db *database) Limits() (uint32, uint32) {
-	smallest := db.shelves[0].slotSize
-	largest := db.shelves[len(db.shelves)-1].slotSize
-	return smallest, largest
+// shelfFileName returns the name of the file of the next shelf, with the given
+// slot size: the existing one among names, if any, otherwise the one in the
+// naming scheme of the options, or "" for the default name.
+func (db *database) shelfFileName(names map[uint32]string, slotSize uint32) string {
+	opts := db.opts
+	if name := names[slotSize]; name != "" {
+		return name
+	}
+	if opts.EncodeSlotSizeInName {
+		return datasetFile(opts.Name, shelfName(len(db.shelves), slotSize))
+	}
+	if opts.Name != "" {
+		return datasetFile(opts.Name, legacyShelfName(slotSize))
+	}
+	return ""
 }
 
-// Close implements io.Closer
-func (db *database) Close() error {
-	var err error
-	for _, shelf := range db.shelves {
-		if e := shelf.Close(); e != nil {
-			err = e
+// AddShelf appends a shelf with the given slot size, which must be larger than
+// the slot sizes of the existing shelves, and returns its index. The size is
+// aligned as configured in Options.SlotAlignment. Puts of values too large for
+// the previous shelves then go to the new one, instead of failing with
+// ErrValueTooLarge or going to Options.OverflowDir. The shelf is recorded in
+// the manifest, but like any shelf at the end, it's only opened again if the
+// SlotSizeFn passed to Open yields it. If the file of the shelf exists, e.g.
+// since the database was opened with fewer shelves than before, its items are
+// kept.
+func (db *database) AddShelf(slotSize uint32) (int, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	if db.readonly {
+		return 0, ErrReadOnly
+	}
+	opts := db.opts
+	if opts.FixedValueSize != 0 {
+		return 0, fmt.Errorf("%w: adding a shelf with fixed value size", ErrInvalidOptions)
+	}
+	if align := uint64(opts.SlotAlignment); align > 1 {
+		aligned := (uint64(slotSize) + align - 1) / align * align
+		if aligned > maxSlotSize {
+			return 0, fmt.Errorf("%w: %d overflows when aligned to %d", ErrInvalidSlotSize, slotSize, align)
 		}
+		slotSize = uint32(aligned)
 	}
-	return err
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	index := len(db.shelves)
+	if prev := db.slotSizes[index-1]; slotSize <= prev {
+		return 0, &ErrNonIncreasingSlotSizes{Index: index, Prev: prev, Size: slotSize}
+	}
+	if index == opts.maxShelves() {
+		return 0, fmt.Errorf("%w: limit is %d", ErrTooManyShelves, index)
+	}
+	names, err := findShelfFiles(db.fs, opts.Path, opts.Name)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		m      = *db.manifest
+		cfg    = db.shelfCfg
+		codecs []Codec
+	)
+	cfg.onGrow = wrapShelfGrowFn(index, opts.OnGrow)
+	cfg.codec = db.codec
+	if db.shelfCodecs {
+		if opts.ShelfCodecFn != nil {
+			cfg.codec = opts.ShelfCodecFn(index, slotSize)
+		}
+		if _, err := cfg.codec.compressor(); err != nil {
+			return 0, fmt.Errorf("shelf %d: %w", index, err)
+		}
+		codecs = append(append(codecs, m.ShelfCodecs...), cfg.codec)
+	}
+	cfg.name = db.shelfFileName(names, slotSize)
+	shelf, err := openShelf(opts.Path, slotSize, nil, cfg)
+	if err != nil {
+		return 0, err
+	}
+	sizes := append(append([]uint32(nil), db.slotSizes...), slotSize)
+	m.SlotSizes, m.ShelfCodecs = sizes, codecs
+	if err := writeManifest(db.fs, opts.Path, opts.Name, &m); err != nil {
+		shelf.Close()
+		return 0, err
+	}
+	db.shelves = append(db.shelves, shelf)
+	db.slotSizes, db.manifest = sizes, &m
+	return index, nil
+}
+
+// OpenFixed opens a (new or existing) database with a single shelf, using the
+// given slot size. It is meant for uniformly-sized records.
+func OpenFixed(opts Options, slotSize uint32, onData OnDataFn) (Database, error) {
+	return Open(opts, func() (uint32, bool) {
+		return slotSize, true
+	}, onData)
+}
+
+// RebuildIndex opens the database in read-only mode, and invokes onItem for
+// every item stored in it. It is meant for rebuilding an external key index
+// from scratch. If onItem returns an error, no further items are delivered,
+// and the error is returned.
+func RebuildIndex(opts Options, slotSizeFn SlotSizeFn, onItem func(key uint64, data []byte) error) error {
+	var itemErr error
+	opts.Readonly = true
+	db, err := Open(opts, slotSizeFn, func(key uint64, data []byte) {
+		if itemErr == nil {
+			itemErr = onItem(key, data)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return itemErr
+}
+
+// Put stores the data to the underlying database, and returns the key needed
+// for later accessing the data.
+// The data is copied by the database, and is safe to modify after the method returns
+// The key is deterministic: within the chosen shelf, the lowest free slot is
+// reused, regardless of the order the slots were freed in, and the shelf is
+// only extended once there are none left. That is the order FreeSlots reports.
+// Concurrent Puts to the same shelf get the slots in an unspecified order.
+func (db *database) Put(data []byte) (uint64, error) {
+	key, _, err := db.PutEx(data)
+	return key, err
+}
+
+// PutEx is like Put, but also returns the number of bytes wasted in the slot,
+// that is, the slot size minus the item size including the header.
+func (db *database) PutEx(data []byte) (uint64, uint32, error) {
+	defer startSpan(db.tracer, "Put").End()
+	if err := db.checkOpen(); err != nil {
+		return 0, 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	key, waste, err := db.putEx(data, db.putCodec(len(data)))
+	if err == nil {
+		db.counters.put(len(data))
+	}
+	return key, waste, err
+}
+
+// putCodec returns the codec Put uses for data of the given size: the codec of
+// the shelf which would hold it uncompressed, or Options.DefaultCodec. The
+// caller must hold db.mu.
+func (db *database) putCodec(size int) Codec {
+	if !db.shelfCodecs {
+		return db.codec
+	}
+	if index := db.shelfIndex(size); index < len(db.shelves) {
+		return db.shelves[index].codec
+	}
+	return db.codec
+}
+
+// PutCompressed is like Put, but compresses the data with the given codec,
+// instead of Options.DefaultCodec. The codec is stored along with the item,
+// and Get decompresses accordingly. It requires Options.Compression.
+func (db *database) PutCompressed(data []byte, codec Codec) (uint64, error) {
+	defer startSpan(db.tracer, "Put").End()
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	key, _, err := db.putEx(data, codec)
+	if err == nil {
+		db.counters.put(len(data))
+	}
+	return key, err
+}
+
+// PutAt stores the data at the given key, instead of letting the database pick
+// one, e.g. to restore items exported along with their keys. The key must
+// belong to an existing shelf, and the data (as compressed with the codec of
+// the shelf) must fit its slots, otherwise ErrOversized is
+// returned. If the slot is beyond the end of the shelf, the shelf is extended,
+// and the slots in between become free. If the slot is in use, its data is
+// overwritten. Pending deferred deletes of the key are dropped.
+func (db *database) PutAt(key uint64, data []byte) error {
+	defer startSpan(db.tracer, "Put").End()
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrEmptyData
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return err
+	}
+	stored, err := shelf.codec.compress(data)
+	if err != nil {
+		return err
+	}
+	if db.deferDeletes {
+		db.pendingMu.Lock()
+		for i := 0; i < len(db.pending); i++ {
+			if db.pending[i] == key {
+				db.pending = append(db.pending[:i], db.pending[i+1:]...)
+				i--
+			}
+		}
+		db.pendingMu.Unlock()
+	}
+	return shelf.PutAt(stored, shelf.codec, slot)
+}
+
+// ReserveBlock reserves count contiguous slots in the smallest shelf which
+// can hold items of the given size, and returns their keys, in slot order. The
+// slots are taken from the end of the shelf, never from the gap-list, so that
+// items which are read together can be stored next to each other, with PutAt.
+// Until then, Get of a reserved key returns ErrNeverWritten. Each key can be
+// written and deleted on its own. Reserved slots which are still unwritten on
+// Close are freed on the next open. A count below one reserves nothing.
+func (db *database) ReserveBlock(count int, size int) ([]uint64, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if db.readonly {
+		return nil, ErrReadOnly
+	}
+	if size < 1 {
+		return nil, ErrEmptyData
+	}
+	if count < 1 {
+		return nil, nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	index := db.shelfIndex(size)
+	if index == len(db.shelves) {
+		return nil, fmt.Errorf("%w: no shelf found for size %d", ErrValueTooLarge, size)
+	}
+	if err := db.shelves[index].unavailable; err != nil {
+		return nil, err
+	}
+	first, err := db.shelves[index].reserveBlock(uint64(count))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]uint64, count)
+	for i := range keys {
+		keys[i] = db.MakeKey(index, first+uint64(i))
+	}
+	return keys, nil
+}
+
+// putEx implements PutEx, compressing the data with the given codec. The caller
+// must hold db.mu.
+func (db *database) putEx(data []byte, codec Codec) (uint64, uint32, error) {
+	if len(data) == 0 {
+		return 0, 0, ErrEmptyData
+	}
+	if size := db.opts.FixedValueSize; size != 0 && uint32(len(data)) != size {
+		return 0, 0, fmt.Errorf("%w: %d bytes, values have %d", ErrWrongSize, len(data), size)
+	}
+	stored, err := codec.compress(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	index := db.shelfIndex(len(stored))
+	if index == len(db.shelves) && db.overflow != nil {
+		if db.readonly {
+			return 0, 0, ErrReadOnly
+		}
+		key, err := db.overflow.put(data)
+		return key, 0, err
+	}
+	if index == len(db.shelves) {
+		return 0, 0, fmt.Errorf("%w: no shelf found for size %d", ErrValueTooLarge, len(stored))
+	}
+	if db.placement == PlacementSpreadLargest && index < len(db.shelves)-1 {
+		index++
+	}
+	shelf := db.shelves[index]
+	if shelf.unavailable != nil {
+		return 0, 0, shelf.unavailable
+	}
+	slot, err := shelf.PutCodec(stored, codec)
+	if err != nil {
+		return 0, 0, err
+	}
+	return db.MakeKey(index, slot), shelf.capacity() - uint32(len(stored)), nil
+}
+
+// shelfIndex returns the index of the smallest shelf which can hold data of the
+// given size, or len(db.shelves) if there is none. The shelf chosen by the
+// previous call is checked first, which skips the binary search for streams of
+// similarly-sized data.
+func (db *database) shelfIndex(size int) int {
+	if last := int(atomic.LoadInt32(&db.lastShelf)); size <= int(db.shelves[last].capacity()) &&
+		(last == 0 || size > int(db.shelves[last-1].capacity())) {
+		return last
+	}
+	index := db.searchShelf(size)
+	if index < len(db.shelves) {
+		atomic.StoreInt32(&db.lastShelf, int32(index))
+	}
+	return index
+}
+
+// searchShelf returns the index of the smallest shelf which can hold data of
+// the given size, or len(db.shelves) if there is none.
+func (db *database) searchShelf(size int) int {
+	// Search uses binary search to find and return the smallest index i
+	// in [0, n) at which f(i) is true,
+	return sort.Search(len(db.shelves), func(i int) bool {
+		return size <= int(db.shelves[i].capacity())
+	})
+}
+
+// Get retrieves the data stored at the given key.
+func (db *database) Get(key uint64) ([]byte, error) {
+	defer startSpan(db.tracer, "Get").End()
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	data, err := db.get(key)
+	if err == nil {
+		db.counters.get(len(data))
+	}
+	return data, err
+}
+
+// get implements Get.
+func (db *database) get(key uint64) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if key&overflowBit != 0 && db.overflow != nil {
+		return db.overflow.get(key)
+	}
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := shelf.Get(slot)
+	if errors.Is(err, ErrChecksumMismatch) && db.repair != nil {
+		return db.repairItem(shelf, key, slot, err)
+	}
+	return data, err
+}
+
+// maxGetters is the max number of goroutines run by GetContext at once, per
+// database, including the abandoned ones.
+const maxGetters = 64
+
+// GetContext is like Get, but returns the error of the context if it's done
+// before the data has been read, e.g. on a slow disk. Since reads from a file
+// can't be interrupted, Get is run on a goroutine of its own, which is
+// abandoned in that case: it holds the locks taken by Get until the read
+// returns, so that e.g. Close still waits for it. Each call which gives up
+// leaves such a goroutine behind, until the disk responds. At most maxGetters
+// of them run at once; further calls wait for one to exit, or for the context.
+func (db *database) GetContext(ctx context.Context, key uint64) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	select {
+	case db.getters <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1) // Buffered, so that an abandoned Get exits
+	go func() {
+		defer func() { <-db.getters }()
+		data, err := db.Get(key)
+		done <- result{data, err}
+	}()
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetTimeout is like GetContext, with a context which expires after the given
+// duration, so context.DeadlineExceeded is returned if the data has not been
+// read by then.
+func (db *database) GetTimeout(key uint64, d time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	return db.GetContext(ctx, key)
+}
+
+// repairItem fetches the data of an item which failed its checksum from the
+// repair function, and rewrites the slot with it.
+func (db *database) repairItem(shelf *shelf, key, slot uint64, cause error) ([]byte, error) {
+	data, err := db.repair(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w (repair failed: %v)", cause, err)
+	}
+	if shelf.readonly {
+		return data, nil
+	}
+	if err := shelf.Update(data, slot); err != nil {
+		return nil, fmt.Errorf("%w (repair failed: %v)", cause, err)
+	}
+	return data, nil
+}
+
+// Len returns the length of the data stored at the given key, without reading
+// the data itself.
+func (db *database) Len(key uint64) (int, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if key&overflowBit != 0 && db.overflow != nil {
+		return db.overflow.size(key)
+	}
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return 0, err
+	}
+	size, err := shelf.Len(slot)
+	return int(size), err
+}
+
+// Location describes where an item is stored, as returned by Locate.
+type Location struct {
+	Shelf    int    // Index of the shelf
+	Slot     uint64 // Slot within the shelf
+	Offset   int64  // Byte offset of the slot in the shelf file
+	SlotSize uint32 // Slot size of the shelf
+	Length   uint32 // Length of the data as stored, excluding the item header
+}
+
+// Locate returns where the item with the given key is stored. It's meant for
+// diagnostics, and reads only the item header.
+func (db *database) Locate(key uint64) (Location, error) {
+	if err := db.checkOpen(); err != nil {
+		return Location{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return Location{}, err
+	}
+	size, err := shelf.Len(slot)
+	if err != nil {
+		return Location{}, err
+	}
+	return Location{
+		Shelf:    int(key >> db.slotBits),
+		Slot:     slot,
+		Offset:   int64(slot) * int64(shelf.slotSize),
+		SlotSize: shelf.slotSize,
+		Length:   size,
+	}, nil
+}
+
+// MakeKey returns the key of the given slot of the i:th shelf. The split of
+// the key bits depends on Options.ShelfBits.
+func (db *database) MakeKey(shelf int, slot uint64) uint64 {
+	return uint64(shelf)<<db.slotBits | slot
+}
+
+// ParseKey splits the key into the index of the shelf and the slot within it.
+// The split of the key bits depends on Options.ShelfBits.
+func (db *database) ParseKey(key uint64) (int, uint64) {
+	return int(key >> db.slotBits), key & (1<<db.slotBits - 1)
+}
+
+// NthKey returns the key of slot n of the shelf with the given index, in a
+// database opened with the default Options.ShelfBits, without needing the
+// database. The slot is the n:th item Put into an empty shelf, as long as
+// nothing is deleted. Slots are limited to the low 28 bits of the key, and the
+// shelf index to the 12 bits above; for other splits, see Database.MakeKey.
+func NthKey(shelfID int, n uint32) uint64 {
+	return uint64(shelfID)<<slotBits | uint64(n)
+}
+
+// shelfFor decodes the given key into a shelf and a slot within that shelf.
+// The caller must hold db.mu.
+func (db *database) shelfFor(key uint64) (*shelf, uint64, error) {
+	if key>>db.slotBits >= uint64(len(db.shelves)) {
+		return nil, 0, fmt.Errorf("%w: shelf %d, have %d shelves", ErrShelfOutOfRange, key>>db.slotBits, len(db.shelves))
+	}
+	id, slot := db.ParseKey(key)
+	if err := db.shelves[id].unavailable; err != nil {
+		return nil, 0, err
+	}
+	return db.shelves[id], slot, nil
+}
+
+// Delete marks the data for deletion, which means it will (eventually) be
+// overwritten by other data. After calling Delete with a given key, the results
+// from doing Get(key) is undefined -- it may return the same data, or some other
+// data, or fail with an error. With DeleteTombstone, Get returns ErrDeleted
+// until the slot is reused.
+func (db *database) Delete(key uint64) error {
+	defer startSpan(db.tracer, "Delete").End()
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.delete(key)
+}
+
+// delete implements Delete. The caller must hold db.mu.
+func (db *database) delete(key uint64) error {
+	if atomic.LoadInt32(&db.bulk) == 1 {
+		return ErrBulkLoad
+	}
+	if key&overflowBit != 0 && db.overflow != nil {
+		if db.readonly {
+			return ErrReadOnly
+		}
+		return db.overflow.delete(key)
+	}
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return err
+	}
+	if !db.deferDeletes {
+		return shelf.Delete(slot)
+	}
+	if _, tail := shelf.slotCounts(); slot >= tail {
+		return fmt.Errorf("%w: shelf %d, slot %d, tail %d", ErrBadIndex, shelf.slotSize, slot, tail)
+	}
+	db.pendingMu.Lock()
+	db.pending = append(db.pending, key)
+	db.pendingMu.Unlock()
+	return nil
+}
+
+// ApplyDeletes applies the deletes queued because of Options.DeferDeletes,
+// after which the slots may be reused. It is also done by Sync, Close and the
+// compaction methods.
+func (db *database) ApplyDeletes() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.applyDeletes()
+}
+
+// applyDeletes implements ApplyDeletes. The caller must hold db.mu.
+func (db *database) applyDeletes() error {
+	db.pendingMu.Lock()
+	pending := db.pending
+	db.pending = nil
+	db.pendingMu.Unlock()
+
+	var err error
+	for _, key := range pending {
+		shelf, slot, e := db.shelfFor(key)
+		if e == nil {
+			e = shelf.Delete(slot)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Append appends extra to the data stored at the given key. If the slot has
+// room for it, the data is extended in place and the same key is returned.
+// Otherwise, the data is moved to a shelf with larger slots, and the new key is
+// returned. Moving the data is not atomic: the new copy is written before the
+// old one is deleted. The data is stored with the codec Put would use (see
+// Options.DefaultCodec and Options.ShelfCodecFn), regardless of how it was
+// stored before.
+func (db *database) Append(key uint64, extra []byte) (uint64, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return 0, err
+	}
+	data, err := shelf.Get(slot)
+	if err != nil {
+		return 0, err
+	}
+	if len(extra) == 0 {
+		return key, nil
+	}
+	data = append(data, extra...)
+	stored, err := shelf.codec.compress(data)
+	if err != nil {
+		return 0, err
+	}
+	if len(stored) <= int(shelf.capacity()) {
+		return key, shelf.UpdateCodec(stored, shelf.codec, slot)
+	}
+	newKey, _, err := db.putEx(data, db.putCodec(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	return newKey, db.delete(key)
+}
+
+// Shrink moves the data stored at the given key to the shelf with the smallest
+// slots it fits in, e.g. after it was placed in a larger one by
+// PlacementSpreadLargest, and returns the new key. If the data is in that shelf
+// already, or in Options.OverflowDir, the same key is returned. Like with
+// Append, moving the data is not atomic, and the data is stored with the codec
+// Put would use.
+func (db *database) Shrink(key uint64) (uint64, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if key&overflowBit != 0 && db.overflow != nil {
+		return key, nil
+	}
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return 0, err
+	}
+	data, err := shelf.Get(slot)
+	if err != nil {
+		return 0, err
+	}
+	codec := db.putCodec(len(data))
+	stored, err := codec.compress(data)
+	if err != nil {
+		return 0, err
+	}
+	index, _ := db.ParseKey(key)
+	smallest := db.searchShelf(len(stored))
+	if smallest >= index {
+		return key, nil
+	}
+	target := db.shelves[smallest]
+	if target.unavailable != nil {
+		return 0, target.unavailable
+	}
+	newSlot, err := target.PutCodec(stored, codec)
+	if err != nil {
+		return 0, err
+	}
+	return db.MakeKey(smallest, newSlot), db.delete(key)
+}
+
+// Swap replaces the data stored at the given key in place, and returns the data
+// it replaces. The new data must fit in the slot of the key, otherwise
+// ErrOversized is returned and nothing is changed. The read and the write are
+// atomic with respect to other writes to the key: the shelf is locked
+// exclusively in between, so other writes to it have to wait. The data is stored
+// with the codec of the shelf, see Options.ShelfCodecFn.
+func (db *database) Swap(key uint64, data []byte) ([]byte, error) {
+	defer startSpan(db.tracer, "Swap").End()
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrEmptyData
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := shelf.codec.compress(data)
+	if err != nil {
+		return nil, err
+	}
+	return shelf.Swap(stored, shelf.codec, slot)
+}
+
+// FinishBulkLoad ends bulk-load mode. Since the shelves were not scanned on
+// open, they are scanned now to build the gap-list, in case the files already
+// contained deleted slots. Calling it when not in bulk-load mode is a no-op.
+func (db *database) FinishBulkLoad() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if atomic.LoadInt32(&db.bulk) == 0 {
+		return nil
+	}
+	for _, shelf := range db.shelves {
+		if err := shelf.scanGaps(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&db.bulk, 0)
+	return nil
+}
+
+// OnDataFn is used to iterate the entire dataset in the database.
+// After the method returns, the content of 'data' will be modified by
+// the iterator, so it needs to be copied if it is to be used later.
+type OnDataFn func(key uint64, data []byte)
+
+func (db *database) wrapShelfDataFn(shelfId int, onData OnDataFn) onShelfDataFn {
+	if onData == nil {
+		return nil
+	}
+	id := db.MakeKey(shelfId, 0)
+	return func(slot uint64, data []byte) {
+		onData(id|slot, data)
+	}
+}
+
+func wrapShelfGrowFn(shelfId int, onGrow func(shelf int, oldSlots, newSlots uint32)) onShelfGrowFn {
+	if onGrow == nil {
+		return nil
+	}
+	return func(oldSlots, newSlots uint64) {
+		onGrow(shelfId, uint32(oldSlots), uint32(newSlots))
+	}
+}
+
+// Iterate iterates through all the data in the database, and invokes the
+// given onData method for every element. Values in Options.OverflowDir come
+// last.
+func (db *database) Iterate(onData OnDataFn) {
+	if db.checkOpen() != nil {
+		return
+	}
+	defer startSpan(db.tracer, "Iterate").End()
+	for i, b := range db.snapshot() {
+		b.Iterate(db.wrapShelfDataFn(i, onData))
+	}
+	if db.overflow != nil {
+		db.overflow.iterate(false, onData)
+	}
+}
+
+// IterateReverse is like Iterate, but visits the items in descending key order:
+// the shelves from the highest index down, and within each shelf, the slots
+// from the high-water mark down to zero. Since the shelf index makes up the
+// high bits of a key, this is the reverse of the order of Iterate. Values in
+// Options.OverflowDir, whose keys have the top bit set, come first.
+func (db *database) IterateReverse(onData OnDataFn) {
+	if db.checkOpen() != nil {
+		return
+	}
+	defer startSpan(db.tracer, "IterateReverse").End()
+	if db.overflow != nil {
+		db.overflow.iterate(true, onData)
+	}
+	shelves := db.snapshot()
+	for i := len(shelves) - 1; i >= 0; i-- {
+		shelves[i].IterateReverse(db.wrapShelfDataFn(i, onData))
+	}
+}
+
+// IterateShelfRange is like Iterate, but only visits the shelves with ids in
+// [lo, hi], which makes it possible to partition work by shelf. The keys passed
+// to onData are the regular database keys.
+func (db *database) IterateShelfRange(lo, hi int, onData OnDataFn) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if lo > hi {
+		return fmt.Errorf("%w: inverted shelf range [%d, %d]", ErrShelfOutOfRange, lo, hi)
+	}
+	shelves := db.snapshot()
+	if lo < 0 || hi >= len(shelves) {
+		return fmt.Errorf("%w: shelf range [%d, %d], have %d shelves", ErrShelfOutOfRange, lo, hi, len(shelves))
+	}
+	defer startSpan(db.tracer, "Iterate").End()
+	for i := lo; i <= hi; i++ {
+		shelves[i].Iterate(db.wrapShelfDataFn(i, onData))
+	}
+	return nil
+}
+
+// IterateGaps invokes onData for every deleted slot which has not yet been
+// reused, with whatever content it currently holds. Since deleted slots are not
+// cleared, this may be the old data, but there are no guarantees: a slot may
+// be only partially overwritten, or already be in the process of being reused.
+// It is a best-effort API, meant for forensics and testing.
+func (db *database) IterateGaps(onData OnDataFn) {
+	if db.checkOpen() != nil {
+		return
+	}
+	for i, b := range db.snapshot() {
+		b.IterateGaps(db.wrapShelfDataFn(i, onData))
+	}
+}
+
+// ReplayInSequence invokes onData for every item, in the order the items were
+// written (an item which has been updated in place counts as written at the
+// time of the update). It requires the database to be opened with
+// Options.Sequence.
+// Items within a shelf are not necessarily in sequence order, since deleted
+// slots are reused and compaction on open moves items around. Therefore, the
+// headers of all items are read first, and the items are then read and
+// delivered in sequence order, with a Get each. The memory needed is 16 bytes
+// per item. Items deleted in between are skipped, unless the deletion isn't
+// visible to Get yet, see Delete.
+func (db *database) ReplayInSequence(onData OnDataFn) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if !db.useSeq {
+		return ErrSequenceDisabled
+	}
+	if db.overflow != nil {
+		return fmt.Errorf("%w: replay with OverflowDir", ErrInvalidOptions)
+	}
+	type seqKey struct {
+		seq uint64
+		key uint64
+	}
+	var items []seqKey
+	for i, shelf := range db.snapshot() {
+		id := db.MakeKey(i, 0)
+		err := shelf.iterateSeq(func(slot, seq uint64) {
+			items = append(items, seqKey{seq, id | slot})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].seq < items[j].seq
+	})
+	for _, item := range items {
+		data, err := db.Get(item.key)
+		if errors.Is(err, ErrDeleted) || errors.Is(err, ErrNeverWritten) {
+			// Deleted since the headers were read
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		onData(item.key, data)
+	}
+	return nil
+}
+
+// CopyTo stores every item into the destination database, which may have a
+// different layout, and reports the old and new key of each item to the
+// optional remap callback. It stops at the first error.
+func (db *database) CopyTo(dst Database, remap func(oldKey, newKey uint64)) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	var err error
+	db.Iterate(func(key uint64, data []byte) {
+		if err != nil {
+			return
+		}
+		var newKey uint64
+		if newKey, err = dst.Put(data); err == nil && remap != nil {
+			remap(key, newKey)
+		}
+	})
+	return err
+}
+
+// Merge stores the items of each of the source databases into the destination,
+// e.g. to combine shards, like CopyTo. Since the keys of different sources
+// collide, it returns a map per source, from the old key of each of its items
+// to the new key in the destination. It stops at the first error, with the maps
+// of the items stored so far.
+func Merge(dst Database, srcs ...Database) ([]map[uint64]uint64, error) {
+	remaps := make([]map[uint64]uint64, len(srcs))
+	for i, src := range srcs {
+		remap := make(map[uint64]uint64)
+		remaps[i] = remap
+		err := src.CopyTo(dst, func(oldKey, newKey uint64) {
+			remap[oldKey] = newKey
+		})
+		if err != nil {
+			return remaps[:i+1], fmt.Errorf("source %d: %w", i, err)
+		}
+	}
+	return remaps, nil
+}
+
+// Warmup reads all shelf files sequentially, to pull them into the OS page
+// cache before the database starts serving requests. It only reads, and is
+// therefore fine to use in read-only mode.
+func (db *database) Warmup() error {
+	return db.WarmupContext(context.Background())
+}
+
+// WarmupContext is like Warmup, but stops early, returning the context error,
+// if the context is cancelled.
+func (db *database) WarmupContext(ctx context.Context) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	for _, shelf := range db.snapshot() {
+		if err := shelf.Warmup(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WarmupShelf reads the file of the i:th shelf sequentially, to pull it into
+// the OS page cache.
+func (db *database) WarmupShelf(i int) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	shelves := db.snapshot()
+	if i < 0 || i >= len(shelves) {
+		return fmt.Errorf("%w: shelf %d, have %d shelves", ErrShelfOutOfRange, i, len(shelves))
+	}
+	return shelves[i].Warmup(context.Background())
+}
+
+// FreeSlots returns a copy of the free slots of the i:th shelf, that is, the
+// slots below the tail which are not in use, in increasing order. For shelves
+// with huge gap-lists, IterateFreeSlots avoids the allocation.
+func (db *database) FreeSlots(i int) ([]uint32, error) {
+	var slots []uint32
+	err := db.IterateFreeSlots(i, func(slot uint32) bool {
+		slots = append(slots, slot)
+		return true
+	})
+	return slots, err
+}
+
+// IterateFreeSlots invokes fn with the free slots of the i:th shelf, in
+// increasing order, until fn returns false. The gap-list is copied in chunks,
+// and fn is invoked without holding any lock, so fn may use the database;
+// concurrent modifications may or may not be reflected.
+func (db *database) IterateFreeSlots(i int, fn func(slot uint32) bool) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	shelves := db.snapshot()
+	if i < 0 || i >= len(shelves) {
+		return fmt.Errorf("%w: shelf %d, have %d shelves", ErrShelfOutOfRange, i, len(shelves))
+	}
+	if atomic.LoadInt32(&db.bulk) == 1 {
+		return ErrBulkLoad
+	}
+	shelves[i].freeSlots(fn)
+	return nil
+}
+
+// Scrub verifies the checksum of every item, to detect corruption before it
+// is read, and returns the keys of the items which fail, or whose header is
+// corrupt. It does not stop at the first bad item. It requires
+// Options.Checksum.
+func (db *database) Scrub() ([]uint64, error) {
+	return db.ScrubContext(context.Background())
+}
+
+// ScrubContext is like Scrub, but stops early if the context is cancelled,
+// returning the bad keys found so far along with the context error.
+func (db *database) ScrubContext(ctx context.Context) ([]uint64, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	if !db.checksum {
+		return nil, fmt.Errorf("%w: checksums not enabled", ErrInvalidOptions)
+	}
+	var bad []uint64
+	for i, shelf := range db.snapshot() {
+		id := db.MakeKey(i, 0)
+		if err := shelf.scrub(ctx, func(slot uint64) {
+			bad = append(bad, id|slot)
+		}); err != nil {
+			return bad, err
+		}
+	}
+	return bad, nil
+}
+
+// KeyRange returns the smallest and largest key currently in use, or ok=false
+// if the database is empty. Since the shelf id occupies the bits above the
+// slot, every key of a shelf is larger than all keys of the shelves before it:
+// the smallest key is the lowest live slot of the first non-empty shelf, and the
+// largest is the highest live slot of the last non-empty shelf.
+// In bulk-load mode, deleted slots are not tracked, and count as live.
+func (db *database) KeyRange() (uint64, uint64, bool) {
+	if db.checkOpen() != nil {
+		return 0, 0, false
+	}
+	var (
+		min, max uint64
+		found    bool
+		shelves  = db.snapshot()
+	)
+	for i, shelf := range shelves {
+		if lo, _, ok := shelf.liveRange(); ok {
+			min, found = db.MakeKey(i, lo), true
+			break
+		}
+	}
+	if !found {
+		return 0, 0, false
+	}
+	for i := len(shelves) - 1; i >= 0; i-- {
+		if _, hi, ok := shelves[i].liveRange(); ok {
+			max = db.MakeKey(i, hi)
+			break
+		}
+	}
+	return min, max, true
+}
+
+// IsValidKey reports whether the key could refer to a live item, e.g. to check
+// keys from untrusted sources before Get: its shelf must exist and be
+// available, and its slot must be below the high-water mark of the shelf, and
+// not in the gap-list. Slots deleted while the gap-list was full (see
+// Options.MaxGapListEntries), or whose delete is still queued because of
+// Options.DeferDeletes, pass the check, as do slots reserved with ReserveBlock
+// but not written yet. Keys in Options.OverflowDir are valid if their file
+// exists.
+func (db *database) IsValidKey(key uint64) bool {
+	if db.checkOpen() != nil {
+		return false
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if key&overflowBit != 0 && db.overflow != nil {
+		_, err := db.overflow.size(key)
+		return err == nil
+	}
+	shelf, slot, err := db.shelfFor(key)
+	return err == nil && shelf.isLive(slot)
+}
+
+func (db *database) Limits() (uint32, uint32) {
+	sizes := db.currentSlotSizes()
+	return sizes[0], sizes[len(sizes)-1]
+}
+
+// currentSlotSizes returns the slot sizes of the shelves. They stay the same
+// across SwapIn, but AddShelf replaces them.
+func (db *database) currentSlotSizes() []uint32 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.slotSizes
+}
+
+// MaxValueSize returns the size of the largest value Put stores in a shelf: the
+// largest slot size minus the item header, which depends on the options (see
+// Options.Checksum, Options.Timestamps etc.). Larger values fail with
+// ErrValueTooLarge, or go to Options.OverflowDir, if configured. With
+// Options.Compression, the size applies to the compressed value, so larger
+// values may fit if they compress well. With Options.FixedValueSize, that is
+// the only size accepted.
+func (db *database) MaxValueSize() int {
+	if size := db.opts.FixedValueSize; size != 0 {
+		return int(size)
+	}
+	shelves := db.snapshot()
+	return int(shelves[len(shelves)-1].capacity())
+}
+
+// FitsShelf reports whether data of the given size fits in a slot of the i:th
+// shelf, that is, whether size plus the item header size is at most the slot
+// size. Data which exactly fills the slot fits; one byte more does not. Put
+// stores data in the first shelf it fits, unless configured otherwise with
+// Options.Placement. It returns false for shelves which
+// don't exist.
+func (db *database) FitsShelf(i int, size int) bool {
+	shelves := db.snapshot()
+	if i < 0 || i >= len(shelves) || size < 0 {
+		return false
+	}
+	return size <= int(shelves[i].capacity())
+}
+
+// Fragmentation returns, for each shelf, the ratio of free slots to the
+// total number of slots below the high-water mark (0 for an empty shelf),
+// along with the same ratio computed across all shelves, weighted by slot count.
+func (db *database) Fragmentation() ([]float64, float64) {
+	var (
+		shelves  = db.snapshot()
+		ratios   = make([]float64, len(shelves))
+		allGaps  uint64
+		allSlots uint64
+	)
+	for i, shelf := range shelves {
+		gaps, tail := shelf.slotCounts()
+		if tail > 0 {
+			ratios[i] = float64(gaps) / float64(tail)
+		}
+		allGaps += gaps
+		allSlots += tail
+	}
+	if allSlots == 0 {
+		return ratios, 0
+	}
+	return ratios, float64(allGaps) / float64(allSlots)
+}
+
+// ReclaimableBytes returns, for each shelf, the number of bytes compacting it
+// would free: the free slots in the gap-list, times the slot size. It takes no
+// I/O.
+func (db *database) ReclaimableBytes() []uint64 {
+	var (
+		shelves = db.snapshot()
+		bytes   = make([]uint64, len(shelves))
+	)
+	for i, shelf := range shelves {
+		gaps, _ := shelf.slotCounts()
+		bytes[i] = gaps * uint64(shelf.slotSize)
+	}
+	return bytes
+}
+
+// CompactionPlan returns the indices of the shelves which have space to
+// reclaim, ordered by ReclaimableBytes, most first, e.g. to CompactShelf them
+// in that order when time is limited. Shelves reclaiming equally much are
+// ordered by index.
+func (db *database) CompactionPlan() []int {
+	var (
+		bytes = db.ReclaimableBytes()
+		plan  []int
+	)
+	for i, n := range bytes {
+		if n > 0 {
+			plan = append(plan, i)
+		}
+	}
+	sort.SliceStable(plan, func(i, j int) bool {
+		return bytes[plan[i]] > bytes[plan[j]]
+	})
+	return plan
+}
+
+// CountByShelf returns the number of items stored in each shelf, computed as
+// the high-water mark minus the number of free slots, so it takes no I/O.
+// Slots not tracked in the gap-list are counted as items: those deleted while
+// it was full (see Options.MaxGapListEntries), deletes still queued by
+// Options.DeferDeletes, and any deleted slot in bulk-load mode.
+func (db *database) CountByShelf() []uint64 {
+	var (
+		shelves = db.snapshot()
+		counts  = make([]uint64, len(shelves))
+	)
+	for i, shelf := range shelves {
+		gaps, tail := shelf.slotCounts()
+		counts[i] = tail - gaps
+	}
+	return counts
+}
+
+// EfficiencyReport describes how the space taken by the items of a database is
+// used. Free slots are not included, see Fragmentation for those.
+type EfficiencyReport struct {
+	Items        uint64  // Number of items
+	PayloadBytes uint64  // Total length of the data, as stored
+	SlotBytes    uint64  // Total size of the slots holding the items
+	HeaderBytes  uint64  // Total size of the item headers
+	Ratio        float64 // PayloadBytes / SlotBytes, 0 for an empty database
+}
+
+// Efficiency reports how much of the space taken by the items is used by their
+// data, the rest being item headers and unused space at the end of the
+// slots. It reads the header of every item, but none of the data. For
+// compressed items, the compressed length is counted.
+func (db *database) Efficiency() EfficiencyReport {
+	var report EfficiencyReport
+	if db.checkOpen() != nil {
+		return report
+	}
+	for _, shelf := range db.snapshot() {
+		shelf.iterateHeaders(func(slot uint64, hdr []byte) {
+			report.Items++
+			report.PayloadBytes += uint64(shelf.getSize(hdr))
+			report.SlotBytes += uint64(shelf.slotSize)
+			report.HeaderBytes += uint64(shelf.hdrSize)
+		})
+	}
+	if report.SlotBytes > 0 {
+		report.Ratio = float64(report.PayloadBytes) / float64(report.SlotBytes)
+	}
+	return report
+}
+
+// Compact moves items from the end of each shelf into its gaps and truncates
+// the files, while the database stays in use. Every item moved is reported to
+// Options.OnRelocate, and its old key becomes invalid.
+// Each shelf is locked while it's being compacted, so operations on it have to
+// wait. A Get for an item which is being moved may fail, or return the data
+// from either location.
+func (db *database) Compact() error {
+	return db.CompactParallel(1)
+}
+
+// CompactParallel is like Compact, but compacts up to the given number of
+// shelves concurrently. Since the shelves are independent files, each with its
+// own locks, this mainly helps databases with many shelves. Options.OnRelocate
+// is invoked concurrently from the workers. The first error encountered is
+// returned, but the shelves already being compacted run to completion.
+func (db *database) CompactParallel(workers int) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&db.bulk) == 1 {
+		return ErrBulkLoad
+	}
+	// Compaction moves items, which would invalidate the queued keys.
+	if err := db.ApplyDeletes(); err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		shelves = make(chan int)
+		errs    = make(chan error, workers)
+	)
+	for w := 0; w < workers; w++ {
+		go func() {
+			var err error
+			for i := range shelves {
+				if err != nil {
+					continue // Drain, but don't start any more work
+				}
+				err = db.compactShelf(i)
+			}
+			errs <- err
+		}()
+	}
+	for i := range db.currentSlotSizes() {
+		shelves <- i
+	}
+	close(shelves)
+	var err error
+	for w := 0; w < workers; w++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// CompactShelf is like Compact, but only compacts the i:th shelf, e.g. one
+// which Fragmentation reports as heavily fragmented. Options.OnRelocate is
+// invoked for the items moved within it.
+func (db *database) CompactShelf(i int) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if n := len(db.currentSlotSizes()); i < 0 || i >= n {
+		return fmt.Errorf("%w: shelf %d, have %d shelves", ErrShelfOutOfRange, i, n)
+	}
+	if atomic.LoadInt32(&db.bulk) == 1 {
+		return ErrBulkLoad
+	}
+	if err := db.ApplyDeletes(); err != nil {
+		return err
+	}
+	return db.compactShelf(i)
+}
+
+// compactShelf compacts the i:th shelf, reporting the moves to onRelocate.
+func (db *database) compactShelf(i int) error {
+	defer startSpan(db.tracer, "Compact").End()
+	var onMove func(oldSlot, newSlot uint64)
+	if db.onRelocate != nil {
+		id := db.MakeKey(i, 0)
+		onMove = func(oldSlot, newSlot uint64) {
+			db.onRelocate(id|oldSlot, id|newSlot)
+		}
+	}
+	return db.snapshot()[i].Compact(onMove)
+}
+
+// ShrinkTail truncates each shelf file down to its high-water mark, reclaiming
+// space beyond the last slot in use, and returns the number of bytes freed.
+func (db *database) ShrinkTail() (uint64, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	var freed uint64
+	for _, shelf := range db.snapshot() {
+		n, err := shelf.ShrinkTail()
+		freed += n
+		if err != nil {
+			return freed, err
+		}
+	}
+	return freed, nil
+}
+
+// checkOpen returns ErrClosed if the database has been closed.
+func (db *database) checkOpen() error {
+	if atomic.LoadInt32(&db.closed) == 1 {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close implements io.Closer. Only the first call closes the shelves, any
+// subsequent calls are no-ops. After Close, the other methods return
+// ErrClosed, or do nothing if they don't return an error. All shelves are
+// closed even if some fail, and the error returned holds every failure, which
+// can be matched with errors.Is and errors.As.
+func (db *database) Close() error {
+	if !atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		return nil
+	}
+	if db.onClose != nil {
+		defer db.onClose()
+	}
+	db.stopBackground()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var (
+		errs  = []error{db.applyDeletes(), db.saveMetrics()}
+		grown bool
+	)
+	for i, shelf := range db.shelves {
+		if shelf.grownSinceSync() {
+			grown = true
+		}
+		if err := shelf.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shelf %d: %w", i, err))
+		}
+	}
+	if grown {
+		errs = append(errs, db.syncDir())
+	}
+	return joinErrors(errs...)
+}
+
+// syncDir syncs the database directory, on file systems which need it, see
+// DirSyncer.
+func (db *database) syncDir() error {
+	if syncer, ok := db.fs.(DirSyncer); ok && !db.readonly {
+		return syncer.SyncDir(db.path)
+	}
+	return nil
+}
+
+// Sync flushes the shelf files to disk, after applying the deletes queued
+// because of Options.DeferDeletes. If shelf files have been created or
+// extended since the previous Sync, the database directory is synced as well,
+// on file systems which need it for the files to be found after a crash (the
+// OS one, or an Options.FS implementing DirSyncer). Only once Sync returns
+// without error is the data written before it durable. It is done
+// automatically by Close, and periodically if Options.SyncInterval is set.
+func (db *database) Sync() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	var (
+		err   = db.ApplyDeletes()
+		grown bool
+	)
+	for _, shelf := range db.snapshot() {
+		if shelf.unavailable != nil {
+			continue
+		}
+		if shelf.grownSinceSync() {
+			grown = true
+		}
+		if e := shelf.Sync(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if grown && err == nil {
+		err = db.syncDir()
+	}
+	if e := db.saveMetrics(); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// snapshot returns the current shelves. Iterations work on a snapshot, so that
+// they don't hold db.mu while invoking callbacks. If SwapIn replaces the shelves
+// meanwhile, the rest of the iteration sees the old shelves as closed.
+func (db *database) snapshot() []*shelf {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return append([]*shelf(nil), db.shelves...)
 }
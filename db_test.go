@@ -6,9 +6,14 @@ package billy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGrowFile(t *testing.T) {
@@ -162,3 +167,2634 @@ func TestSizes(t *testing.T) {
 		}
 	}
 }
+
+func TestFragmentation(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Shelf 0: four items, delete the second
+	var keys []uint64
+	for i := 0; i < 4; i++ {
+		k, err := db.Put(fill(byte(i), 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	// Shelf 1: two items, delete the first
+	k, _ := db.Put(fill(1, 200))
+	_, _ = db.Put(fill(2, 200))
+	if err := db.Delete(k); err != nil {
+		t.Fatal(err)
+	}
+	// Shelf 2: left empty
+	shelves, total := db.Fragmentation()
+	if have, want := len(shelves), 3; have != want {
+		t.Fatalf("have %d shelves, want %d", have, want)
+	}
+	for i, want := range []float64{0.25, 0.5, 0} {
+		if have := shelves[i]; have != want {
+			t.Errorf("shelf %d: have %v want %v", i, have, want)
+		}
+	}
+	if have, want := total, 2.0/6; have != want {
+		t.Errorf("total: have %v want %v", have, want)
+	}
+}
+
+func TestCountByShelf(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Shelf 0: five items, delete two. Shelf 1: three items, delete the last.
+	var keys []uint64
+	for i := 0; i < 5; i++ {
+		k, _ := db.Put(fill(byte(i), 100))
+		keys = append(keys, k)
+	}
+	for i := 0; i < 3; i++ {
+		k, _ := db.Put(fill(byte(i), 200))
+		keys = append(keys, k)
+	}
+	for _, i := range []int{1, 3, 7} {
+		if err := db.Delete(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want []uint64) {
+		t.Helper()
+		have := db.CountByShelf()
+		if len(have) != len(want) {
+			t.Fatalf("have %d shelves, want %d", len(have), len(want))
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				t.Errorf("shelf %d: have %d items, want %d", i, have[i], want[i])
+			}
+		}
+	}
+	check([]uint64{3, 2, 0})
+	// Reusing a gap brings the count back up.
+	if _, err := db.Put(fill(9, 100)); err != nil {
+		t.Fatal(err)
+	}
+	check([]uint64{4, 2, 0})
+}
+
+func TestEfficiency(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), Checksum: true}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if have := db.Efficiency(); have != (EfficiencyReport{}) {
+		t.Fatalf("have %+v for an empty database", have)
+	}
+	// The header is 8 bytes with checksums. Two items in 128-byte slots, one
+	// in a 256-byte slot, and a deleted one which doesn't count.
+	for _, size := range []int{100, 120, 200, 50} {
+		if _, err := db.Put(fill(1, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+	want := EfficiencyReport{
+		Items:        3,
+		PayloadBytes: 100 + 200 + 50,
+		SlotBytes:    128 + 256 + 128,
+		HeaderBytes:  3 * 8,
+		Ratio:        350.0 / 512,
+	}
+	if have := db.Efficiency(); have != want {
+		t.Fatalf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestCompactHeader(t *testing.T) {
+	p := t.TempDir()
+	sizes := []uint32{64, 128, 70000}
+	newSizes := func() SlotSizeFn {
+		i := 0
+		return func() (uint32, bool) {
+			i++
+			return sizes[i-1], i == len(sizes)
+		}
+	}
+	db, err := Open(Options{Path: p, CompactHeader: true}, newSizes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []uint32{compactItemHeaderSize, compactItemHeaderSize, itemHeaderSize} {
+		if have := db.(*database).shelves[i].hdrSize; have != want {
+			t.Fatalf("shelf %d: have header size %d, want %d", i, have, want)
+		}
+	}
+	// A 62-byte item only fits the first shelf with the compact header.
+	k0, err := db.Put(fill(1, 62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := k0>>28, uint64(0); have != want {
+		t.Fatalf("have shelf %d, want %d", have, want)
+	}
+	k1, err := db.Put(fill(2, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{Path: p, CompactHeader: true}, newSizes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if have, err := db.Get(k0); err != nil {
+		t.Fatal(err)
+	} else if want := fill(1, 62); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	if have, err := db.Get(k1); err != nil {
+		t.Fatal(err)
+	} else if want := fill(2, 1000); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+}
+
+func TestOnGrow(t *testing.T) {
+	type growth struct {
+		shelf    int
+		old, new uint32
+	}
+	var have []growth
+	db, err := Open(Options{Path: t.TempDir(), OnGrow: func(shelf int, oldSlots, newSlots uint32) {
+		have = append(have, growth{shelf, oldSlots, newSlots})
+	}}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	k0, _ := db.Put(fill(0, 100)) // shelf 0 grows to 1
+	_, _ = db.Put(fill(1, 100))   // shelf 0 grows to 2
+	_, _ = db.Put(fill(2, 200))   // shelf 1 grows to 1
+	if err := db.Delete(k0); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = db.Put(fill(3, 100)) // reuses the gap, no growth
+	_, _ = db.Put(fill(4, 100)) // shelf 0 grows to 3
+	want := []growth{{0, 0, 1}, {0, 1, 2}, {1, 0, 1}, {0, 2, 3}}
+	if len(have) != len(want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("event %d: have %v, want %v", i, have[i], want[i])
+		}
+	}
+}
+
+func TestStrictDelete(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		db, err := Open(Options{Path: t.TempDir(), StrictDelete: strict}, SlotSizePowerOfTwo(128, 500), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = db.Put(fill(0, 100))
+		k1, _ := db.Put(fill(1, 100))
+		_, _ = db.Put(fill(2, 100))
+		if err := db.Delete(k1); err != nil {
+			t.Fatal(err)
+		}
+		data, err := db.Get(k1)
+		if strict {
+			if !errors.Is(err, ErrDeleted) {
+				t.Fatalf("strict: expected %v, got %v", ErrDeleted, err)
+			}
+		} else if err != nil || !bytes.Equal(data, fill(1, 100)) {
+			t.Fatalf("default: expected stale data, got %x, %v", data, err)
+		}
+		// Reusing the slot makes it readable again
+		if k, err := db.Put(fill(3, 100)); err != nil {
+			t.Fatal(err)
+		} else if k != k1 {
+			t.Fatalf("expected slot reuse, have %d want %d", k, k1)
+		}
+		if data, err := db.Get(k1); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, fill(3, 100)) {
+			t.Fatalf("have %x", data)
+		}
+		db.Close()
+	}
+}
+
+func TestIterateConcurrentPut(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	existing := make(map[uint64]bool)
+	for i := 0; i < 50; i++ {
+		k, err := db.Put(fill(byte(i), 100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		existing[k] = true
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 500; i++ {
+			if _, err := db.Put(fill(byte(i), 100+i%300)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for round := 0; round < 5; round++ {
+		visited := make(map[uint64]bool)
+		db.(*database).Iterate(func(key uint64, data []byte) {
+			if visited[key] {
+				t.Errorf("key %d visited twice", key)
+			}
+			visited[key] = true
+			if !existing[key] {
+				return
+			}
+			for _, b := range data {
+				if b != data[0] {
+					t.Errorf("key %d: inconsistent data", key)
+					break
+				}
+			}
+		})
+		for k := range existing {
+			if !visited[k] {
+				t.Fatalf("round %d: key %d not visited", round, k)
+			}
+		}
+	}
+	<-done
+}
+
+func TestRebuildIndex(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64]string)
+	for i := 0; i < 20; i++ {
+		data := fill(byte(i), 50+20*i)
+		k, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[k] = string(data)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[uint64]string)
+	err = RebuildIndex(Options{Path: p}, SlotSizePowerOfTwo(128, 500), func(key uint64, data []byte) error {
+		have[key] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %d items, want %d", len(have), len(want))
+	}
+	for k, v := range want {
+		if have[k] != v {
+			t.Fatalf("key %d: wrong data", k)
+		}
+	}
+	// Errors abort the rebuild
+	var (
+		calls   int
+		errStop = errors.New("stop")
+	)
+	err = RebuildIndex(Options{Path: p}, SlotSizePowerOfTwo(128, 500), func(key uint64, data []byte) error {
+		calls++
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected %v, got %v", errStop, err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+}
+
+func TestValidateSlotSizeFn(t *testing.T) {
+	sizes, err := ValidateSlotSizeFn(SlotSizePowerOfTwo(128, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 3 || sizes[0] != 128 || sizes[1] != 256 || sizes[2] != 512 {
+		t.Fatalf("have sizes %v", sizes)
+	}
+	generator := func(sizes ...uint32) SlotSizeFn {
+		i := 0
+		return func() (uint32, bool) {
+			i++
+			return sizes[i-1], i == len(sizes)
+		}
+	}
+	size := uint32(100)
+	endless := func() (uint32, bool) {
+		size++
+		return size, false
+	}
+	for _, tt := range []struct {
+		name string
+		fn   SlotSizeFn
+		want error
+	}{
+		{"non-increasing", generator(100, 200, 200), ErrInvalidSlotSize},
+		{"decreasing", generator(100, 50), ErrInvalidSlotSize},
+		{"too small", generator(4, 100), ErrInvalidSlotSize},
+		{"too many shelves", endless, ErrTooManyShelves},
+	} {
+		if _, err := ValidateSlotSizeFn(tt.fn); !errors.Is(err, tt.want) {
+			t.Errorf("%v: expected %v, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestMaxShelves(t *testing.T) {
+	// A buggy generator which never finishes
+	size := uint32(100)
+	endless := func() (uint32, bool) {
+		size++
+		return size, false
+	}
+	_, err := Open(Options{Path: t.TempDir(), MaxShelves: 10}, endless, nil)
+	if !errors.Is(err, ErrTooManyShelves) {
+		t.Fatalf("expected %v, got %v", ErrTooManyShelves, err)
+	}
+	// Exactly at the limit is fine
+	db, err := Open(Options{Path: t.TempDir(), MaxShelves: 3}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(db.(*database).shelves), 3; have != want {
+		t.Fatalf("have %d shelves, want %d", have, want)
+	}
+	db.Close()
+}
+
+func TestLen(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 2048), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, size := range []int{1, 100, 124, 125, 500, 2044} {
+		key, err := db.Put(fill(1, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, err := db.Len(key); err != nil {
+			t.Fatal(err)
+		} else if want := len(data); have != want {
+			t.Fatalf("have %d want %d", have, want)
+		}
+	}
+	if _, err := db.Len(uint64(100) << 28); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+	if _, err := db.Len(1000); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+}
+
+func TestDoubleClose(t *testing.T) {
+	var calls int
+	db, err := Open(Options{Path: t.TempDir(), OnClose: func() { calls++ }}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = db.Put(fill(1, 100))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected OnClose to be called once, got %d", calls)
+	}
+}
+
+func TestPayloadSizeFn(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, PayloadSizeFn(SlotSizeLinear(100, 4)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, tt := range []struct {
+		size  int
+		shelf uint64
+	}{
+		{100, 0}, {101, 1}, {200, 1}, {201, 2}, {300, 2},
+	} {
+		key, err := db.Put(fill(1, tt.size))
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if have := key >> 28; have != tt.shelf {
+			t.Errorf("test %d: size %d stored in shelf %d, want %d", i, tt.size, have, tt.shelf)
+		}
+	}
+	if _, err := db.Put(fill(1, 301)); err == nil {
+		t.Fatal("expected error for oversized payload")
+	}
+}
+
+func TestSlotSizeConcat(t *testing.T) {
+	sizes, err := ValidateSlotSizeFn(SlotSizeConcat(
+		SlotSizeLinear(100, 5),        // 100, 200, 300, 400
+		SlotSizePowerOfTwo(512, 4096), // 512, ..., 4096
+		SlotSizeLinear(5000, 2),       // 5000
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(sizes), "[100 200 300 400 512 1024 2048 4096 5000]"; have != want {
+		t.Fatalf("have sizes %v, want %v", have, want)
+	}
+	for i, fns := range [][]SlotSizeFn{
+		{SlotSizeLinear(100, 5), SlotSizePowerOfTwo(256, 4096)},
+		{SlotSizePowerOfTwo(256, 1024), SlotSizeLinear(1024, 3)},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("test %d: expected panic on overlapping sizes", i)
+				}
+			}()
+			ValidateSlotSizeFn(SlotSizeConcat(fns...))
+		}()
+	}
+}
+
+func TestAppend(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, _ := db.Put(fill(1, 100))
+	// In place: 100 + 24 + 4 == 128
+	newKey, err := db.Append(key, fill(2, 24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey != key {
+		t.Fatalf("expected in-place append, key changed from %#x to %#x", key, newKey)
+	}
+	want := append(fill(1, 100), fill(2, 24)...)
+	if have, _ := db.Get(key); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	// Relocating: no more room in the 128-byte slot
+	newKey, err = db.Append(key, fill(3, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey == key {
+		t.Fatal("expected relocation")
+	}
+	if have, want := newKey>>28, uint64(1); have != want {
+		t.Fatalf("relocated to shelf %d, want %d", have, want)
+	}
+	want = append(want, 3)
+	if have, _ := db.Get(newKey); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	if _, err := db.Append(newKey, fill(4, 500)); err == nil {
+		t.Fatal("expected error appending beyond the largest shelf")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, _ := db.Put(fill(1, 100))
+	get := func() []byte {
+		t.Helper()
+		data, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	old, err := db.Swap(key, fill(2, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fill(1, 100); !bytes.Equal(old, want) {
+		t.Fatalf("have old %x want %x", old, want)
+	}
+	if have, want := get(), fill(2, 50); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	// Data which doesn't fit the slot is rejected, and nothing changes.
+	if _, err := db.Swap(key, fill(3, 200)); !errors.Is(err, ErrOversized) {
+		t.Fatalf("expected %v, got %v", ErrOversized, err)
+	}
+	if have, want := get(), fill(2, 50); !bytes.Equal(have, want) {
+		t.Fatalf("have %x want %x", have, want)
+	}
+	// Concurrent swaps each see the value written by exactly one other.
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = map[byte]int{}
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			old, err := db.Swap(key, fill(byte(100+i), 10+i))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			seen[old[0]]++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	seen[get()[0]]++
+	if len(seen) != 51 {
+		t.Fatalf("have %d distinct values, want 51", len(seen))
+	}
+	for v, n := range seen {
+		if n != 1 {
+			t.Fatalf("value %d seen %d times", v, n)
+		}
+	}
+}
+
+func TestReuseOrder(t *testing.T) {
+	db, err := OpenFixed(Options{Path: t.TempDir()}, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		db.Put(fill(byte(i), 50))
+	}
+	// Freed in scrambled order, reused lowest first, then the tail.
+	for _, key := range []uint64{7, 2, 5, 0} {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []uint64{0, 2} {
+		if key, _ := db.Put(fill(1, 50)); key != want {
+			t.Fatalf("have key %d, want %d", key, want)
+		}
+	}
+	// Slots freed later, but lower, are used before the remaining ones.
+	db.Delete(1)
+	for _, want := range []uint64{1, 5, 7, 10, 11} {
+		if key, _ := db.Put(fill(1, 50)); key != want {
+			t.Fatalf("have key %d, want %d", key, want)
+		}
+	}
+}
+
+func TestPutAt(t *testing.T) {
+	src, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 512), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 30; i++ {
+		src.Put(fill(byte(i), 10+i*15))
+	}
+	for _, key := range []uint64{2, 5, 1<<slotBits | 1} {
+		if err := src.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	type item struct {
+		key  uint64
+		data []byte
+	}
+	var items []item
+	src.Iterate(func(key uint64, data []byte) {
+		items = append(items, item{key, append([]byte(nil), data...)})
+	})
+	// Restore in reverse order.
+	dst, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 512), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	for i := len(items) - 1; i >= 0; i-- {
+		if err := dst.PutAt(items[i].key, items[i].data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, it := range items {
+		if have, err := dst.Get(it.key); err != nil || !bytes.Equal(have, it.data) {
+			t.Fatalf("key %#x: have %x (err %v), want %x", it.key, have, err, it.data)
+		}
+	}
+	// The deleted slots are free, and are reused first.
+	for i := 0; i < 2; i++ {
+		want, _ := src.FreeSlots(i)
+		have, _ := dst.FreeSlots(i)
+		if len(have) != len(want) {
+			t.Fatalf("shelf %d: have free slots %v, want %v", i, have, want)
+		}
+		for j := range want {
+			if have[j] != want[j] {
+				t.Fatalf("shelf %d: have free slots %v, want %v", i, have, want)
+			}
+		}
+	}
+	if key, _ := dst.Put(fill(1, 10)); key != 2 {
+		t.Fatalf("have key %d, want 2", key)
+	}
+	if err := dst.PutAt(3<<slotBits, fill(1, 10)); !errors.Is(err, ErrShelfOutOfRange) {
+		t.Fatalf("expected %v, got %v", ErrShelfOutOfRange, err)
+	}
+	if err := dst.PutAt(0, fill(1, 200)); !errors.Is(err, ErrOversized) {
+		t.Fatalf("expected %v, got %v", ErrOversized, err)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	for _, tt := range []struct {
+		placement Placement
+		shelves   []uint64 // Shelf of a 100, 200 and 400 byte item
+	}{
+		{PlacementSmallestFit, []uint64{0, 1, 2}},
+		{PlacementSpreadLargest, []uint64{1, 2, 2}},
+	} {
+		db, err := Open(Options{Path: t.TempDir(), Placement: tt.placement}, SlotSizePowerOfTwo(128, 512), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, size := range []int{100, 200, 400} {
+			key, err := db.Put(fill(byte(i), size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := key>>slotBits, tt.shelves[i]; have != want {
+				t.Errorf("placement %d, size %d: have shelf %d, want %d", tt.placement, size, have, want)
+			}
+			if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(byte(i), size)) {
+				t.Fatalf("placement %d, size %d: wrong data (err %v)", tt.placement, size, err)
+			}
+		}
+		db.Close()
+	}
+	if _, err := Open(Options{Path: t.TempDir(), Placement: 100}, SlotSizePowerOfTwo(128, 512), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
+
+func TestShrink(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), Placement: PlacementSpreadLargest}, SlotSizePowerOfTwo(128, 512), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, tt := range []struct {
+		size          int
+		before, after uint64 // Shelf of the item before and after Shrink
+	}{
+		{100, 1, 0},
+		{200, 2, 1},
+		{400, 2, 2},
+	} {
+		key, err := db.Put(fill(byte(i), tt.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := key >> slotBits; have != tt.before {
+			t.Fatalf("size %d: have shelf %d, want %d", tt.size, have, tt.before)
+		}
+		newKey, err := db.Shrink(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := newKey >> slotBits; have != tt.after {
+			t.Errorf("size %d: have shelf %d after shrink, want %d", tt.size, have, tt.after)
+		}
+		if data, err := db.Get(newKey); err != nil || !bytes.Equal(data, fill(byte(i), tt.size)) {
+			t.Fatalf("size %d: wrong data (err %v)", tt.size, err)
+		}
+		// The old slot is deleted
+		var total uint64
+		for _, count := range db.CountByShelf() {
+			total += count
+		}
+		if total != uint64(i+1) {
+			t.Fatalf("size %d: have %d items, want %d", tt.size, total, i+1)
+		}
+	}
+}
+
+func TestIterateGaps(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 6; i++ {
+		k, _ := db.Put(fill(byte(i), 50+50*i))
+		keys = append(keys, k)
+	}
+	// Delete some items, but not the last item of each shelf since that
+	// would truncate the file rather than leave a gap.
+	deleted := map[uint64]int{keys[0]: 0, keys[3]: 3}
+	for k := range deleted {
+		if err := db.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	visited := make(map[uint64]bool)
+	db.IterateGaps(func(key uint64, data []byte) {
+		i, ok := deleted[key]
+		if !ok {
+			t.Fatalf("unexpected gap %#x", key)
+		}
+		if want := fill(byte(i), 50+50*i); !bytes.Equal(data, want) {
+			t.Fatalf("gap %#x: have %x want %x", key, data, want)
+		}
+		visited[key] = true
+	})
+	if len(visited) != len(deleted) {
+		t.Fatalf("visited %d gaps, want %d", len(visited), len(deleted))
+	}
+}
+
+func TestOpenFixed(t *testing.T) {
+	var (
+		pA = t.TempDir()
+		pB = t.TempDir()
+	)
+	a, err := OpenFixed(Options{Path: pA}, 200, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Open(Options{Path: pB}, func() (uint32, bool) { return 200, true }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(a.(*database).shelves), 1; have != want {
+		t.Fatalf("have %d shelves, want %d", have, want)
+	}
+	for _, size := range []int{1, 100, 196, 197} {
+		kA, errA := a.Put(fill(1, size))
+		kB, errB := b.Put(fill(1, size))
+		if kA != kB || (errA == nil) != (errB == nil) {
+			t.Fatalf("size %d: have %d (%v), want %d (%v)", size, kA, errA, kB, errB)
+		}
+	}
+	a.Close()
+	b.Close()
+	if err := checkIdentical(filepath.Join(pA, "bkt_00000200.bag"), filepath.Join(pB, "bkt_00000200.bag")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkipScan(t *testing.T) {
+	p := t.TempDir()
+	if _, err := Open(Options{Path: p, SkipScan: true}, SlotSizeLinear(100, 3), func(uint64, []byte) {}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	db, err := OpenFixed(Options{Path: p}, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		db.Put(fill(byte(i), 50))
+	}
+	db.Delete(3)
+	db.Close()
+	for _, skip := range []bool{false, true} {
+		// Open a copy, since opening with the scan compacts the shelf.
+		dir := t.TempDir()
+		for _, name := range []string{legacyShelfName(100), manifestName} {
+			data, err := os.ReadFile(filepath.Join(p, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(dir, name), data, 0666)
+		}
+		db, err := OpenFixed(Options{Path: dir, SkipScan: skip}, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := 0
+		db.Iterate(func(key uint64, data []byte) { items++ })
+		if items != 9 {
+			t.Fatalf("skip %v: have %d items, want 9", skip, items)
+		}
+		// With the scan, the shelf is compacted on open. Without it, the
+		// deleted slot stays in place, and is not reused.
+		key, err := db.Put(fill(10, 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[bool]uint64{false: 9, true: 10}[skip]; key != want {
+			t.Fatalf("skip %v: have key %d, want %d", skip, key, want)
+		}
+		// Deletes are tracked from then on.
+		if err := db.Delete(0); err != nil {
+			t.Fatal(err)
+		}
+		if free, _ := db.FreeSlots(0); len(free) != 1 || free[0] != 0 {
+			t.Fatalf("skip %v: have free slots %v, want [0]", skip, free)
+		}
+		db.Close()
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k0, _ := db.Put(fill(0, 100))
+	_, _ = db.Put(fill(1, 100))
+	if err := db.Delete(k0); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := Open(Options{Path: p, BulkLoad: true}, SlotSizePowerOfTwo(128, 500), func(uint64, []byte) {}); !errors.Is(err, ErrBulkLoad) {
+		t.Fatalf("expected %v, got %v", ErrBulkLoad, err)
+	}
+	db, err = Open(Options{Path: p, BulkLoad: true}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The gap is not known during bulk load, so puts append
+	k2, _ := db.Put(fill(2, 100))
+	if have, want := k2, uint64(2); have != want {
+		t.Fatalf("have key %d want %d", have, want)
+	}
+	if err := db.Delete(k2); !errors.Is(err, ErrBulkLoad) {
+		t.Fatalf("expected %v, got %v", ErrBulkLoad, err)
+	}
+	if err := db.FinishBulkLoad(); err != nil {
+		t.Fatal(err)
+	}
+	// Back to normal: the gap is reused, and deletes work
+	k3, _ := db.Put(fill(3, 100))
+	if have, want := k3, k0; have != want {
+		t.Fatalf("have key %d want %d", have, want)
+	}
+	if err := db.Delete(k2); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := db.Get(k3); !bytes.Equal(have, fill(3, 100)) {
+		t.Fatalf("wrong data: %x", have)
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	// Opening an existing database normally requires a full scan, which bulk
+	// load mode skips.
+	p := b.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := fill(1, 100)
+	for i := 0; i < 100000; i++ {
+		_, _ = db.Put(data)
+	}
+	db.Close()
+	for _, bulk := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bulk=%v", bulk), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				db, err := Open(Options{Path: p, BulkLoad: bulk}, SlotSizePowerOfTwo(128, 500), nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < 1000; j++ {
+					_, _ = db.Put(data)
+				}
+				db.Close()
+			}
+		})
+	}
+}
+
+func TestReplayInSequence(t *testing.T) {
+	p := t.TempDir()
+	open := func() Database {
+		t.Helper()
+		db, err := Open(Options{Path: p, Sequence: true}, SlotSizePowerOfTwo(128, 1024), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	var (
+		db    = open()
+		keys  []uint64
+		sizes = []int{300, 20, 900, 100, 500, 40, 700, 250}
+	)
+	// The first byte of each item is its insertion index
+	for i, size := range sizes {
+		k, err := db.Put(fill(byte(i), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	// Delete an early item, and reuse the slot with a later one
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(fill(8, 30)); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening compacts the shelves, moving items around, and the sequence
+	// must continue where it left off.
+	db.Close()
+	db = open()
+	defer db.Close()
+	if _, err := db.Put(fill(9, 30)); err != nil {
+		t.Fatal(err)
+	}
+	var have []byte
+	if err := db.ReplayInSequence(func(key uint64, data []byte) {
+		have = append(have, data[0])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 2, 3, 4, 5, 6, 7, 8, 9}; !bytes.Equal(have, want) {
+		t.Fatalf("have order %v, want %v", have, want)
+	}
+}
+
+func TestReplayInSequenceDelete(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), Sequence: true, StrictDelete: true}, SlotSizeLinear(100, 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 5; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// Items deleted during the replay are skipped, whether their slot is
+	// in the gap-list, or cut off the end of the shelf.
+	var have []byte
+	if err := db.ReplayInSequence(func(key uint64, data []byte) {
+		if data[0] == 0 {
+			db.Delete(keys[2])
+			db.Delete(keys[4])
+		}
+		have = append(have, data[0])
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 1, 3}; !bytes.Equal(have, want) {
+		t.Fatalf("have order %v, want %v", have, want)
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	src, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(64, 1024), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	want := make(map[uint64][]byte)
+	for i := 0; i < 30; i++ {
+		data := fill(byte(i), 10+30*i)
+		k, err := src.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[k] = data
+	}
+	remapped := make(map[uint64]uint64)
+	if err := src.CopyTo(dst, func(oldKey, newKey uint64) {
+		remapped[oldKey] = newKey
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(remapped) != len(want) {
+		t.Fatalf("have %d remapped keys, want %d", len(remapped), len(want))
+	}
+	for oldKey, data := range want {
+		have, err := dst.Get(remapped[oldKey])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, data) {
+			t.Fatalf("key %#x: wrong data", oldKey)
+		}
+	}
+	// Items which don't fit the destination make the copy fail
+	if _, err := src.Put(fill(1, 890)); err != nil {
+		t.Fatal(err)
+	}
+	small, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(64, 512), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer small.Close()
+	if err := src.CopyTo(small, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var (
+		srcs []Database
+		want []map[uint64][]byte // Items of each source
+	)
+	for i := 0; i < 2; i++ {
+		src, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 10), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		items := make(map[uint64][]byte)
+		for j := 0; j < 20; j++ {
+			data := fill(byte(10*i+j), 10+40*j)
+			key, err := src.Put(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items[key] = data
+		}
+		srcs, want = append(srcs, src), append(want, items)
+	}
+	dst, err := Open(Options{Path: t.TempDir()}, SlotSizePowerOfTwo(64, 1024), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	remaps, err := Merge(dst, srcs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaps) != len(srcs) {
+		t.Fatalf("have %d remaps, want %d", len(remaps), len(srcs))
+	}
+	newKeys := make(map[uint64]bool)
+	for i, items := range want {
+		if len(remaps[i]) != len(items) {
+			t.Fatalf("source %d: have %d remapped keys, want %d", i, len(remaps[i]), len(items))
+		}
+		for oldKey, data := range items {
+			newKey, ok := remaps[i][oldKey]
+			if !ok {
+				t.Fatalf("source %d: key %#x not remapped", i, oldKey)
+			}
+			if have, err := dst.Get(newKey); err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("source %d: key %#x: wrong data (err %v)", i, oldKey, err)
+			}
+			newKeys[newKey] = true
+		}
+	}
+	if len(newKeys) != 40 {
+		t.Fatalf("have %d distinct keys, want 40", len(newKeys))
+	}
+}
+
+// readCountFS counts the bytes read from each file.
+type readCountFS struct {
+	*memFS
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+func (fsys *readCountFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountFile{f, fsys, filepath.Base(name)}, nil
+}
+
+type readCountFile struct {
+	File
+	fsys *readCountFS
+	name string
+}
+
+func (f *readCountFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	f.fsys.mu.Lock()
+	f.fsys.reads[f.name] += n
+	f.fsys.mu.Unlock()
+	return n, err
+}
+
+func TestWarmup(t *testing.T) {
+	path := "/memfs/billy"
+	fsys := &readCountFS{memFS: newMemFS(path), reads: make(map[string]int)}
+	db, err := Open(Options{Path: path, FS: fsys}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 10; j++ {
+			if _, err := db.Put(fill(byte(j), 100*i+50)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fsys.reads = make(map[string]int)
+	if err := db.Warmup(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		name := fmt.Sprintf("bkt_%08d.bag", 100*i)
+		if have, want := fsys.reads[name], 10*100*i; have != want {
+			t.Errorf("shelf %d: read %d bytes, want %d", i-1, have, want)
+		}
+	}
+	if err := db.WarmupShelf(4); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected ErrBadIndex, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.WarmupContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Put(fill(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var errs = map[string]error{}
+	_, errs["Put"] = db.Put(fill(1, 10))
+	_, errs["Get"] = db.Get(key)
+	_, errs["Len"] = db.Len(key)
+	errs["Delete"] = db.Delete(key)
+	_, errs["Append"] = db.Append(key, []byte{1})
+	errs["FinishBulkLoad"] = db.FinishBulkLoad()
+	errs["ReplayInSequence"] = db.ReplayInSequence(nil)
+	errs["CopyTo"] = db.CopyTo(dst, nil)
+	errs["Warmup"] = db.Warmup()
+	errs["WarmupShelf"] = db.WarmupShelf(0)
+	_, errs["ShrinkTail"] = db.ShrinkTail()
+	for name, err := range errs {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("%s: expected %v, got %v", name, ErrClosed, err)
+		}
+	}
+	db.Iterate(func(uint64, []byte) { t.Error("Iterate after close") })
+	db.IterateGaps(func(uint64, []byte) { t.Error("IterateGaps after close") })
+}
+
+func TestSlotAlignment(t *testing.T) {
+	p := t.TempDir()
+	// Slot sizes 100, 200, ... 1100 become 512, 1024 and 1536
+	db, err := Open(Options{Path: p, SlotAlignment: 512}, SlotSizeLinear(100, 12), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := []uint32{512, 1024, 1536}
+	shelves := db.(*database).shelves
+	if len(shelves) != len(want) {
+		t.Fatalf("have %d shelves, want %d", len(shelves), len(want))
+	}
+	for i, shelf := range shelves {
+		if shelf.slotSize != want[i] {
+			t.Errorf("shelf %d: have slot size %d, want %d", i, shelf.slotSize, want[i])
+		}
+	}
+	for _, tt := range []struct {
+		size  int
+		shelf uint64
+	}{{1, 0}, {508, 0}, {509, 1}, {1020, 1}, {1021, 2}, {1532, 2}} {
+		key, err := db.Put(make([]byte, tt.size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := key >> slotBits; have != tt.shelf {
+			t.Errorf("size %d: have shelf %d, want %d", tt.size, have, tt.shelf)
+		}
+	}
+	if _, err := db.Put(make([]byte, 1533)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	m, err := readManifest(osFS{}, p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.hasSlotSizes(want) {
+		t.Fatalf("manifest has slot sizes %v, want %v", m.SlotSizes, want)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	var (
+		p       = t.TempDir()
+		replica = make(map[uint64][]byte)
+		repairs int
+	)
+	repair := func(key uint64) ([]byte, error) {
+		repairs++
+		if data, ok := replica[key]; ok {
+			return data, nil
+		}
+		return nil, errors.New("not in replica")
+	}
+	if _, err := Open(Options{Path: p, Repair: repair}, SlotSizeLinear(100, 3), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	db, err := Open(Options{Path: p, Checksum: true, Repair: repair}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replica[key] = fill(byte(i), 50)
+		keys = append(keys, key)
+	}
+	corrupt := func(slot uint64) {
+		t.Helper()
+		f, err := os.OpenFile(filepath.Join(p, "bkt_00000100.bag"), os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0xff}, int64(slot)*100+20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corrupt(1)
+	data, err := db.Get(keys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, replica[keys[1]]) {
+		t.Fatal("wrong repaired data")
+	}
+	if repairs != 1 {
+		t.Fatalf("have %d repairs, want 1", repairs)
+	}
+	// The slot has been rewritten, so no further repair is needed
+	if data, err = db.Get(keys[1]); err != nil || !bytes.Equal(data, replica[keys[1]]) {
+		t.Fatalf("read after repair failed: %v", err)
+	}
+	if repairs != 1 {
+		t.Fatalf("have %d repairs, want 1", repairs)
+	}
+	// A failed repair reports the checksum error
+	delete(replica, keys[2])
+	corrupt(2)
+	if _, err := db.Get(keys[2]); !errors.Is(err, ErrChecksumMismatch) || !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrChecksumMismatch, err)
+	}
+	if data, err := db.Get(keys[0]); err != nil || !bytes.Equal(data, fill(0, 50)) {
+		t.Fatalf("intact item failed: %v", err)
+	}
+}
+
+func TestKeyRange(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, ok := db.KeyRange(); ok {
+		t.Fatal("expected empty range")
+	}
+	check := func(wantMin, wantMax uint64) {
+		t.Helper()
+		min, max, ok := db.KeyRange()
+		if !ok || min != wantMin || max != wantMax {
+			t.Fatalf("have (%#x, %#x, %v), want (%#x, %#x, true)", min, max, ok, wantMin, wantMax)
+		}
+	}
+	// Three items each in shelves 1 and 2 (slot sizes 200 and 300)
+	var keys [3][]uint64
+	for shelf := 1; shelf <= 2; shelf++ {
+		for i := 0; i < 3; i++ {
+			key, err := db.Put(fill(byte(i), 100*shelf+50))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys[shelf] = append(keys[shelf], key)
+		}
+	}
+	check(1<<slotBits, 2<<slotBits|2)
+	// Deleting the edges moves the range inwards
+	if err := db.Delete(keys[1][0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(keys[2][2]); err != nil {
+		t.Fatal(err)
+	}
+	check(1<<slotBits|1, 2<<slotBits|1)
+	// A small item in shelf 0 becomes the minimum, even though the slot
+	// number is lower than in the other shelves
+	key, err := db.Put(fill(1, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(key, 2<<slotBits|1)
+	// Emptying the last shelf makes the previous one hold the maximum
+	for _, key := range keys[2][:2] {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check(key, 1<<slotBits|2)
+}
+
+func TestPutAlternatingSizes(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Alternate between the shelves, including the sizes at their edges, so
+	// the cached shelf is wrong for almost every Put
+	sizes := []int{1, 350, 96, 97, 196, 197, 296, 297, 396, 10, 396, 200, 200, 96}
+	for _, size := range sizes {
+		key, err := db.Put(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := db.(*database).searchShelf(size)
+		if have := int(key >> slotBits); have != want {
+			t.Errorf("size %d: have shelf %d, want %d", size, have, want)
+		}
+	}
+	if _, err := db.Put(make([]byte, 397)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	if key, err := db.Put(make([]byte, 100)); err != nil || key>>slotBits != 1 {
+		t.Fatalf("wrong shelf after failed Put: %#x, %v", key, err)
+	}
+}
+
+func BenchmarkShelfIndex(b *testing.B) {
+	db, err := Open(Options{Path: b.TempDir()}, SlotSizeLinear(16, 1000), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	d := db.(*database)
+	b.Run("search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = d.searchShelf(5000)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = d.shelfIndex(5000)
+		}
+	})
+}
+
+func TestPutEx(t *testing.T) {
+	for _, tt := range []struct {
+		opts  Options
+		size  int
+		waste uint32
+	}{
+		{Options{}, 1, 100 - 4 - 1},
+		{Options{}, 96, 0},
+		{Options{}, 97, 200 - 4 - 97},
+		{Options{}, 250, 300 - 4 - 250},
+		{Options{CompactHeader: true}, 98, 0},
+		{Options{Sequence: true}, 50, 100 - 12 - 50},
+		{Options{Checksum: true, Sequence: true}, 50, 100 - 16 - 50},
+	} {
+		tt.opts.Path = t.TempDir()
+		db, err := Open(tt.opts, SlotSizeLinear(100, 4), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, waste, err := db.PutEx(make([]byte, tt.size)); err != nil {
+			t.Fatal(err)
+		} else if waste != tt.waste {
+			t.Errorf("size %d, %+v: have waste %d, want %d", tt.size, tt.opts, waste, tt.waste)
+		}
+		db.Close()
+	}
+}
+
+func TestCompactParallel(t *testing.T) {
+	build := func(path string, onRelocate func(oldKey, newKey uint64)) (Database, map[uint64][]byte) {
+		db, err := Open(Options{Path: path, OnRelocate: onRelocate}, SlotSizeLinear(100, 6), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items := make(map[uint64][]byte)
+		for i := 0; i < 200; i++ {
+			data := fill(byte(i), 50+100*(i%5))
+			key, err := db.Put(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			items[key] = data
+		}
+		// Delete in a pattern which leaves gaps both at the start, in the
+		// middle and at the end of the shelves
+		for key := range items {
+			if slot := key & (1<<slotBits - 1); slot%3 == 0 || slot > 35 {
+				if err := db.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(items, key)
+			}
+		}
+		return db, items
+	}
+	var (
+		paths = [2]string{t.TempDir(), t.TempDir()}
+		moves = [2]map[uint64]uint64{{}, {}}
+		mu    sync.Mutex
+	)
+	for i, workers := range []int{1, 4} {
+		i := i
+		db, items := build(paths[i], func(oldKey, newKey uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			moves[i][oldKey] = newKey
+		})
+		// Keep writing during the compaction, to exercise the locking
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 50; j++ {
+				if _, err := db.Put(fill(byte(j), 20)); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		if err := db.CompactParallel(workers); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		for key, data := range items {
+			mu.Lock()
+			if newKey, ok := moves[i][key]; ok {
+				key = newKey
+			}
+			mu.Unlock()
+			have, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("workers=%d: %v", workers, err)
+			}
+			if !bytes.Equal(have, data) {
+				t.Fatalf("workers=%d, key %#x: wrong data", workers, key)
+			}
+		}
+		db.Close()
+	}
+	// Without concurrent writes, both end up in the same state
+	for i, workers := range []int{1, 4} {
+		i := i
+		moves[i] = make(map[uint64]uint64)
+		paths[i] = t.TempDir()
+		db, _ := build(paths[i], func(oldKey, newKey uint64) {
+			mu.Lock()
+			defer mu.Unlock()
+			moves[i][oldKey] = newKey
+		})
+		if err := db.CompactParallel(workers); err != nil {
+			t.Fatal(err)
+		}
+		if _, frag := db.Fragmentation(); frag != 0 {
+			t.Errorf("workers=%d: fragmentation %v after compaction", workers, frag)
+		}
+		db.Close()
+	}
+	if len(moves[0]) == 0 || len(moves[0]) != len(moves[1]) {
+		t.Fatalf("have %d and %d moves", len(moves[0]), len(moves[1]))
+	}
+	for oldKey, newKey := range moves[0] {
+		if moves[1][oldKey] != newKey {
+			t.Fatalf("key %#x: moved to %#x and %#x", oldKey, newKey, moves[1][oldKey])
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(paths[0], "*.bag"))
+	for _, file := range files {
+		if err := checkIdentical(file, filepath.Join(paths[1], filepath.Base(file))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFreeSlots(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Fill shelf 1 with more slots than fit in one chunk
+	n := 2*freeSlotsChunk + 100
+	for i := 0; i < n; i++ {
+		if _, err := db.Put(fill(byte(i), 150)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want []uint32
+	for slot := 0; slot < n-1; slot += 2 {
+		if err := db.Delete(uint64(1)<<slotBits | uint64(slot)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, uint32(slot))
+	}
+	have, err := db.FreeSlots(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("have %d free slots, want %d", len(have), len(want))
+	}
+	if have, err := db.FreeSlots(0); err != nil || len(have) != 0 {
+		t.Fatalf("have %v (err %v), want no free slots", have, err)
+	}
+	// The returned slice is a copy
+	have[0] = 12345
+	if again, _ := db.FreeSlots(1); again[0] != 0 {
+		t.Fatal("internal state exposed")
+	}
+	// Stop early
+	var visited int
+	if err := db.IterateFreeSlots(1, func(slot uint32) bool {
+		visited++
+		return visited < 10
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 10 {
+		t.Fatalf("have %d visited, want 10", visited)
+	}
+	if _, err := db.FreeSlots(3); !errors.Is(err, ErrShelfOutOfRange) {
+		t.Fatalf("expected %v, got %v", ErrShelfOutOfRange, err)
+	}
+}
+
+func TestMeta(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := db.GetMeta(); err != nil || meta != nil {
+		t.Fatalf("have %q (err %v), want no metadata", meta, err)
+	}
+	if err := db.SetMeta([]byte("schema v1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMeta([]byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetMeta(make([]byte, MaxMetaSize+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	db.Close()
+	db, err = Open(Options{Path: p, Readonly: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if meta, err := db.GetMeta(); err != nil || string(meta) != "v2" {
+		t.Fatalf("have %q (err %v), want %q", meta, err, "v2")
+	}
+	if err := db.SetMeta(nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func TestIterateShelfRange(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 6), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[uint64][]byte)
+	for shelf := 0; shelf < 5; shelf++ {
+		for i := 0; i < 3; i++ {
+			data := fill(byte(i), 100*shelf+50)
+			key, err := db.Put(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[key] = data
+		}
+	}
+	visited := make(map[int]int)
+	if err := db.IterateShelfRange(1, 3, func(key uint64, data []byte) {
+		visited[int(key>>slotBits)]++
+		if !bytes.Equal(data, want[key]) {
+			t.Errorf("key %#x: wrong data", key)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 3 || visited[1] != 3 || visited[2] != 3 || visited[3] != 3 {
+		t.Fatalf("wrong shelves visited: %v", visited)
+	}
+	for _, r := range [][2]int{{3, 1}, {-1, 2}, {0, 5}} {
+		if err := db.IterateShelfRange(r[0], r[1], func(uint64, []byte) {}); !errors.Is(err, ErrShelfOutOfRange) {
+			t.Errorf("range %v: expected %v, got %v", r, ErrShelfOutOfRange, err)
+		}
+	}
+}
+
+func TestScrub(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p, Checksum: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 20; i++ {
+		key, err := db.Put(fill(byte(i), 50+100*(i%2)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// Deleted slots are not checked, even if corrupt
+	if err := db.Delete(keys[4]); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the data of one item in each shelf, and the deleted one
+	corrupt := func(key uint64) {
+		t.Helper()
+		slotSize := 100 * int64(key>>slotBits+1)
+		f, err := os.OpenFile(filepath.Join(p, fmt.Sprintf("bkt_%08d.bag", slotSize)), os.O_RDWR, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteAt([]byte{0xff}, int64(key&(1<<slotBits-1))*slotSize+20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []uint64{keys[2], keys[7], keys[4]} {
+		corrupt(key)
+	}
+	bad, err := db.Scrub()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(bad), fmt.Sprint([]uint64{keys[2], keys[7]}); have != want {
+		t.Fatalf("have bad keys %v, want %v", have, want)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.ScrubContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	plain, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.Scrub(); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
+
+func TestMaxGapListEntries(t *testing.T) {
+	var (
+		p    = t.TempDir()
+		opts = Options{Path: p, MaxGapListEntries: 10}
+	)
+	db, err := OpenFixed(opts, 64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 100; i++ {
+		key, err := db.Put([]byte(fmt.Sprintf("item-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// Delete every other item, well beyond the cap.
+	for i := 0; i < 100; i += 2 {
+		if err := db.Delete(keys[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if free, _ := db.FreeSlots(0); len(free) != 10 {
+		t.Fatalf("have %d free slots tracked, want 10", len(free))
+	}
+	// The tracked slots are reused, after which the file grows.
+	for i := 0; i < 11; i++ {
+		key, err := db.Put([]byte("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 10 && key >= 100 {
+			t.Fatalf("put %d: expected reused slot, got %d", i, key)
+		}
+		if i == 10 && key != 100 {
+			t.Fatalf("put %d: expected slot 100, got %d", i, key)
+		}
+	}
+	db.Close()
+	// On reopen, the untracked slots are reclaimed, and the deleted items
+	// must not be resurrected.
+	db, err = OpenFixed(opts, 64, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := 0
+	db.Iterate(func(key uint64, data []byte) {
+		if s := string(data); s != "new" && s[len(s)-1]%2 == 0 {
+			t.Errorf("deleted item %q resurrected", data)
+		}
+		count++
+	})
+	if want := 50 + 11; count != want {
+		t.Fatalf("have %d items, want %d", count, want)
+	}
+	if _, tail := db.(*database).shelves[0].slotCounts(); tail != 61 {
+		t.Fatalf("have tail %d, want 61", tail)
+	}
+}
+
+func TestCompactShelf(t *testing.T) {
+	moves := make(map[uint64]uint64)
+	db, err := Open(Options{Path: t.TempDir(), OnRelocate: func(oldKey, newKey uint64) {
+		moves[oldKey] = newKey
+	}}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	items := make(map[uint64][]byte)
+	for i := 0; i < 40; i++ {
+		data := fill(byte(i), 50+100*(i%2)) // Shelves 0 and 1
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		items[key] = data
+	}
+	for key := range items {
+		if slot := key & (1<<slotBits - 1); slot%2 == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(items, key)
+		}
+	}
+	before, _ := db.Fragmentation()
+	if err := db.CompactShelf(1); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.Fragmentation()
+	if after[1] != 0 {
+		t.Fatalf("shelf 1 still fragmented: %v", after[1])
+	}
+	if after[0] != before[0] || after[0] == 0 {
+		t.Fatalf("shelf 0 fragmentation changed from %v to %v", before[0], after[0])
+	}
+	if len(moves) == 0 {
+		t.Fatal("no moves reported")
+	}
+	for oldKey, newKey := range moves {
+		if oldKey>>slotBits != 1 || newKey>>slotBits != 1 {
+			t.Fatalf("unexpected move %x -> %x", oldKey, newKey)
+		}
+		items[newKey] = items[oldKey]
+		delete(items, oldKey)
+	}
+	for key, want := range items {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, want) {
+			t.Fatalf("key %x: have %x (err %v), want %x", key, have, err, want)
+		}
+	}
+	for _, i := range []int{-1, 3} {
+		if err := db.CompactShelf(i); !errors.Is(err, ErrShelfOutOfRange) {
+			t.Fatalf("shelf %d: expected %v, got %v", i, ErrShelfOutOfRange, err)
+		}
+	}
+}
+
+func TestLocate(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		size := 10 + 15*i
+		key, err := db.Put(fill(byte(i), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc, err := db.Locate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.Shelf != int(key>>slotBits) || loc.Slot != key&(1<<slotBits-1) {
+			t.Fatalf("key %x: have shelf %d slot %d", key, loc.Shelf, loc.Slot)
+		}
+		if want := uint32(100 * (loc.Shelf + 1)); loc.SlotSize != want {
+			t.Fatalf("key %x: have slot size %d, want %d", key, loc.SlotSize, want)
+		}
+		if want := int64(loc.Slot) * int64(loc.SlotSize); loc.Offset != want {
+			t.Fatalf("key %x: have offset %d, want %d", key, loc.Offset, want)
+		}
+		if loc.Length != uint32(size) {
+			t.Fatalf("key %x: have length %d, want %d", key, loc.Length, size)
+		}
+	}
+	if _, err := db.Locate(5 << slotBits); !errors.Is(err, ErrShelfOutOfRange) {
+		t.Fatalf("expected %v, got %v", ErrShelfOutOfRange, err)
+	}
+}
+
+func TestShelfBoundary(t *testing.T) {
+	for _, opts := range []Options{
+		{},
+		{CompactHeader: true},
+		{Sequence: true, Checksum: true},
+	} {
+		opts.Path = t.TempDir()
+		db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrSize := 100 - int(db.(*database).shelves[0].capacity())
+		for i, slotSize := range []int{100, 200} {
+			exact := slotSize - hdrSize
+			if !db.FitsShelf(i, exact) {
+				t.Errorf("opts %+v: %d bytes should fit shelf %d", opts, exact, i)
+			}
+			if db.FitsShelf(i, exact+1) {
+				t.Errorf("opts %+v: %d bytes should not fit shelf %d", opts, exact+1, i)
+			}
+			key, err := db.Put(make([]byte, exact))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shelf := int(key >> slotBits); shelf != i {
+				t.Errorf("opts %+v: %d bytes stored in shelf %d, want %d", opts, exact, shelf, i)
+			}
+			key, err = db.Put(make([]byte, exact+1))
+			if i == 1 {
+				if !errors.Is(err, ErrValueTooLarge) {
+					t.Errorf("opts %+v: expected %v, got %v", opts, ErrValueTooLarge, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shelf := int(key >> slotBits); shelf != i+1 {
+				t.Errorf("opts %+v: %d bytes stored in shelf %d, want %d", opts, exact+1, shelf, i+1)
+			}
+		}
+		if db.FitsShelf(-1, 1) || db.FitsShelf(2, 1) {
+			t.Errorf("opts %+v: nonexistent shelves should not fit", opts)
+		}
+		db.Close()
+	}
+}
+
+func TestDeferDeletes(t *testing.T) {
+	opts := Options{Path: t.TempDir(), DeferDeletes: true, StrictDelete: true}
+	db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, err := db.Put(fill(byte(i), 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for _, key := range keys[:5] {
+		if err := db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(1000); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+	// Until applied, the data can still be read, and the slots are not
+	// reused.
+	for i, key := range keys[:5] {
+		if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(byte(i), 20)) {
+			t.Fatalf("key %x: have %x (err %v)", key, data, err)
+		}
+	}
+	key, err := db.Put(fill(0xff, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != 10 {
+		t.Fatalf("have key %d, want 10", key)
+	}
+	if err := db.ApplyDeletes(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[:5] {
+		if _, err := db.Get(key); !errors.Is(err, ErrDeleted) {
+			t.Fatalf("key %x: expected %v, got %v", key, ErrDeleted, err)
+		}
+	}
+	for _, key := range keys[5:] {
+		if _, err := db.Get(key); err != nil {
+			t.Fatalf("key %x: %v", key, err)
+		}
+	}
+	// Sync applies them too.
+	if err := db.Delete(keys[5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(keys[5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(keys[5]); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("expected %v, got %v", ErrDeleted, err)
+	}
+	// And so does Close.
+	if err := db.Delete(keys[6]); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	count := 0
+	db, err = Open(opts, SlotSizeLinear(100, 3), func(key uint64, data []byte) { count++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if count != 4 {
+		t.Fatalf("have %d items, want 4", count)
+	}
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	// copyDir copies the files of a database which is still open, as they
+	// would be found after a crash.
+	copyDir := func(src string) string {
+		dst := t.TempDir()
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dst
+	}
+	for _, tc := range []struct {
+		mode DeleteMode
+		want int
+	}{
+		{DeleteLazy, 10}, // The delete is lost without Close
+		{DeleteTombstone, 9},
+	} {
+		opts := Options{Path: t.TempDir(), DeleteMode: tc.mode}
+		db, err := OpenFixed(opts, 64, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := db.Put([]byte(fmt.Sprintf("item-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Delete(3); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		opts.Path = copyDir(db.(*database).path)
+		db.Close()
+
+		db, err = OpenFixed(opts, 64, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		db.Iterate(func(key uint64, data []byte) { count++ })
+		if count != tc.want {
+			t.Fatalf("mode %d: have %d items, want %d", tc.mode, count, tc.want)
+		}
+		if tc.mode == DeleteTombstone {
+			// The scan found the tombstone, and the freed slot got reused
+			// when the shelf was compacted.
+			if data, err := db.Get(3); err != nil || string(data) != "item-9" {
+				t.Fatalf("have %q (err %v), want %q", data, err, "item-9")
+			}
+			if _, tail := db.(*database).shelves[0].slotCounts(); tail != 9 {
+				t.Fatalf("have tail %d, want 9", tail)
+			}
+		}
+		db.Close()
+	}
+	if _, err := OpenFixed(Options{Path: t.TempDir(), DeleteMode: 5}, 64, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
+
+func TestIterateReverse(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(50, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 100; i++ {
+		key, err := db.Put(fill(byte(i), 1+i*37%180))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < len(keys); i += 7 {
+		db.Delete(keys[i])
+	}
+	var forward, reverse []uint64
+	db.Iterate(func(key uint64, data []byte) { forward = append(forward, key) })
+	db.IterateReverse(func(key uint64, data []byte) { reverse = append(reverse, key) })
+	if len(forward) != len(reverse) || len(forward) != 100-15 {
+		t.Fatalf("have %d items forward, %d reverse", len(forward), len(reverse))
+	}
+	for i, key := range reverse {
+		if want := forward[len(forward)-1-i]; key != want {
+			t.Fatalf("item %d: have key %#x, want %#x", i, key, want)
+		}
+		if i > 0 && key >= reverse[i-1] {
+			t.Fatalf("item %d: key %#x not below %#x", i, key, reverse[i-1])
+		}
+	}
+}
+
+func TestCompactionPlan(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	shelves := db.(*database).shelves
+	if len(shelves) < 4 {
+		t.Fatalf("have %d shelves, want at least 4", len(shelves))
+	}
+	// The first slots of each shelf are deleted, so the tails stay put.
+	deletes := []int{5, 1, 4, 0}
+	for i, n := range deletes {
+		var keys []uint64
+		for j := 0; j < 10; j++ {
+			key, err := db.Put(make([]byte, shelves[i].capacity()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys = append(keys, key)
+		}
+		for _, key := range keys[:n] {
+			db.Delete(key)
+		}
+	}
+	bytes := db.ReclaimableBytes()
+	for i, n := range deletes {
+		if want := uint64(n) * uint64(shelves[i].slotSize); bytes[i] != want {
+			t.Errorf("shelf %d: have %d reclaimable bytes, want %d", i, bytes[i], want)
+		}
+	}
+	// Slot sizes 100, 200, 300: shelf 2 frees 1200 bytes, shelf 0 500, shelf
+	// 1 200, and shelf 3 nothing.
+	plan := db.CompactionPlan()
+	if want := []int{2, 0, 1}; fmt.Sprint(plan) != fmt.Sprint(want) {
+		t.Fatalf("have plan %v, want %v", plan, want)
+	}
+	if err := db.CompactShelf(plan[0]); err != nil {
+		t.Fatal(err)
+	}
+	if plan := db.CompactionPlan(); fmt.Sprint(plan) != "[0 1]" {
+		t.Fatalf("have plan %v after compacting, want [0 1]", plan)
+	}
+}
+
+func TestTailLength(t *testing.T) {
+	p := t.TempDir()
+	opts := Options{Path: p, TailLength: true}
+	db, err := Open(opts, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tail length takes 4 bytes of the slot, besides the header
+	if _, err := db.Put(make([]byte, 93)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		key, err := db.Put(fill(byte(i), 92-i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	db.Close()
+	if m, err := readManifest(osFS{}, p, ""); err != nil || m.Version != 2 || !m.TailLength {
+		t.Fatalf("unexpected manifest %+v: %v", m, err)
+	}
+	if _, err := Open(Options{Path: p}, SlotSizeLinear(100, 2), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	// Overwrite the tail length of the second slot, as if the end of the
+	// write had never reached the disk
+	f, err := os.OpenFile(filepath.Join(p, "bkt_00000100.bag"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 4), 2*100-4); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open(opts, SlotSizeLinear(100, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(keys[1]); !errors.Is(err, ErrTornWrite) || !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrTornWrite, err)
+	}
+	for _, i := range []int{0, 2} {
+		if data, err := db.Get(keys[i]); err != nil || !bytes.Equal(data, fill(byte(i), 92-i)) {
+			t.Fatalf("intact item %d failed: %v", i, err)
+		}
+	}
+}
+
+func TestReserveBlock(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Leave a gap, which the block must not use
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	block, err := db.ReserveBlock(4, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block) != 4 {
+		t.Fatalf("have %d keys, want 4", len(block))
+	}
+	for i, key := range block {
+		shelf, slot := db.ParseKey(key)
+		if shelf != 1 || slot != uint64(i) {
+			t.Fatalf("key %d: have shelf %d slot %d, want shelf 1 slot %d", i, shelf, slot, i)
+		}
+		if _, err := db.Get(key); !errors.Is(err, ErrNeverWritten) {
+			t.Fatalf("key %d: expected %v, got %v", i, ErrNeverWritten, err)
+		}
+	}
+	block, err = db.ReserveBlock(2, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block[0] != keys[2]+1 || block[1] != keys[2]+2 {
+		t.Fatalf("have keys %v, want the slots after %d", block, keys[2])
+	}
+	for i, key := range block {
+		if err := db.PutAt(key, fill(byte(10+i), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(block[0]); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(block[1]); err != nil || !bytes.Equal(data, fill(11, 60)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+	// The gap left before the block is still reused by Put
+	if key, err := db.Put(fill(0xff, 50)); err != nil || key != keys[1] {
+		t.Fatalf("have key %d, %v, want %d", key, err, keys[1])
+	}
+	if _, err := db.ReserveBlock(1, 1000); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+}
+
+func TestReserveBlockCompact(t *testing.T) {
+	moved := make(map[uint64]uint64)
+	db, err := Open(Options{
+		Path:       t.TempDir(),
+		OnRelocate: func(oldKey, newKey uint64) { moved[oldKey] = newKey },
+	}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 2; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	block, err := db.ReserveBlock(2, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The reserved slots are at the end, and stay there
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// An item past the reserved slots is moved, but not over them
+	last := block[1] + 2
+	if err := db.PutAt(last, fill(9, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if moved[last] != keys[0] || len(moved) != 1 {
+		t.Fatalf("unexpected moves: %v", moved)
+	}
+	if key, err := db.Put(fill(3, 50)); err != nil || key == block[0] || key == block[1] {
+		t.Fatalf("have key %d, %v, want none of the reserved %v", key, err, block)
+	}
+	for i, key := range block {
+		if _, err := db.Get(key); !errors.Is(err, ErrNeverWritten) {
+			t.Fatalf("key %d: expected %v, got %v", key, ErrNeverWritten, err)
+		}
+		if err := db.PutAt(key, fill(byte(20+i), 50)); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(byte(20+i), 50)) {
+			t.Fatalf("key %d: have %x, %v", key, data, err)
+		}
+	}
+}
+
+func TestNthKey(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for n := uint32(0); n < 5; n++ {
+		for _, item := range []struct{ size, shelf int }{{10, 0}, {150, 1}, {350, 3}} {
+			shelf := item.shelf
+			key, err := db.Put(make([]byte, item.size))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := NthKey(shelf, n); key != want {
+				t.Fatalf("item %d of shelf %d: have key %#x, want %#x", n, shelf, key, want)
+			}
+			if want := db.MakeKey(shelf, uint64(n)); key != want {
+				t.Fatalf("item %d of shelf %d: MakeKey gives %#x, want %#x", n, shelf, want, key)
+			}
+		}
+	}
+	if have, want := NthKey(maxShelves-1, 1<<slotBits-1), uint64(1)<<keyBits-1; have != want {
+		t.Fatalf("have largest key %#x, want %#x", have, want)
+	}
+}
+
+func TestSkipMissingShelves(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for _, size := range []int{50, 150, 250} {
+		key, err := db.Put(fill(byte(size), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	db.Close()
+	missing := filepath.Join(p, "bkt_00000200.bag")
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+	// The third shelf can't be opened either
+	if err := os.Remove(filepath.Join(p, "bkt_00000300.bag")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(p, "bkt_00000300.bag"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{Path: p, SkipMissingShelves: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(keys[0]); err != nil || !bytes.Equal(data, fill(50, 50)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+	for _, key := range keys[1:] {
+		if _, err := db.Get(key); !errors.Is(err, ErrShelfUnavailable) {
+			t.Errorf("get %#x: expected %v, got %v", key, ErrShelfUnavailable, err)
+		}
+		if err := db.Delete(key); !errors.Is(err, ErrShelfUnavailable) {
+			t.Errorf("delete %#x: expected %v, got %v", key, ErrShelfUnavailable, err)
+		}
+	}
+	if _, err := db.Put(make([]byte, 150)); !errors.Is(err, ErrShelfUnavailable) {
+		t.Errorf("expected %v, got %v", ErrShelfUnavailable, err)
+	}
+	if _, err := db.Put(make([]byte, 40)); err != nil {
+		t.Fatal(err)
+	}
+	var items int
+	db.Iterate(func(uint64, []byte) { items++ })
+	if items != 2 {
+		t.Fatalf("have %d items, want 2", items)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); !errors.Is(err, ErrShelfUnavailable) {
+		t.Errorf("expected %v, got %v", ErrShelfUnavailable, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(missing); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing shelf file recreated: %v", err)
+	}
+}
+
+func TestAddShelf(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(fill(1, 300)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+	var nonIncreasing *ErrNonIncreasingSlotSizes
+	if _, err := db.AddShelf(200); !errors.As(err, &nonIncreasing) {
+		t.Fatalf("expected %T, got %v", nonIncreasing, err)
+	}
+	index, err := db.AddShelf(400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index != 2 {
+		t.Fatalf("have shelf %d, want 2", index)
+	}
+	key, err := db.Put(fill(1, 300))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shelf := key >> slotBits; shelf != 2 {
+		t.Fatalf("have shelf %d, want 2", shelf)
+	}
+	db.Close()
+	if m, err := readManifest(osFS{}, p, ""); err != nil || !m.hasSlotSizes([]uint32{100, 200, 400}) {
+		t.Fatalf("manifest has slot sizes %v (err %v)", m.SlotSizes, err)
+	}
+	// The item is found in the new shelf after reopening.
+	sizes := []uint32{100, 200, 400}
+	i := 0
+	db, err = Open(Options{Path: p}, func() (uint32, bool) {
+		i++
+		return sizes[i-1], i == len(sizes)
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(1, 300)) {
+		t.Fatalf("wrong data (err %v)", err)
+	}
+	// The shelf limit is respected.
+	db2, err := Open(Options{Path: t.TempDir(), MaxShelves: 2}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := db2.AddShelf(400); !errors.Is(err, ErrTooManyShelves) {
+		t.Fatalf("expected %v, got %v", ErrTooManyShelves, err)
+	}
+}
+
+func TestMaxValueSize(t *testing.T) {
+	for i, opts := range []Options{
+		{},
+		{CompactHeader: true},
+		{Checksum: true, Sequence: true},
+		{Timestamps: true, TailLength: true},
+		{Compression: true},
+	} {
+		opts.Path = t.TempDir()
+		db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		max := db.MaxValueSize()
+		if _, err := db.Put(fill(1, max)); err != nil {
+			t.Errorf("options %d: put of %d bytes failed: %v", i, max, err)
+		}
+		if _, err := db.Put(fill(1, max+1)); !errors.Is(err, ErrValueTooLarge) {
+			t.Errorf("options %d: %d bytes: expected %v, got %v", i, max+1, ErrValueTooLarge, err)
+		}
+		db.Close()
+	}
+}
+
+// slowFS blocks the reads from its files while slow is set, until release is
+// closed.
+type slowFS struct {
+	*memFS
+	mu      sync.Mutex
+	slow    bool
+	release chan struct{}
+}
+
+func (fsys *slowFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &slowFile{f, fsys}, nil
+}
+
+type slowFile struct {
+	File
+	fsys *slowFS
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	slow := f.fsys.slow
+	f.fsys.mu.Unlock()
+	if slow {
+		<-f.fsys.release
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func TestGetTimeout(t *testing.T) {
+	fsys := &slowFS{memFS: newMemFS("db"), release: make(chan struct{})}
+	db, err := Open(Options{Path: "db", FS: fsys}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, err := db.Put(fill(1, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.mu.Lock()
+	fsys.slow = true
+	fsys.mu.Unlock()
+	if _, err := db.GetTimeout(key, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := db.GetContext(ctx, key); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	// The reads left behind are limited
+	for i := 0; i < 2*maxGetters; i++ {
+		if _, err := db.GetTimeout(key, time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	}
+	if have := len(db.(*database).getters); have != maxGetters {
+		t.Fatalf("have %d reads pending, want %d", have, maxGetters)
+	}
+	// Once the disk responds, the data is returned.
+	close(fsys.release)
+	if data, err := db.GetTimeout(key, time.Minute); err != nil || !bytes.Equal(data, fill(1, 50)) {
+		t.Fatalf("wrong data (err %v)", err)
+	}
+}
+
+func TestIsValidKey(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 3; i++ {
+		key, err := db.Put(fill(byte(i), 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// Not the last item, since that would lower the high-water mark
+	if err := db.Delete(keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		key   uint64
+		valid bool
+	}{
+		{"live", keys[0], true},
+		{"last", keys[2], true},
+		{"deleted", keys[1], false},
+		{"beyond high-water mark", keys[2] + 1, false},
+		{"empty shelf", db.MakeKey(1, 0), false},
+		{"shelf out of range", db.MakeKey(2, 0), false},
+		{"overflow", overflowBit, false},
+	} {
+		if have := db.IsValidKey(tt.key); have != tt.valid {
+			t.Errorf("%v key %#x: have %v, want %v", tt.name, tt.key, have, tt.valid)
+		}
+	}
+}
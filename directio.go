@@ -0,0 +1,61 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// DirectIOAlignment is the alignment required for direct I/O: with
+// Options.DirectIO, every slot size must be a multiple of it.
+const DirectIOAlignment = 4096
+
+// openDirect opens the named file for reading with direct I/O, bypassing the
+// page cache. This needs a file of the OS filesystem, on a platform and
+// filesystem which support it.
+func openDirect(fsys FS, name string) (File, error) {
+	if !directIOSupported {
+		return nil, fmt.Errorf("%w: not supported on this platform", ErrDirectIOUnsupported)
+	}
+	if _, ok := fsys.(osFS); !ok {
+		return nil, fmt.Errorf("%w: not an OS filesystem", ErrDirectIOUnsupported)
+	}
+	f, err := os.OpenFile(name, os.O_RDONLY|oDirect, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDirectIOUnsupported, err)
+	}
+	return f, nil
+}
+
+// alignedBuffer returns a buffer of the given size, whose address is aligned to
+// DirectIOAlignment, as direct I/O requires.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+DirectIOAlignment)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % DirectIOAlignment); rem != 0 {
+		off = DirectIOAlignment - rem
+	}
+	return buf[off : off+size : off+size]
+}
+
+// readSlotDirect is like readSlot, but reads from the file opened for direct
+// I/O, if any. Reads which fail are retried through the page cache. buf must be
+// a whole slot, allocated with alignedBuffer. The caller must hold fileMu.
+func (s *shelf) readSlotDirect(buf []byte, slot uint64) (int, error) {
+	if s.direct == nil {
+		return s.readSlot(buf, slot)
+	}
+	if s.bufferRead(buf, slot) {
+		return len(buf), nil
+	}
+	n, err := s.direct.ReadAt(buf, int64(slot)*int64(s.slotSize))
+	if err != nil && err != io.EOF {
+		return s.f.ReadAt(buf, int64(slot)*int64(s.slotSize))
+	}
+	return n, err
+}
@@ -0,0 +1,14 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux
+
+package billy
+
+import "syscall"
+
+const (
+	directIOSupported = true
+	oDirect           = syscall.O_DIRECT
+)
@@ -0,0 +1,12 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !linux
+
+package billy
+
+const (
+	directIOSupported = false
+	oDirect           = 0
+)
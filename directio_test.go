@@ -0,0 +1,69 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	var warnings []error
+	opts := Options{
+		Path:      t.TempDir(),
+		DirectIO:  true,
+		OnWarning: func(err error) { warnings = append(warnings, err) },
+	}
+	if _, err := Open(opts, SlotSizeLinear(1000, 3), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	db, err := Open(opts, SlotSizeLinear(DirectIOAlignment, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, err := range warnings {
+		// The filesystem of the test directory may not support it.
+		if !errors.Is(err, ErrDirectIOUnsupported) {
+			t.Fatalf("unexpected warning: %v", err)
+		}
+		t.Logf("falling back: %v", err)
+	}
+	if len(warnings) == 0 && db.(*database).shelves[0].direct == nil {
+		t.Fatal("direct I/O silently disabled")
+	}
+	want := make(map[uint64][]byte)
+	for i := 0; i < 100; i++ {
+		data := fill(byte(i), 1+i*127%8000)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	n := 0
+	db.Iterate(func(key uint64, data []byte) {
+		if !bytes.Equal(data, want[key]) {
+			t.Errorf("key %x: have %d bytes, want %d", key, len(data), len(want[key]))
+		}
+		n++
+	})
+	if n != len(want) {
+		t.Fatalf("have %d items, want %d", n, len(want))
+	}
+
+	// An FS which isn't the OS one falls back.
+	warnings = nil
+	opts.Path, opts.FS = "/memfs/billy", newMemFS("/memfs/billy")
+	db2, err := Open(opts, SlotSizeLinear(DirectIOAlignment, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if len(warnings) != len(db2.(*database).shelves) || !errors.Is(warnings[0], ErrDirectIOUnsupported) {
+		t.Fatalf("have warnings %v", warnings)
+	}
+}
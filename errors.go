@@ -0,0 +1,168 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The errors returned by billy wrap one of these values, so they can be
+// matched with errors.Is.
+var (
+	// ErrClosed is returned by operations on a closed database.
+	ErrClosed = errors.New("shelf closed")
+	// ErrOversized is returned when data does not fit in the slot of a shelf.
+	ErrOversized = errors.New("data too large for shelf")
+	// ErrValueTooLarge is returned by Put when the data does not fit in any
+	// shelf of the database.
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrBadIndex is returned for keys which do not refer to a valid slot.
+	ErrBadIndex = errors.New("bad index")
+	// ErrShelfOutOfRange is returned for keys whose shelf id is beyond the
+	// shelves of the database. It wraps ErrBadIndex.
+	ErrShelfOutOfRange = fmt.Errorf("%w: shelf out of range", ErrBadIndex)
+	// ErrKeyNotFound is returned by KeyedDB for names which are not stored.
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrEmptyData is returned when data which should be present is empty.
+	ErrEmptyData = errors.New("empty data")
+	// ErrReadOnly is returned by modifying operations in read-only mode.
+	ErrReadOnly = errors.New("read-only mode")
+	// ErrCorruptData is returned when the stored data is inconsistent.
+	ErrCorruptData = errors.New("corrupt data")
+	// ErrCorruptHeader is returned when the size in an item header exceeds the
+	// capacity of the slot. It wraps ErrCorruptData.
+	ErrCorruptHeader = fmt.Errorf("%w: size in header exceeds slot", ErrCorruptData)
+	// ErrChecksumMismatch is returned by Get when the checksum of an item does
+	// not match its data. It wraps ErrCorruptData.
+	ErrChecksumMismatch = fmt.Errorf("%w: checksum mismatch", ErrCorruptData)
+	// ErrTornWrite is returned by Get when the item size in the header does
+	// not match the one at the end of the slot, see Options.TailLength. It
+	// wraps ErrCorruptData.
+	ErrTornWrite = fmt.Errorf("%w: torn write", ErrCorruptData)
+	// ErrWrongSize is returned when writing a value whose length differs
+	// from Options.FixedValueSize.
+	ErrWrongSize = errors.New("wrong value size")
+	// ErrShelfUnavailable is returned for operations on a shelf which could
+	// not be opened, see Options.SkipMissingShelves.
+	ErrShelfUnavailable = errors.New("shelf unavailable")
+	// ErrNoBackup is returned by BackupIncremental if no Backup has been
+	// made since the database was opened.
+	ErrNoBackup = errors.New("no previous backup")
+	// ErrInvalidOptions is returned by Open for inconsistent options.
+	ErrInvalidOptions = errors.New("invalid options")
+	// ErrLayoutMismatch is returned by Open when the options do not match the
+	// layout the database was created with.
+	ErrLayoutMismatch = errors.New("layout mismatch")
+	// ErrDeleted is returned for deleted keys: in strict-delete mode for all
+	// of them, otherwise for those marked as deleted on disk.
+	ErrDeleted = errors.New("deleted")
+	// ErrNeverWritten is returned by Get for keys of slots which no item has
+	// been written to, such as slots beyond the end of the shelf. It wraps
+	// ErrBadIndex.
+	ErrNeverWritten = fmt.Errorf("%w: never written", ErrBadIndex)
+	// ErrTooManyShelves is returned by Open when the slot size function
+	// yields more shelves than allowed.
+	ErrTooManyShelves = errors.New("too many shelves")
+	// ErrBulkLoad is returned by operations not allowed in bulk-load mode.
+	ErrBulkLoad = errors.New("not allowed in bulk-load mode")
+	// ErrInvalidSlotSize is returned by Open for slot sizes which are too
+	// small, or not in increasing order.
+	ErrInvalidSlotSize = errors.New("invalid slot size")
+	// ErrSlotTooSmall is returned by Open for slot sizes which can't hold the
+	// item header and at least one byte of data.
+	ErrSlotTooSmall = fmt.Errorf("%w: slot too small", ErrInvalidSlotSize)
+	// ErrNotDirectory is returned by Open when the path is not a directory.
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrSequenceDisabled is returned by ReplayInSequence when the database
+	// was not opened with Options.Sequence.
+	ErrSequenceDisabled = errors.New("sequence numbers not enabled")
+	// ErrDirectIOUnsupported is reported to Options.OnWarning when a shelf
+	// file can't be opened for direct I/O.
+	ErrDirectIOUnsupported = errors.New("direct I/O not supported")
+	// ErrFileShrunk is returned by Reload when a shelf file has become
+	// shorter than the shelf.
+	ErrFileShrunk = errors.New("file shrunk")
+	// ErrUnknownCodec is returned for items stored with a codec which is not
+	// available.
+	ErrUnknownCodec = errors.New("unknown codec")
+)
+
+// ErrNonIncreasingSlotSizes is returned by Open when the SlotSizeFn yields a
+// slot size which is not larger than the previous one. It wraps
+// ErrInvalidSlotSize.
+type ErrNonIncreasingSlotSizes struct {
+	Index int    // Index of the offending size among the sizes yielded
+	Prev  uint32 // The size yielded before it, 0 for the first one
+	Size  uint32 // The offending size
+}
+
+func (e *ErrNonIncreasingSlotSizes) Error() string {
+	return fmt.Sprintf("%v: slot sizes must be in increasing order, size %d at index %d follows %d",
+		ErrInvalidSlotSize, e.Size, e.Index, e.Prev)
+}
+
+func (e *ErrNonIncreasingSlotSizes) Unwrap() error { return ErrInvalidSlotSize }
+
+// joinedError holds several errors, like errors.Join in later Go versions.
+type joinedError struct {
+	errs []error
+}
+
+// joinErrors returns an error holding the non-nil ones among errs: nil if there
+// are none, the error itself if there is one.
+func joinErrors(errs ...error) error {
+	var nonNil []error
+	for _, err := range errs {
+		if err != nil {
+			nonNil = append(nonNil, err)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+	return &joinedError{nonNil}
+}
+
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As as of Go 1.20.
+func (e *joinedError) Unwrap() []error { return e.errs }
+
+// Is reports whether any of the errors matches target, for older Go versions.
+func (e *joinedError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors which matches target, for older Go
+// versions.
+func (e *joinedError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrReadonly is the previous name of ErrReadOnly.
+//
+// Deprecated: use ErrReadOnly.
+var ErrReadonly = ErrReadOnly
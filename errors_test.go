@@ -0,0 +1,156 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorsIs(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Put(make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, err, want error) {
+		t.Helper()
+		if !errors.Is(err, want) {
+			t.Errorf("%s: expected %v, got %v", name, want, err)
+		}
+	}
+	_, err = db.Put(make([]byte, 1000))
+	check("Put too large", err, ErrValueTooLarge)
+	_, err = db.Get(5 << slotBits)
+	check("Get out of range", err, ErrShelfOutOfRange)
+	check("Get out of range", err, ErrBadIndex)
+	check("Delete out of range", db.Delete(5<<slotBits), ErrShelfOutOfRange)
+	_, err = db.Get(key + 1000)
+	check("Get beyond tail", err, ErrBadIndex)
+	check("Get beyond tail", err, ErrNeverWritten)
+	check("ReplayInSequence", db.ReplayInSequence(nil), ErrSequenceDisabled)
+	db.Close()
+
+	_, err = db.Put(make([]byte, 10))
+	check("Put after close", err, ErrClosed)
+	_, err = db.Get(key)
+	check("Get after close", err, ErrClosed)
+	_, err = db.Len(key)
+	check("Len after close", err, ErrClosed)
+
+	// Open failures
+	_, err = Open(Options{Path: p, CompactHeader: true}, SlotSizeLinear(100, 3), nil)
+	check("Open with other layout", err, ErrLayoutMismatch)
+	decreasing := []uint32{200, 100}
+	_, err = Open(Options{Path: t.TempDir()}, func() (uint32, bool) {
+		size := decreasing[0]
+		decreasing = decreasing[1:]
+		return size, len(decreasing) == 0
+	}, nil)
+	check("Open with decreasing sizes", err, ErrInvalidSlotSize)
+	_, err = Open(Options{Path: t.TempDir()}, SlotSizeLinear(4, 3), nil)
+	check("Open with tiny slots", err, ErrInvalidSlotSize)
+	check("Open with tiny slots", err, ErrSlotTooSmall)
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(Options{Path: file}, SlotSizeLinear(100, 3), nil)
+	check("Open on a file", err, ErrNotDirectory)
+
+	// Read-only mode
+	ro, err := Open(Options{Path: p, Readonly: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	_, err = ro.Put(make([]byte, 10))
+	check("Put in read-only mode", err, ErrReadOnly)
+	check("Put in read-only mode", err, ErrReadonly)
+	check("Delete in read-only mode", ro.Delete(key), ErrReadOnly)
+}
+
+func TestErrSlotTooSmall(t *testing.T) {
+	// 16 bytes fit the regular header, but not one with sequence numbers
+	// and checksums.
+	p := t.TempDir()
+	sizes := func() SlotSizeFn { return SlotSizeLinear(16, 4) }
+	if _, err := Open(Options{Path: p, Sequence: true, Checksum: true}, sizes(), nil); !errors.Is(err, ErrSlotTooSmall) {
+		t.Fatalf("expected %v, got %v", ErrSlotTooSmall, err)
+	}
+	// Nothing was created.
+	if entries, _ := os.ReadDir(p); len(entries) != 0 {
+		t.Fatalf("have %d files, want none", len(entries))
+	}
+	db, err := Open(Options{Path: p}, sizes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if _, err := ValidateSlotSizeFn(SlotSizeLinear(7, 3)); !errors.Is(err, ErrSlotTooSmall) {
+		t.Fatalf("expected %v, got %v", ErrSlotTooSmall, err)
+	}
+}
+
+func TestErrNonIncreasingSlotSizes(t *testing.T) {
+	sizes := []uint32{100, 200, 200, 300}
+	i := 0
+	_, err := Open(Options{Path: t.TempDir()}, func() (uint32, bool) {
+		i++
+		return sizes[i-1], i == len(sizes)
+	}, nil)
+	var sizeErr *ErrNonIncreasingSlotSizes
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("expected %T, got %v", sizeErr, err)
+	}
+	if sizeErr.Index != 2 || sizeErr.Prev != 200 || sizeErr.Size != 200 {
+		t.Fatalf("have index %d, prev %d, size %d", sizeErr.Index, sizeErr.Prev, sizeErr.Size)
+	}
+	if !errors.Is(err, ErrInvalidSlotSize) {
+		t.Fatalf("expected %v, got %v", ErrInvalidSlotSize, err)
+	}
+}
+
+func TestErrNeverWritten(t *testing.T) {
+	for _, mode := range []DeleteMode{DeleteLazy, DeleteTombstone} {
+		opts := Options{Path: t.TempDir(), DeleteMode: mode}
+		db, err := OpenFixed(opts, 64, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := db.Put([]byte("item")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Slots 3 and 4 are skipped, and never written.
+		if err := db.PutAt(5, []byte("item")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete(1); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []uint64{3, 4, 6, 100} {
+			if _, err := db.Get(key); !errors.Is(err, ErrNeverWritten) {
+				t.Errorf("mode %d, key %d: expected %v, got %v", mode, key, ErrNeverWritten, err)
+			}
+		}
+		// Without tombstones, the deleted item is still on disk.
+		_, err = db.Get(1)
+		if mode == DeleteTombstone && !errors.Is(err, ErrDeleted) {
+			t.Errorf("mode %d: expected %v, got %v", mode, ErrDeleted, err)
+		}
+		if mode == DeleteLazy && err != nil {
+			t.Errorf("mode %d: %v", mode, err)
+		}
+		db.Close()
+	}
+}
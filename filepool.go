@@ -0,0 +1,171 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// filePool limits the number of shelf files which are open at once, see
+// Options.MaxOpenFiles. The files are closed in least-recently-used order, and
+// reopened when they are used again. Files in the middle of an operation are
+// never closed, so the limit may be exceeded briefly if more files than that are
+// in use concurrently.
+type filePool struct {
+	mu    sync.Mutex
+	limit int
+	lru   *list.List // Open files, most recently used at the front
+}
+
+func newFilePool(limit int) *filePool {
+	return &filePool{limit: limit, lru: list.New()}
+}
+
+// pooledFile is a file of a filePool, which is only open while it's among the
+// most recently used ones.
+type pooledFile struct {
+	pool   *filePool
+	fs     FS
+	name   string
+	flag   int  // Flags to reopen the file with
+	f      File // The open file, nil while it's closed
+	elem   *list.Element
+	users  int  // Number of operations in progress
+	closed bool // Set by Close
+}
+
+// open opens the named file, like FS.OpenFile, as a file of the pool.
+func (p *filePool) open(fsys FS, name string, flag int, perm os.FileMode) (File, error) {
+	pf := &pooledFile{
+		pool: p,
+		fs:   fsys,
+		name: name,
+		// Reopening must not create or truncate the file again
+		flag: flag &^ (os.O_CREATE | os.O_TRUNC | os.O_EXCL),
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.evict(p.limit - 1)
+	f, err := fsys.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	pf.f = f
+	pf.elem = p.lru.PushFront(pf)
+	return pf, nil
+}
+
+// evict closes the least recently used files which are not in use, until at
+// most n files are open. The caller must hold p.mu.
+func (p *filePool) evict(n int) {
+	for e := p.lru.Back(); e != nil && p.lru.Len() > n; {
+		pf, prev := e.Value.(*pooledFile), e.Prev()
+		if pf.users == 0 {
+			// Nothing is lost if closing fails, the writes have been
+			// handed to the OS already.
+			pf.f.Close()
+			pf.f = nil
+			p.lru.Remove(e)
+		}
+		e = prev
+	}
+}
+
+// acquire returns the open file, reopening it if needed, and keeps it open
+// until release is called.
+func (pf *pooledFile) acquire() (File, error) {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pf.closed {
+		return nil, os.ErrClosed
+	}
+	if pf.f == nil {
+		p.evict(p.limit - 1)
+		f, err := pf.fs.OpenFile(pf.name, pf.flag, 0666)
+		if err != nil {
+			return nil, err
+		}
+		pf.f = f
+		pf.elem = p.lru.PushFront(pf)
+	} else {
+		p.lru.MoveToFront(pf.elem)
+	}
+	pf.users++
+	return pf.f, nil
+}
+
+// release ends an operation started with acquire.
+func (pf *pooledFile) release() {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pf.users--
+	p.evict(p.limit)
+}
+
+func (pf *pooledFile) ReadAt(b []byte, off int64) (int, error) {
+	f, err := pf.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.release()
+	return f.ReadAt(b, off)
+}
+
+func (pf *pooledFile) WriteAt(b []byte, off int64) (int, error) {
+	f, err := pf.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer pf.release()
+	return f.WriteAt(b, off)
+}
+
+func (pf *pooledFile) Truncate(size int64) error {
+	f, err := pf.acquire()
+	if err != nil {
+		return err
+	}
+	defer pf.release()
+	return f.Truncate(size)
+}
+
+func (pf *pooledFile) Sync() error {
+	f, err := pf.acquire()
+	if err != nil {
+		return err
+	}
+	defer pf.release()
+	return f.Sync()
+}
+
+func (pf *pooledFile) Stat() (os.FileInfo, error) {
+	f, err := pf.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer pf.release()
+	return f.Stat()
+}
+
+func (pf *pooledFile) Close() error {
+	p := pf.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pf.closed {
+		return os.ErrClosed
+	}
+	pf.closed = true
+	if pf.f == nil {
+		return nil
+	}
+	p.lru.Remove(pf.elem)
+	err := pf.f.Close()
+	pf.f = nil
+	return err
+}
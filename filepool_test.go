@@ -0,0 +1,98 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// openCountFS keeps track of the number of shelf files open at once.
+type openCountFS struct {
+	*memFS
+	mu        sync.Mutex
+	open, max int
+}
+
+func (fsys *openCountFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, ok := ParseShelfName(filepath.Base(name)); !ok {
+		return f, nil
+	}
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.open++; fsys.open > fsys.max {
+		fsys.max = fsys.open
+	}
+	return &openCountFile{f, fsys}, nil
+}
+
+type openCountFile struct {
+	File
+	fsys *openCountFS
+}
+
+func (f *openCountFile) Close() error {
+	f.fsys.mu.Lock()
+	f.fsys.open--
+	f.fsys.mu.Unlock()
+	return f.File.Close()
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	var (
+		path = "/memfs/billy"
+		fsys = &openCountFS{memFS: newMemFS(path)}
+		opts = Options{Path: path, FS: fsys, MaxOpenFiles: 3}
+	)
+	db, err := Open(opts, SlotSizeLinear(50, 20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Spread the items over most of the 20 shelves, in an order which keeps
+	// switching shelves.
+	want := make(map[uint64][]byte)
+	for i := 0; i < 200; i++ {
+		data := fill(byte(i), (i*7)%19*50+1)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	check := func() {
+		t.Helper()
+		for key, data := range want {
+			if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("key %x: have %d bytes (err %v), want %d", key, len(have), err, len(data))
+			}
+		}
+	}
+	check()
+	db.Close()
+	if fsys.open != 0 {
+		t.Fatalf("have %d files open after close", fsys.open)
+	}
+	// Reopening scans all shelves.
+	n := 0
+	db, err = Open(opts, SlotSizeLinear(50, 20), func(key uint64, data []byte) { n++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n != len(want) {
+		t.Fatalf("have %d items, want %d", n, len(want))
+	}
+	check()
+	if fsys.max > opts.MaxOpenFiles {
+		t.Fatalf("have %d files open at once, limit %d", fsys.max, opts.MaxOpenFiles)
+	}
+}
@@ -0,0 +1,125 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// With Options.FixedValueSize, the slots hold the values without any item
+// header, so a deleted slot can't be told apart from one in use. Instead, the
+// gap-list is saved in a file next to the shelf, as a sequence of big-endian
+// uint64 slot numbers:
+// [ uint64: slot | uint64: slot | ... ]
+// The file is replaced on Sync and Close, and before a slot listed in it is
+// written to, so it never lists a slot in use. After a crash, the slots deleted
+// since the file was last written are in use again, like the slots whose
+// headers have not been blanked yet, see DeleteLazy.
+
+// freeListName returns the file name of the gap-list of the shelf with the given
+// file name.
+func freeListName(id string) string {
+	return strings.TrimSuffix(id, filepath.Ext(id)) + ".free"
+}
+
+// loadFreeList fills the gap-list of a shelf with fixed-size values from the
+// saved file, if any. The onData callback, if any, is then invoked for every
+// slot in use.
+func (s *shelf) loadFreeList(onData onShelfDataFn) error {
+	data, err := readFileFS(s.fs, s.free)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Nothing was deleted
+	case err != nil:
+		return err
+	case len(data)%8 != 0:
+		return fmt.Errorf("%w: free list %v of %d bytes", ErrCorruptData, s.free, len(data))
+	default:
+		for ; len(data) > 0; data = data[8:] {
+			slot := binary.BigEndian.Uint64(data)
+			// Slots beyond the tail are listed until the file is
+			// next written, and must be claimed if the tail grows.
+			s.savedFree.Append(slot)
+			if slot < s.tail {
+				s.gaps.Append(slot)
+			}
+		}
+	}
+	if onData != nil {
+		s.iterate(0, s.tail, s.gaps, false, onData)
+	}
+	return nil
+}
+
+// saveFreeList writes the gap-list of a shelf with fixed-size values to its
+// file, unless it's saved already. The caller must hold gapsMu.
+func (s *shelf) saveFreeList() error {
+	if s.free == "" || s.readonly || equalSlots(s.gaps, s.savedFree) {
+		return nil
+	}
+	return s.writeFreeList(s.gaps)
+}
+
+// claimFree makes sure that the count slots starting at first are not listed in
+// the saved gap-list, before they're written to. The caller must hold gapsMu.
+func (s *shelf) claimFree(first, count uint64) error {
+	if s.free == "" {
+		return nil
+	}
+	idx := sort.Search(len(s.savedFree), func(i int) bool { return s.savedFree[i] >= first })
+	if idx == len(s.savedFree) || s.savedFree[idx] >= first+count {
+		return nil
+	}
+	gaps := make(sortedUniqueInts, 0, len(s.gaps))
+	for _, gap := range s.gaps {
+		if gap < first || gap >= first+count {
+			gaps = append(gaps, gap)
+		}
+	}
+	return s.writeFreeList(gaps)
+}
+
+// writeFreeList replaces the file of the saved gap-list with the given one, or
+// removes it if there are no gaps. The caller must hold gapsMu.
+func (s *shelf) writeFreeList(gaps sortedUniqueInts) error {
+	if len(gaps) == 0 {
+		if err := s.fs.Remove(s.free); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		s.savedFree = nil
+		return nil
+	}
+	data := make([]byte, 8*len(gaps))
+	for i, gap := range gaps {
+		binary.BigEndian.PutUint64(data[8*i:], gap)
+	}
+	if err := writeFileFS(s.fs, s.free+".tmp", data); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(s.free+".tmp", s.free); err != nil {
+		return err
+	}
+	s.savedFree = append(sortedUniqueInts(nil), gaps...)
+	return nil
+}
+
+// equalSlots reports whether the two lists hold the same slots.
+func equalSlots(a, b sortedUniqueInts) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
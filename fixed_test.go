@@ -0,0 +1,143 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFixedValueSize(t *testing.T) {
+	p := t.TempDir()
+	opts := Options{Path: p, FixedValueSize: 32}
+	db, err := Open(opts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, err := db.Put(fill(byte(i), 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for _, size := range []int{31, 33} {
+		if _, err := db.Put(make([]byte, size)); !errors.Is(err, ErrWrongSize) {
+			t.Errorf("put of %d bytes: expected %v, got %v", size, ErrWrongSize, err)
+		}
+	}
+	if _, err := db.Swap(keys[0], make([]byte, 16)); !errors.Is(err, ErrWrongSize) {
+		t.Errorf("swap: expected %v, got %v", ErrWrongSize, err)
+	}
+	// No headers, the values are packed back to back
+	stat, err := os.Stat(filepath.Join(p, "bkt_00000032.bag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != 10*32 {
+		t.Fatalf("have file of %d bytes, want %d", stat.Size(), 10*32)
+	}
+	for i, key := range keys {
+		if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(byte(i), 32)) {
+			t.Fatalf("item %d: have %x, %v", i, data, err)
+		}
+		if size, err := db.Len(key); err != nil || size != 32 {
+			t.Fatalf("item %d: have size %d, %v", i, size, err)
+		}
+	}
+	if err := db.Delete(keys[3]); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(keys[7]); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The deleted slots are remembered across the restart
+	seen := make(map[uint64]bool)
+	db, err = Open(opts, nil, func(key uint64, data []byte) {
+		seen[key] = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 8 || seen[keys[3]] || seen[keys[7]] {
+		t.Fatalf("unexpected items on open: %v", seen)
+	}
+	for _, want := range []uint64{keys[3], keys[7]} {
+		if key, err := db.Put(fill(0xff, 32)); err != nil || key != want {
+			t.Fatalf("have key %d, %v, want reused key %d", key, err, want)
+		}
+	}
+	db.Close()
+
+	if _, err := Open(Options{Path: p, FixedValueSize: 32, Checksum: true}, nil, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	if _, err := OpenFixed(Options{Path: p, FixedValueSize: 32}, 32, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	if _, err := OpenFixed(Options{Path: p}, 32, nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+}
+
+func TestFixedValueSizeCrash(t *testing.T) {
+	opts := Options{Path: t.TempDir(), FixedValueSize: 32}
+	db, err := Open(opts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []uint64
+	for i := 0; i < 10; i++ {
+		key, err := db.Put(fill(byte(i), 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	db.Delete(keys[3])
+	db.Delete(keys[7])
+	db.Close()
+
+	// Reuse a saved gap, and delete another slot before syncing
+	if db, err = Open(opts, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := db.Put(fill(0xff, 32)); err != nil || key != keys[3] {
+		t.Fatalf("have key %d, %v, want reused key %d", key, err, keys[3])
+	}
+	db.Delete(keys[5])
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// A delete after the sync is lost
+	db.Delete(keys[1])
+
+	// Reopen without closing, as after a crash
+	seen := make(map[uint64][]byte)
+	db, err = Open(opts, nil, func(key uint64, data []byte) {
+		seen[key] = append([]byte(nil), data...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(seen) != 8 || seen[keys[5]] != nil || seen[keys[7]] != nil {
+		t.Fatalf("unexpected items on open: %v", seen)
+	}
+	if !bytes.Equal(seen[keys[3]], fill(0xff, 32)) {
+		t.Fatalf("reused slot: have %x", seen[keys[3]])
+	}
+	for _, want := range []uint64{keys[5], keys[7]} {
+		if key, err := db.Put(fill(0xee, 32)); err != nil || key != want {
+			t.Fatalf("have key %d, %v, want reused key %d", key, err, want)
+		}
+	}
+}
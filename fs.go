@@ -0,0 +1,126 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"io"
+	"os"
+	"runtime"
+)
+
+// File is the subset of file operations needed by billy. It is satisfied by
+// *os.File.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Truncate(size int64) error
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// FS abstracts the filesystem a database is stored on, so that billy can be
+// run on top of e.g. an in-memory filesystem or custom storage. The names
+// passed to it are produced with filepath.Join from Options.Path.
+type FS interface {
+	// OpenFile opens the named file with the given flags (os.O_RDONLY,
+	// os.O_RDWR, os.O_CREATE, os.O_TRUNC), like os.OpenFile.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Stat returns the file info of the named file or directory, like os.Stat.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the entries of the named directory, sorted by name,
+	// like os.ReadDir.
+	ReadDir(name string) ([]os.DirEntry, error)
+	// Rename moves the file oldpath to newpath, replacing newpath if it
+	// exists, like os.Rename.
+	Rename(oldpath, newpath string) error
+	// Remove removes the named file, like os.Remove.
+	Remove(name string) error
+}
+
+// DirSyncer may be implemented by an FS on which files only survive a crash
+// once their directory has been synced too, after they were created or
+// extended. Database.Sync then syncs the database directory as needed.
+type DirSyncer interface {
+	// SyncDir flushes the entries of the named directory to disk.
+	SyncDir(name string) error
+}
+
+// osFS is the FS used by default, backed by the OS filesystem.
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // Avoid returning a non-nil interface holding a nil file
+	}
+	return f, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) SyncDir(name string) error {
+	if runtime.GOOS == "windows" {
+		return nil // Directories can't be opened for syncing
+	}
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// readFileFS reads the whole named file from the filesystem.
+func readFileFS(fsys FS, name string) ([]byte, error) {
+	f, err := fsys.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, stat.Size())
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeFileFS writes data to the named file, replacing any previous content.
+func writeFileFS(fsys FS, name string, data []byte) error {
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, 0); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,539 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory FS, for testing.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+}
+
+func newMemFS(dirs ...string) *memFS {
+	fsys := &memFS{files: make(map[string]*memData), dirs: make(map[string]bool)}
+	for _, dir := range dirs {
+		fsys.dirs[filepath.Clean(dir)] = true
+	}
+	return fsys
+}
+
+func (fsys *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if !fsys.dirs[filepath.Dir(name)] {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	d, ok := fsys.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{name: filepath.Base(name)}
+		fsys.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.Truncate(0)
+	}
+	return &memFile{memData: d, readonly: flag&(os.O_RDWR|os.O_WRONLY) == 0}, nil
+}
+
+func (fsys *memFS) Stat(name string) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if fsys.dirs[name] {
+		return memInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	if d, ok := fsys.files[name]; ok {
+		return d.Stat()
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fsys *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if !fsys.dirs[name] {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for path, d := range fsys.files {
+		if filepath.Dir(path) == name {
+			info, _ := d.Stat()
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (fsys *memFS) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	d, ok := fsys.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if !fsys.dirs[filepath.Dir(newpath)] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	d.mu.Lock()
+	d.name = filepath.Base(newpath)
+	d.mu.Unlock()
+	delete(fsys.files, oldpath)
+	fsys.files[newpath] = d
+	return nil
+}
+
+func (fsys *memFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	name = filepath.Clean(name)
+	if _, ok := fsys.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, name)
+	return nil
+}
+
+// memData is the content of a file in a memFS.
+type memData struct {
+	mu   sync.RWMutex
+	name string
+	data []byte
+}
+
+func (d *memData) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memData) writeAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(d.data)) {
+		d.data = append(d.data, make([]byte, end-int64(len(d.data)))...)
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memData) Truncate(size int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if size <= int64(len(d.data)) {
+		d.data = d.data[:size]
+	} else {
+		d.data = append(d.data, make([]byte, size-int64(len(d.data)))...)
+	}
+	return nil
+}
+
+func (d *memData) Stat() (os.FileInfo, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memInfo{name: d.name, size: int64(len(d.data))}, nil
+}
+
+// memFile is an open handle to a memData.
+type memFile struct {
+	*memData
+	readonly bool
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.readonly {
+		return 0, os.ErrPermission
+	}
+	return f.writeAt(p, off)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.readonly {
+		return os.ErrPermission
+	}
+	return f.memData.Truncate(size)
+}
+
+func (f *memFile) Sync() error  { return nil }
+func (f *memFile) Close() error { return nil }
+
+type memInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return i.dir }
+func (i memInfo) Sys() interface{}   { return nil }
+func (i memInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
+
+func TestMemFS(t *testing.T) {
+	var (
+		path = "/memfs/billy"
+		fsys = newMemFS(path)
+		opts = Options{Path: path, FS: fsys}
+		want = make(map[uint64][]byte)
+	)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Skipf("%v exists on disk", path)
+	}
+	db, err := Open(opts, SlotSizeLinear(50, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		data := fill(byte(i), 10+i)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	// Delete every third item
+	i := 0
+	for key := range want {
+		if i%3 == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+		}
+		i++
+	}
+	for key, data := range want {
+		have, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, data) {
+			t.Fatalf("key %#x: wrong data", key)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(filepath.Join(path, manifestName)); err != nil {
+		t.Fatalf("manifest missing: %v", err)
+	}
+	// Reopen, the data gets compacted and should come out intact
+	have := make(map[string]bool)
+	db, err = Open(opts, SlotSizeLinear(50, 5), func(key uint64, data []byte) {
+		have[string(data)] = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(have) != len(want) {
+		t.Fatalf("have %d items, want %d", len(have), len(want))
+	}
+	for _, data := range want {
+		if !have[string(data)] {
+			t.Fatalf("missing item of size %d", len(data))
+		}
+	}
+	// Opening on a missing directory fails
+	if _, err := Open(Options{Path: "/memfs/other", FS: fsys}, SlotSizeLinear(50, 5), nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// failingFS is a memFS where writes fail with a given error, as long as the
+// failure budget lasts.
+type failingFS struct {
+	*memFS
+	mu       sync.Mutex
+	failures int   // Number of writes left to fail
+	err      error // Error to fail with
+	writes   int   // Number of write attempts
+	syncErr  error // Error to fail syncs with, if any
+	syncs    int   // Number of sync attempts
+}
+
+func (fsys *failingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{f, fsys}, nil
+}
+
+func (fsys *failingFS) fail(n int, err error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.failures, fsys.err, fsys.writes = n, err, 0
+}
+
+type failingFile struct {
+	File
+	fsys *failingFS
+}
+
+func (f *failingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fsys.mu.Lock()
+	f.fsys.writes++
+	if f.fsys.failures > 0 {
+		f.fsys.failures--
+		f.fsys.mu.Unlock()
+		return 0, &os.PathError{Op: "write", Err: f.fsys.err}
+	}
+	f.fsys.mu.Unlock()
+	return f.File.WriteAt(p, off)
+}
+
+func (f *failingFile) Sync() error {
+	f.fsys.mu.Lock()
+	f.fsys.syncs++
+	err := f.fsys.syncErr
+	f.fsys.mu.Unlock()
+	if err != nil {
+		return &os.PathError{Op: "sync", Err: err}
+	}
+	return f.File.Sync()
+}
+
+func TestWriteRetries(t *testing.T) {
+	path := "/memfs/billy"
+	fsys := &failingFS{memFS: newMemFS(path)}
+	db, err := Open(Options{Path: path, FS: fsys, WriteRetries: 3}, SlotSizeLinear(50, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Transient errors within the retry budget are overcome
+	fsys.fail(3, syscall.ENOSPC)
+	key, err := db.Put([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys.writes != 4 {
+		t.Fatalf("have %d write attempts, want 4", fsys.writes)
+	}
+	if data, err := db.Get(key); err != nil || string(data) != "hello" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "hello")
+	}
+	fsys.fail(2, syscall.EAGAIN)
+	if _, err := db.Append(key, []byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	// Exceeding the budget fails with the underlying error
+	fsys.fail(4, syscall.ENOSPC)
+	if _, err := db.Put([]byte("hello")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected %v, got %v", syscall.ENOSPC, err)
+	}
+	// Fatal errors are not retried at all
+	fsys.fail(1, syscall.EPERM)
+	if _, err := db.Put([]byte("hello")); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("expected %v, got %v", syscall.EPERM, err)
+	}
+	if fsys.writes != 1 {
+		t.Fatalf("have %d write attempts, want 1", fsys.writes)
+	}
+	// Nor is EIO, the data may be lost already
+	fsys.fail(1, syscall.EIO)
+	if _, err := db.Put([]byte("hello")); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected %v, got %v", syscall.EIO, err)
+	}
+	if fsys.writes != 1 {
+		t.Fatalf("have %d write attempts, want 1", fsys.writes)
+	}
+}
+
+func TestSyncNotRetried(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		path := "/memfs/billy"
+		fsys := &failingFS{memFS: newMemFS(path)}
+		// A single shelf, synced once by db.Sync
+		db, err := Open(Options{Path: path, FS: fsys, WriteRetries: 3, Journal: journal}, SlotSizeLinear(50, 1), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsys.mu.Lock()
+		fsys.syncErr, fsys.syncs = syscall.ENOSPC, 0
+		fsys.mu.Unlock()
+		if journal {
+			// The slot write syncs the journal first
+			if _, err := db.Put([]byte("hello")); !errors.Is(err, syscall.ENOSPC) {
+				t.Fatalf("journal: expected %v, got %v", syscall.ENOSPC, err)
+			}
+		} else if err := db.Sync(); !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("expected %v, got %v", syscall.ENOSPC, err)
+		}
+		if fsys.syncs != 1 {
+			t.Fatalf("journal=%v: have %d sync attempts, want 1", journal, fsys.syncs)
+		}
+		fsys.mu.Lock()
+		fsys.syncErr = nil
+		fsys.mu.Unlock()
+		db.Close()
+	}
+}
+
+// closeFailFS fails closing the shelf files with the given slot sizes.
+type closeFailFS struct {
+	*memFS
+	fail map[uint32]error
+}
+
+func (fsys *closeFailFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, size, ok := ParseShelfName(filepath.Base(name)); ok && fsys.fail[size] != nil {
+		return &closeFailFile{f, fsys.fail[size]}, nil
+	}
+	return f, nil
+}
+
+type closeFailFile struct {
+	File
+	err error
+}
+
+func (f *closeFailFile) Close() error {
+	f.File.Close()
+	return f.err
+}
+
+func TestCloseErrors(t *testing.T) {
+	var (
+		path = "/memfs/billy"
+		errA = errors.New("failure A")
+		errB = &os.PathError{Op: "close", Path: "b", Err: syscall.EIO}
+		fsys = &closeFailFS{memFS: newMemFS(path), fail: map[uint32]error{100: errA, 300: errB}}
+	)
+	db, err := Open(Options{Path: path, FS: fsys}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if !errors.Is(err, errA) || !errors.Is(err, syscall.EIO) {
+		t.Fatalf("have %v, want both failures", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "b" {
+		t.Fatalf("have %v, want a %T", err, pathErr)
+	}
+	for _, msg := range []string{"shelf 0: failure A", "shelf 2: close b"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error %q doesn't mention %q", err, msg)
+		}
+	}
+	// A single failure is returned as is.
+	fsys.fail = map[uint32]error{200: errA}
+	if db, err = Open(Options{Path: path, FS: fsys}, SlotSizeLinear(100, 4), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err == nil || err.Error() != "shelf 1: failure A" {
+		t.Fatalf("have %v", err)
+	}
+}
+
+// dirSyncFS counts the directory syncs.
+type dirSyncFS struct {
+	*memFS
+	syncs map[string]int
+}
+
+func (fsys *dirSyncFS) SyncDir(name string) error {
+	fsys.syncs[name]++
+	return nil
+}
+
+func TestSyncDir(t *testing.T) {
+	fsys := &dirSyncFS{newMemFS("db"), make(map[string]int)}
+	opts := Options{Path: "db", FS: fsys}
+	db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing the manifest syncs the directory
+	if fsys.syncs["db"] != 1 {
+		t.Fatalf("have %d directory syncs after open, want 1", fsys.syncs["db"])
+	}
+	// The shelf files have been created
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.syncs["db"] != 2 {
+		t.Fatalf("have %d directory syncs, want 2", fsys.syncs["db"])
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.syncs["db"] != 2 {
+		t.Fatalf("have %d directory syncs without changes, want 2", fsys.syncs["db"])
+	}
+	key, err := db.Put(make([]byte, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.syncs["db"] != 3 {
+		t.Fatalf("have %d directory syncs after extending a shelf, want 3", fsys.syncs["db"])
+	}
+	// Reusing a slot doesn't extend the file
+	if err := db.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fsys.syncs["db"] != 3 {
+		t.Fatalf("have %d directory syncs, want 3", fsys.syncs["db"])
+	}
+	// The OS filesystem syncs directories for real
+	p := t.TempDir()
+	if db, err = Open(Options{Path: p}, SlotSizeLinear(100, 3), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(make([]byte, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
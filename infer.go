@@ -0,0 +1,132 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"sort"
+)
+
+// maxInferCandidates caps the number of distinct slot sizes InferSlotSizes
+// chooses from. Samples with more distinct sizes are first bucketed by
+// quantile.
+const maxInferCandidates = 256
+
+// InferSlotSizes returns a SlotSizeFn with at most maxShelves shelves, chosen
+// to minimize the space wasted when storing data with the sizes in samples.
+// The slot sizes include the item header; like PayloadSizeFn, it only accounts
+// for the 4-byte header, so options which grow the header need a margin. The
+// largest slot fits the largest sample, and the sizes are strictly
+// increasing.
+//
+// The sizes are chosen among those occurring in the samples (or among their
+// quantiles, for samples with many distinct sizes), which makes the layout
+// optimal for the samples, given the shelf budget.
+func InferSlotSizes(samples []int, maxShelves int) SlotSizeFn {
+	if len(samples) == 0 || maxShelves <= 0 { // programming error
+		panic(fmt.Sprintf("Bad options, %d samples for %d shelves", len(samples), maxShelves))
+	}
+	sizes := inferSlotSizes(samples, maxShelves)
+	i := 0
+	return func() (uint32, bool) {
+		ret := sizes[i]
+		i++
+		return ret, i == len(sizes)
+	}
+}
+
+// inferSlotSizes implements InferSlotSizes, returning the slot sizes.
+func inferSlotSizes(samples []int, limit int) []uint32 {
+	if limit > maxShelves {
+		limit = maxShelves
+	}
+	sorted := make([]int, len(samples))
+	for i, size := range samples {
+		if uint64(size)+itemHeaderSize > maxSlotSize || size < 0 { // programming error
+			panic(fmt.Sprintf("Bad options, sample size %d", size))
+		}
+		if size < minSlotSize-itemHeaderSize {
+			size = minSlotSize - itemHeaderSize
+		}
+		sorted[i] = size
+	}
+	sort.Ints(sorted)
+	// Pick the candidate sizes, and group the samples by the smallest
+	// candidate which fits them.
+	var cands []int
+	for i, size := range sorted {
+		if i == len(sorted)-1 || sorted[i+1] != size {
+			cands = append(cands, size)
+		}
+	}
+	if len(cands) > maxInferCandidates {
+		quantiles := make([]int, 0, maxInferCandidates)
+		for i := 1; i <= maxInferCandidates; i++ {
+			size := sorted[i*len(sorted)/maxInferCandidates-1]
+			if len(quantiles) == 0 || quantiles[len(quantiles)-1] != size {
+				quantiles = append(quantiles, size)
+			}
+		}
+		cands = quantiles
+	}
+	// count[i] and sum[i] are the number and total size of the samples which
+	// fit in the first i candidates.
+	var (
+		k     = len(cands)
+		count = make([]float64, k+1)
+		sum   = make([]float64, k+1)
+		c     = 0
+	)
+	for _, size := range sorted {
+		for size > cands[c] {
+			c++
+		}
+		count[c+1]++
+		sum[c+1] += float64(size)
+	}
+	for i := 1; i <= k; i++ {
+		count[i] += count[i-1]
+		sum[i] += sum[i-1]
+	}
+	// waste returns the space wasted by the samples of candidates [i, j) in a
+	// shelf of size cands[j-1].
+	waste := func(i, j int) float64 {
+		n := count[j] - count[i]
+		return n*float64(cands[j-1]) - (sum[j] - sum[i])
+	}
+	shelves := limit
+	if shelves > k {
+		shelves = k
+	}
+	// best[j] is the least waste of the samples of the first j candidates,
+	// in the number of shelves of the current round, and from[s][j] the
+	// start of the last shelf of that layout.
+	var (
+		best = make([]float64, k+1)
+		next = make([]float64, k+1)
+		from = make([][]int, shelves+1)
+	)
+	for j := 1; j <= k; j++ {
+		best[j] = waste(0, j)
+	}
+	from[1] = make([]int, k+1)
+	for s := 2; s <= shelves; s++ {
+		from[s] = make([]int, k+1)
+		for j := s; j <= k; j++ {
+			for i := s - 1; i < j; i++ {
+				if w := best[i] + waste(i, j); i == s-1 || w < next[j] {
+					next[j], from[s][j] = w, i
+				}
+			}
+		}
+		best, next = next, best
+	}
+	out := make([]uint32, shelves)
+	for s, j := shelves, k; s > 0; s-- {
+		out[s-1] = uint32(cands[j-1]) + itemHeaderSize
+		j = from[s][j]
+	}
+	return out
+}
@@ -0,0 +1,110 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// collectSlotSizes returns the slot sizes yielded by the SlotSizeFn.
+func collectSlotSizes(fn SlotSizeFn) []uint32 {
+	var sizes []uint32
+	for done := false; !done; {
+		var size uint32
+		size, done = fn()
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
+
+// wastedSpace returns the space wasted when storing data of the sample sizes
+// in shelves with the given slot sizes.
+func wastedSpace(t *testing.T, sizes []uint32, samples []int) uint64 {
+	t.Helper()
+	var waste uint64
+	for _, size := range samples {
+		i := 0
+		for i < len(sizes) && int(sizes[i])-itemHeaderSize < size {
+			i++
+		}
+		if i == len(sizes) {
+			t.Fatalf("size %d does not fit in %v", size, sizes)
+		}
+		waste += uint64(int(sizes[i]) - itemHeaderSize - size)
+	}
+	return waste
+}
+
+func TestInferSlotSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	gen := func(n int, fn func() int) []int {
+		samples := make([]int, n)
+		for i := range samples {
+			samples[i] = fn()
+		}
+		return samples
+	}
+	for _, tt := range []struct {
+		name    string
+		samples []int
+	}{
+		{"uniform", gen(10000, func() int { return 16 * (1 + rng.Intn(255)) })},
+		{"bimodal", gen(10000, func() int {
+			if rng.Intn(4) == 0 {
+				return 3000 + rng.Intn(1000)
+			}
+			return 100 + rng.Intn(100)
+		})},
+		{"exponential", gen(10000, func() int { return 1 + int(rng.ExpFloat64()*300)%4000 })},
+	} {
+		// The built-in helpers, sized to fit the largest sample.
+		for _, helper := range []struct {
+			name  string
+			sizes []uint32
+		}{
+			{"power-of-two", collectSlotSizes(SlotSizePowerOfTwo(64, 4096+itemHeaderSize))},
+			{"linear", collectSlotSizes(SlotSizeLinear(256+itemHeaderSize, 17))},
+		} {
+			inferred := collectSlotSizes(InferSlotSizes(tt.samples, len(helper.sizes)))
+			if len(inferred) > len(helper.sizes) {
+				t.Fatalf("%v: have %d shelves, budget %d", tt.name, len(inferred), len(helper.sizes))
+			}
+			for i := 1; i < len(inferred); i++ {
+				if inferred[i] <= inferred[i-1] {
+					t.Fatalf("%v: slot sizes not increasing: %v", tt.name, inferred)
+				}
+			}
+			have := wastedSpace(t, inferred, tt.samples)
+			want := wastedSpace(t, helper.sizes, tt.samples)
+			if have > want {
+				t.Errorf("%v: inferred layout wastes %d bytes, %v wastes %d", tt.name, have, helper.name, want)
+			}
+		}
+	}
+}
+
+func TestInferSlotSizesSmall(t *testing.T) {
+	// A budget exceeding the number of distinct sizes wastes nothing.
+	sizes := collectSlotSizes(InferSlotSizes([]int{10, 20, 20, 0, 30}, 10))
+	want := []uint32{minSlotSize, 14, 24, 34}
+	if len(sizes) != len(want) {
+		t.Fatalf("have %v, want %v", sizes, want)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("have %v, want %v", sizes, want)
+		}
+	}
+	// The layout can be used to open a database.
+	db, err := Open(Options{Path: t.TempDir()}, InferSlotSizes([]int{10, 20, 20, 0, 30}, 2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if min, max := db.Limits(); min != 14 || max != 34 {
+		t.Fatalf("have limits %d, %d, want 14, 34", min, max)
+	}
+}
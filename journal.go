@@ -0,0 +1,114 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// journalHeaderSize is the size of the header of a journal entry, which is
+// stored as
+// [ uint64: slot | uint32: crc | <slot content> ]
+// The crc covers the slot number and the slot content.
+const journalHeaderSize = 12
+
+// journal is a single-entry write-ahead journal for a shelf. Before a slot is
+// overwritten, its new content is written to the journal and synced, so that
+// if the slot write is torn by a crash, it can be redone from the journal when
+// the shelf is opened again. Once the slot write has been synced, the journal
+// is emptied.
+type journal struct {
+	mu sync.Mutex // Serializes the journaled writes of the shelf
+	f  File
+}
+
+// openJournal opens the journal file with the given name, and replays any
+// entry left in it onto the shelf file.
+func openJournal(fsys FS, name string, shelf File, slotSize uint32) (*journal, error) {
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{f: f}
+	if err := j.replay(shelf, slotSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay writes the entry in the journal, if it is complete, to the shelf file,
+// and empties the journal. A torn entry means that the slot write it protected
+// never started, so it's dropped.
+func (j *journal) replay(shelf File, slotSize uint32) error {
+	stat, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		return nil
+	}
+	entry := make([]byte, journalHeaderSize+int(slotSize))
+	if stat.Size() == int64(len(entry)) {
+		if _, err := j.f.ReadAt(entry, 0); err != nil && err != io.EOF {
+			return err
+		}
+		slot := binary.BigEndian.Uint64(entry)
+		if binary.BigEndian.Uint32(entry[8:]) == journalChecksum(entry) {
+			if _, err := shelf.WriteAt(entry[journalHeaderSize:], int64(slot)*int64(slotSize)); err != nil {
+				return err
+			}
+			if err := shelf.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return j.f.Truncate(0)
+}
+
+// journalChecksum computes the checksum of a journal entry.
+func journalChecksum(entry []byte) uint32 {
+	crc := crc32.ChecksumIEEE(entry[:8])
+	return crc32.Update(crc, crc32.IEEETable, entry[journalHeaderSize:])
+}
+
+// write journals the new content of the given slot, and then calls apply to
+// write it in place.
+func (j *journal) write(slot uint64, buf []byte, retries int, apply func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := make([]byte, journalHeaderSize+len(buf))
+	binary.BigEndian.PutUint64(entry, slot)
+	copy(entry[journalHeaderSize:], buf)
+	binary.BigEndian.PutUint32(entry[8:], journalChecksum(entry))
+	if err := withRetry(retries, func() error {
+		_, err := j.f.WriteAt(entry, 0)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	return j.f.Truncate(0)
+}
+
+// Close syncs and closes the journal file.
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.f.Sync()
+	if e := j.f.Close(); e != nil {
+		err = e
+	}
+	return err
+}
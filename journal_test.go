@@ -0,0 +1,92 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tearFS is a memFS which, when armed, tears the next write to a shelf file:
+// only half the data is written, simulating a crash in the middle of it.
+type tearFS struct {
+	*memFS
+	armed int32
+}
+
+func (fsys *tearFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fsys.memFS.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, ".bag") {
+		return f, err
+	}
+	return &tearFile{f, fsys}, nil
+}
+
+type tearFile struct {
+	File
+	fsys *tearFS
+}
+
+var errCrash = errors.New("simulated crash")
+
+func (f *tearFile) WriteAt(p []byte, off int64) (int, error) {
+	if atomic.CompareAndSwapInt32(&f.fsys.armed, 1, 0) {
+		n, _ := f.File.WriteAt(p[:len(p)/2], off)
+		return n, errCrash
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestJournal(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		var (
+			path = "/memfs/billy"
+			fsys = &tearFS{memFS: newMemFS(path)}
+			opts = Options{Path: path, FS: fsys, Journal: journal}
+		)
+		db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := db.Put(fill(1, 90))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Overwrite the item in place, and crash half-way through
+		atomic.StoreInt32(&fsys.armed, 1)
+		if _, err := db.Append(key, fill(2, 5)); !errors.Is(err, errCrash) {
+			t.Fatalf("journal=%v: expected %v, got %v", journal, errCrash, err)
+		}
+		// Reopen without closing, as after a crash
+		db, err = Open(opts, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(fill(1, 90), fill(2, 5)...)
+		have, err := db.Get(key)
+		if journal {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(have, want) {
+				t.Fatalf("slot not repaired:\nhave %x\nwant %x", have, want)
+			}
+		} else if err == nil && bytes.Equal(have, want) {
+			t.Fatal("torn write not torn")
+		}
+		if journal {
+			// The journal has been emptied by the replay
+			if info, err := fsys.Stat(filepath.Join(path, "bkt_00000100.journal")); err != nil || info.Size() != 0 {
+				t.Fatalf("journal not emptied: %v", err)
+			}
+		}
+		db.Close()
+	}
+}
@@ -0,0 +1,178 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// keyedHeaderSize is the size of the header KeyedDB prepends to each value,
+// which is stored as
+// [ uint64: generation | uint16: name length | <name> | <data> ]
+const keyedHeaderSize = 10
+
+// maxKeyedNameLen is the longest name a KeyedDB can store.
+const maxKeyedNameLen = 0xffff
+
+// KeyedDB stores data under string names, on top of a plain Database.
+//
+// The name is stored along with the data, in the same item, and the mapping
+// from names to keys is kept in memory, rebuilt by iterating the database
+// when the KeyedDB is created. Storing the name in-band means that the
+// mapping stays valid when items are moved by the compaction on Open, and that
+// a write is a single Put.
+//
+// The overhead per item is 10 bytes plus the name on disk, and a map entry
+// holding the name and two uint64s in memory. The item size, and thus the
+// shelf it lands in, includes the name.
+//
+// Every item carries a generation number, so that if a crash during an
+// overwrite leaves two items with the same name, the newest one wins, and the
+// stale one is deleted, when the KeyedDB is created.
+type KeyedDB struct {
+	db Database
+
+	mu    sync.RWMutex
+	names map[string]keyedEntry
+	gen   uint64 // Highest generation number in use
+}
+
+// keyedEntry is the in-memory index entry of a name.
+type keyedEntry struct {
+	key uint64
+	gen uint64
+}
+
+// NewKeyedDB creates a KeyedDB on top of the given database, which must only
+// contain items written by a KeyedDB. The KeyedDB takes ownership of the
+// database, which is closed by Close.
+func NewKeyedDB(db Database) (*KeyedDB, error) {
+	kdb := &KeyedDB{
+		db:    db,
+		names: make(map[string]keyedEntry),
+	}
+	var (
+		stale []uint64
+		err   error
+	)
+	db.Iterate(func(key uint64, data []byte) {
+		if err != nil {
+			return
+		}
+		var name []byte
+		if name, _, err = splitKeyed(key, data); err != nil {
+			return
+		}
+		entry := keyedEntry{key: key, gen: binary.BigEndian.Uint64(data)}
+		if entry.gen > kdb.gen {
+			kdb.gen = entry.gen
+		}
+		if prev, ok := kdb.names[string(name)]; ok {
+			if prev.gen > entry.gen {
+				prev, entry = entry, prev
+			}
+			stale = append(stale, prev.key)
+		}
+		kdb.names[string(name)] = entry
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range stale {
+		if err := db.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+	return kdb, nil
+}
+
+// splitKeyed splits an item written by a KeyedDB into the name and the data.
+func splitKeyed(key uint64, item []byte) (name, data []byte, err error) {
+	if len(item) < keyedHeaderSize {
+		return nil, nil, fmt.Errorf("%w: keyed item %#x of %d bytes", ErrCorruptData, key, len(item))
+	}
+	nameLen := int(binary.BigEndian.Uint16(item[8:]))
+	if len(item) < keyedHeaderSize+nameLen {
+		return nil, nil, fmt.Errorf("%w: keyed item %#x of %d bytes, name of %d", ErrCorruptData, key, len(item), nameLen)
+	}
+	return item[keyedHeaderSize : keyedHeaderSize+nameLen], item[keyedHeaderSize+nameLen:], nil
+}
+
+// PutKeyed stores the data under the given name, replacing any data
+// previously stored under it.
+func (kdb *KeyedDB) PutKeyed(name string, data []byte) error {
+	if len(name) > maxKeyedNameLen {
+		return fmt.Errorf("%w: name of %d bytes", ErrValueTooLarge, len(name))
+	}
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+	item := make([]byte, keyedHeaderSize+len(name)+len(data))
+	binary.BigEndian.PutUint64(item, kdb.gen+1)
+	binary.BigEndian.PutUint16(item[8:], uint16(len(name)))
+	copy(item[keyedHeaderSize:], name)
+	copy(item[keyedHeaderSize+len(name):], data)
+	key, err := kdb.db.Put(item)
+	if err != nil {
+		return err
+	}
+	kdb.gen++
+	prev, exists := kdb.names[name]
+	kdb.names[name] = keyedEntry{key: key, gen: kdb.gen}
+	if exists {
+		return kdb.db.Delete(prev.key)
+	}
+	return nil
+}
+
+// GetKeyed retrieves the data stored under the given name, or returns
+// ErrKeyNotFound.
+func (kdb *KeyedDB) GetKeyed(name string) ([]byte, error) {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+	entry, ok := kdb.names[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrKeyNotFound, name)
+	}
+	item, err := kdb.db.Get(entry.key)
+	if err != nil {
+		return nil, err
+	}
+	have, data, err := splitKeyed(entry.key, item)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(have, []byte(name)) {
+		return nil, fmt.Errorf("%w: item %#x has name %q, want %q", ErrCorruptData, entry.key, have, name)
+	}
+	return data, nil
+}
+
+// DeleteKeyed deletes the data stored under the given name. Deleting a name
+// which is not stored is a no-op.
+func (kdb *KeyedDB) DeleteKeyed(name string) error {
+	kdb.mu.Lock()
+	defer kdb.mu.Unlock()
+	entry, ok := kdb.names[name]
+	if !ok {
+		return nil
+	}
+	delete(kdb.names, name)
+	return kdb.db.Delete(entry.key)
+}
+
+// Len returns the number of names stored.
+func (kdb *KeyedDB) Len() int {
+	kdb.mu.RLock()
+	defer kdb.mu.RUnlock()
+	return len(kdb.names)
+}
+
+// Close closes the underlying database.
+func (kdb *KeyedDB) Close() error {
+	return kdb.db.Close()
+}
@@ -0,0 +1,126 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func openKeyed(t *testing.T, path string) *KeyedDB {
+	t.Helper()
+	db, err := Open(Options{Path: path}, SlotSizeLinear(64, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kdb, err := NewKeyedDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kdb
+}
+
+func TestKeyedDB(t *testing.T) {
+	p := t.TempDir()
+	kdb := openKeyed(t, p)
+	want := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("item-%d", i)
+		want[name] = fill(byte(i), 10+i*10)
+		if err := kdb.PutKeyed(name, want[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Overwrite, with data that goes into another shelf
+	want["item-3"] = fill(0xff, 300)
+	if err := kdb.PutKeyed("item-3", want["item-3"]); err != nil {
+		t.Fatal(err)
+	}
+	// Delete, including a name which isn't there
+	for _, name := range []string{"item-0", "item-5", "item-10", "nonexistent"} {
+		if err := kdb.DeleteKeyed(name); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, name)
+	}
+	check := func(kdb *KeyedDB) {
+		t.Helper()
+		if have := kdb.Len(); have != len(want) {
+			t.Fatalf("have %d names, want %d", have, len(want))
+		}
+		for name, data := range want {
+			have, err := kdb.GetKeyed(name)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(have, data) {
+				t.Fatalf("%s: wrong data", name)
+			}
+		}
+		if _, err := kdb.GetKeyed("item-5"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected %v, got %v", ErrKeyNotFound, err)
+		}
+	}
+	check(kdb)
+	if err := kdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening compacts the database, which moves items around
+	kdb = openKeyed(t, p)
+	defer kdb.Close()
+	check(kdb)
+	// Generations continue after reopen
+	want["item-1"] = []byte("new")
+	if err := kdb.PutKeyed("item-1", want["item-1"]); err != nil {
+		t.Fatal(err)
+	}
+	check(kdb)
+}
+
+func TestKeyedDBStale(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(64, 10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an interrupted overwrite, which left two items for one name
+	item := func(gen uint64, name, data string) []byte {
+		buf := make([]byte, keyedHeaderSize, keyedHeaderSize+len(name)+len(data))
+		binary.BigEndian.PutUint64(buf, gen)
+		binary.BigEndian.PutUint16(buf[8:], uint16(len(name)))
+		return append(append(buf, name...), data...)
+	}
+	for _, it := range [][]byte{item(5, "a", "new"), item(3, "a", "old"), item(4, "b", "b")} {
+		if _, err := db.Put(it); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kdb, err := NewKeyedDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kdb.Close()
+	if kdb.Len() != 2 {
+		t.Fatalf("have %d names, want 2", kdb.Len())
+	}
+	if data, err := kdb.GetKeyed("a"); err != nil || string(data) != "new" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "new")
+	}
+	var items int
+	db.Iterate(func(uint64, []byte) { items++ })
+	if items != 2 {
+		t.Fatalf("stale item not deleted, have %d items", items)
+	}
+	// Corrupt items are reported
+	if _, err := db.Put([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewKeyedDB(db); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrCorruptData, err)
+	}
+}
@@ -0,0 +1,279 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+)
+
+// manifestName is the name of the file, within the database directory, which
+// records the settings that affect how the shelf files are to be interpreted.
+const manifestName = "billy.manifest"
+
+// manifestBackupSuffix is appended to manifestName for the previous version of
+// the manifest, which is read if the manifest itself is missing or corrupt,
+// e.g. after a crash while it was rewritten.
+const manifestBackupSuffix = ".bak"
+
+// manifestVersion is the current version of the manifest format. Version 2
+// adds TailLength and FixedValueSize; manifests without them are still written
+// as version 1, so that older versions of billy can open those databases.
+const manifestVersion = 2
+
+// manifest contains the database-wide settings which must stay the same
+// across restarts, since they determine the on-disk layout.
+type manifest struct {
+	Version        int    `json:"version"`
+	CompactHeader  bool   `json:"compactHeader,omitempty"`
+	Sequence       bool   `json:"sequence,omitempty"`
+	Checksum       bool   `json:"checksum,omitempty"`
+	Compression    bool   `json:"compression,omitempty"`
+	Timestamps     bool   `json:"timestamps,omitempty"`
+	TailLength     bool   `json:"tailLength,omitempty"`
+	FixedValueSize uint32 `json:"fixedValueSize,omitempty"`
+	ShelfBits      int    `json:"shelfBits,omitempty"` // 0 for the default
+
+	// SlotSizes are the effective slot sizes of the shelves, as of the last
+	// time the database was opened for writing. Shelves may be added or
+	// dropped at the end, but the sizes of the others must stay the same.
+	SlotSizes []uint32 `json:"slotSizes,omitempty"`
+
+	// ShelfCodecs are the codecs assigned to the shelves by
+	// Options.ShelfCodecFn, if it has ever been used.
+	ShelfCodecs []Codec `json:"shelfCodecs,omitempty"`
+
+	// CRC is the checksum of the manifest, encoded without it. It's 0 in
+	// manifests written before it was added, which are not verified.
+	CRC uint32 `json:"crc,omitempty"`
+}
+
+// newManifest creates a manifest from the given options.
+func newManifest(opts Options) *manifest {
+	version := 1
+	if opts.TailLength || opts.FixedValueSize != 0 {
+		version = manifestVersion
+	}
+	return &manifest{
+		Version:        version,
+		CompactHeader:  opts.CompactHeader,
+		Sequence:       opts.Sequence,
+		Checksum:       opts.Checksum,
+		Compression:    opts.Compression,
+		Timestamps:     opts.Timestamps,
+		TailLength:     opts.TailLength,
+		FixedValueSize: opts.FixedValueSize,
+		ShelfBits:      opts.ShelfBits,
+	}
+}
+
+// check verifies that the given options are compatible with the manifest.
+func (m *manifest) check(opts Options) error {
+	if m.CompactHeader != opts.CompactHeader {
+		return fmt.Errorf("%w: compact header %v, database has %v", ErrLayoutMismatch, opts.CompactHeader, m.CompactHeader)
+	}
+	if m.Sequence != opts.Sequence {
+		return fmt.Errorf("%w: sequence %v, database has %v", ErrLayoutMismatch, opts.Sequence, m.Sequence)
+	}
+	if m.Checksum != opts.Checksum {
+		return fmt.Errorf("%w: checksum %v, database has %v", ErrLayoutMismatch, opts.Checksum, m.Checksum)
+	}
+	if m.Compression != opts.Compression {
+		return fmt.Errorf("%w: compression %v, database has %v", ErrLayoutMismatch, opts.Compression, m.Compression)
+	}
+	if m.Timestamps != opts.Timestamps {
+		return fmt.Errorf("%w: timestamps %v, database has %v", ErrLayoutMismatch, opts.Timestamps, m.Timestamps)
+	}
+	if m.TailLength != opts.TailLength {
+		return fmt.Errorf("%w: tail length %v, database has %v", ErrLayoutMismatch, opts.TailLength, m.TailLength)
+	}
+	if m.FixedValueSize != opts.FixedValueSize {
+		return fmt.Errorf("%w: fixed value size %d, database has %d", ErrLayoutMismatch, opts.FixedValueSize, m.FixedValueSize)
+	}
+	if have := (Options{ShelfBits: m.ShelfBits}).shelfBits(); have != opts.shelfBits() {
+		return fmt.Errorf("%w: shelf bits %d, database has %d", ErrLayoutMismatch, opts.shelfBits(), have)
+	}
+	return nil
+}
+
+// checkSlotSizes verifies that the given slot sizes only add or drop shelves at
+// the end of the layout recorded in the manifest, if any.
+func (m *manifest) checkSlotSizes(sizes []uint32) error {
+	for i, size := range m.SlotSizes {
+		if i == len(sizes) {
+			break
+		}
+		if sizes[i] != size {
+			return fmt.Errorf("%w: shelf %d has slot size %d, database has %d", ErrLayoutMismatch, i, sizes[i], size)
+		}
+	}
+	return nil
+}
+
+// shelfCodecs returns the codec Put uses for each of the shelves with the given
+// slot sizes: the one recorded in the manifest, or for shelves not recorded
+// yet, the one assigned by opts.ShelfCodecFn. It returns nil if codecs have
+// never been assigned per shelf, in which case all shelves use the default
+// codec.
+func (m *manifest) shelfCodecs(sizes []uint32, opts Options) ([]Codec, error) {
+	if opts.ShelfCodecFn == nil && len(m.ShelfCodecs) == 0 {
+		return nil, nil
+	}
+	codecs := make([]Codec, len(sizes))
+	for i, size := range sizes {
+		codec := opts.DefaultCodec
+		if opts.ShelfCodecFn != nil {
+			codec = opts.ShelfCodecFn(i, size)
+		}
+		if i < len(m.ShelfCodecs) {
+			if opts.ShelfCodecFn != nil && codec != m.ShelfCodecs[i] {
+				return nil, fmt.Errorf("%w: shelf %d has codec %v, database has %v", ErrLayoutMismatch, i, codec, m.ShelfCodecs[i])
+			}
+			codec = m.ShelfCodecs[i]
+		}
+		if _, err := codec.compressor(); err != nil {
+			return nil, fmt.Errorf("shelf %d: %w", i, err)
+		}
+		codecs[i] = codec
+	}
+	return codecs, nil
+}
+
+// hasShelfCodecs reports whether the manifest records the given shelf codecs.
+func (m *manifest) hasShelfCodecs(codecs []Codec) bool {
+	if len(m.ShelfCodecs) != len(codecs) {
+		return false
+	}
+	for i, codec := range codecs {
+		if m.ShelfCodecs[i] != codec {
+			return false
+		}
+	}
+	return true
+}
+
+// hasSlotSizes reports whether the manifest records the given slot sizes.
+func (m *manifest) hasSlotSizes(sizes []uint32) bool {
+	if len(m.SlotSizes) != len(sizes) {
+		return false
+	}
+	for i, size := range sizes {
+		if m.SlotSizes[i] != size {
+			return false
+		}
+	}
+	return true
+}
+
+// checksum returns the CRC of the manifest, which must have none set.
+func (m *manifest) checksum() (uint32, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+// readManifest reads the manifest of the dataset from the given directory, or
+// if it's missing or corrupt, the backup of the previous version. If neither
+// exists, it returns nil, without error.
+func readManifest(fsys FS, path, dataset string) (*manifest, error) {
+	name := filepath.Join(path, datasetFile(dataset, manifestName))
+	m, err := readManifestFile(fsys, name)
+	if err == nil || !(errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrCorruptData)) {
+		return m, err
+	}
+	bak, bakErr := readManifestFile(fsys, name+manifestBackupSuffix)
+	switch {
+	case bakErr == nil:
+		return bak, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	case errors.Is(bakErr, os.ErrNotExist):
+		return nil, nil
+	default:
+		return nil, bakErr
+	}
+}
+
+// readLayoutManifest is like readManifest, but if there is no manifest while
+// the directory holds shelf files of the dataset, the files are assumed to
+// have been written before manifests were introduced, or the manifest was
+// lost, and the legacy layout is returned: the plain item header, without any
+// of the layout options.
+func readLayoutManifest(fsys FS, path, dataset string) (*manifest, error) {
+	m, err := readManifest(fsys, path, dataset)
+	if m != nil || err != nil {
+		return m, err
+	}
+	names, err := findShelfFiles(fsys, path, dataset)
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	return &manifest{Version: 1}, nil
+}
+
+// readManifestFile reads and verifies the named manifest file.
+func readManifestFile(fsys FS, name string) (*manifest, error) {
+	data, err := readFileFS(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	m := new(manifest)
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %v", ErrCorruptData, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("%w: manifest version %d not supported", ErrLayoutMismatch, m.Version)
+	}
+	if want := m.CRC; want != 0 {
+		m.CRC = 0
+		have, err := m.checksum()
+		if err != nil {
+			return nil, err
+		}
+		if have != want {
+			return nil, fmt.Errorf("%w: manifest checksum %#x, want %#x", ErrCorruptData, have, want)
+		}
+	}
+	return m, nil
+}
+
+// writeManifest writes the manifest of the dataset into the given directory.
+// It's written to a temporary file first, synced, which then replaces the
+// manifest, whose previous version is kept as backup. The directory is synced
+// after the renames, on file systems which need it, see DirSyncer.
+func writeManifest(fsys FS, path, dataset string, m *manifest) error {
+	c := *m
+	c.CRC = 0
+	crc, err := c.checksum()
+	if err != nil {
+		return err
+	}
+	c.CRC = crc
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(path, datasetFile(dataset, manifestName))
+	// writeFileFS syncs the file before closing it
+	if err := writeFileFS(fsys, name+".tmp", data); err != nil {
+		return err
+	}
+	if err := fsys.Rename(name, name+manifestBackupSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := fsys.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	if syncer, ok := fsys.(DirSyncer); ok {
+		return syncer.SyncDir(path)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestMismatch(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p, CompactHeader: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(p, manifestName)); err != nil {
+		t.Fatalf("manifest missing: %v", err)
+	}
+	_, err = Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	db, err = Open(Options{Path: p, CompactHeader: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestExtendLayout(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, _ := db.Put(fill(1, 50))
+	k2, _ := db.Put(fill(2, 150))
+	db.Close()
+	// Appending shelves is allowed, and the existing items stay in place.
+	db, err = Open(Options{Path: p}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k3, err := db.Put(fill(3, 350))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shelf := k3 >> slotBits; shelf != 3 {
+		t.Fatalf("have shelf %d, want 3", shelf)
+	}
+	for key, want := range map[uint64][]byte{k1: fill(1, 50), k2: fill(2, 150), k3: fill(3, 350)} {
+		if have, err := db.Get(key); err != nil || !bytes.Equal(have, want) {
+			t.Fatalf("key %#x: have %x (err %v), want %x", key, have, err, want)
+		}
+	}
+	db.Close()
+	if m, err := readManifest(osFS{}, p, ""); err != nil || !m.hasSlotSizes([]uint32{100, 200, 300, 400}) {
+		t.Fatalf("manifest has slot sizes %v (err %v)", m.SlotSizes, err)
+	}
+	// Changing an existing shelf is not.
+	sizes := []uint32{100, 250, 300, 400}
+	i := 0
+	_, err = Open(Options{Path: p}, func() (uint32, bool) {
+		i++
+		return sizes[i-1], i == len(sizes)
+	}, nil)
+	if !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	if _, err := Open(Options{Path: p}, SlotSizeLinear(110, 5), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+}
+
+func TestShelfBits(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p, ShelfBits: 10}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put(fill(1, 50))
+	key, err := db.Put(fill(2, 150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(1) << 30; key != want {
+		t.Fatalf("have key %#x, want %#x", key, want)
+	}
+	if shelf, slot := db.ParseKey(key); shelf != 1 || slot != 0 {
+		t.Fatalf("have shelf %d slot %d, want 1, 0", shelf, slot)
+	}
+	if have := db.MakeKey(1, 0); have != key {
+		t.Fatalf("have key %#x, want %#x", have, key)
+	}
+	db.Close()
+	// The split can't be changed.
+	for _, bits := range []int{0, 12} {
+		if _, err := Open(Options{Path: p, ShelfBits: bits}, SlotSizeLinear(100, 4), nil); !errors.Is(err, ErrLayoutMismatch) {
+			t.Fatalf("shelf bits %d: expected %v, got %v", bits, ErrLayoutMismatch, err)
+		}
+	}
+	db, err = Open(Options{Path: p, ShelfBits: 10}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(2, 150)) {
+		t.Fatalf("have %x (err %v)", data, err)
+	}
+	db.Close()
+	// The number of shelves is limited by the split.
+	if _, err := Open(Options{Path: t.TempDir(), ShelfBits: 1}, SlotSizeLinear(100, 4), nil); !errors.Is(err, ErrTooManyShelves) {
+		t.Fatalf("expected %v, got %v", ErrTooManyShelves, err)
+	}
+	if _, err := Open(Options{Path: t.TempDir(), ShelfBits: maxShelfBits + 1}, SlotSizeLinear(100, 4), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
+
+func TestManifestBackup(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Extending the layout rewrites the manifest, keeping the previous one.
+	db, err = Open(Options{Path: p}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	name := filepath.Join(p, manifestName)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A modified manifest fails the checksum, and the backup is read instead.
+	if err := os.WriteFile(name, bytes.Replace(data, []byte("[100,"), []byte("[101,"), 1), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readManifest(osFS{}, p, ""); err != nil || !m.hasSlotSizes([]uint32{100, 200}) {
+		t.Fatalf("manifest has slot sizes %v (err %v)", m.SlotSizes, err)
+	}
+	// So is a truncated one, which is rewritten on open.
+	if err := os.WriteFile(name, data[:len(data)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(Options{Path: p}, SlotSizeLinear(100, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if m, err := readManifest(osFS{}, p, ""); err != nil || !m.hasSlotSizes([]uint32{100, 200, 300, 400}) {
+		t.Fatalf("manifest has slot sizes %v (err %v)", m.SlotSizes, err)
+	}
+	// Without a backup, the corruption is reported.
+	if err := os.Remove(name + manifestBackupSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, data[:len(data)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readManifest(osFS{}, p, ""); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrCorruptData, err)
+	}
+}
+
+func TestLegacyLayout(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Put(fill(1, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	// Without a manifest, the shelf files have the legacy layout.
+	for _, name := range []string{manifestName, manifestName + manifestBackupSuffix} {
+		if err := os.Remove(filepath.Join(p, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Open(Options{Path: p, CompactHeader: true}, SlotSizeLinear(100, 3), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	if _, err := os.Stat(filepath.Join(p, manifestName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("manifest written for mismatching layout: %v", err)
+	}
+	db, err = Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if data, err := db.Get(key); err != nil || !bytes.Equal(data, fill(1, 50)) {
+		t.Fatalf("wrong data (err %v)", err)
+	}
+}
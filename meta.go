@@ -0,0 +1,51 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// metaName is the name of the file, within the database directory, which holds
+// the metadata blob set by SetMeta.
+const metaName = "billy.meta"
+
+// MaxMetaSize is the largest metadata blob SetMeta accepts.
+const MaxMetaSize = 64 * 1024
+
+// SetMeta stores a small blob of application metadata, such as a schema
+// version, in a file next to the shelves, replacing any previous blob. The
+// blob may be at most MaxMetaSize bytes.
+func (db *database) SetMeta(blob []byte) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if db.readonly {
+		return ErrReadOnly
+	}
+	if len(blob) > MaxMetaSize {
+		return fmt.Errorf("%w: metadata of %d bytes, limit is %d", ErrValueTooLarge, len(blob), MaxMetaSize)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return writeFileFS(db.fs, filepath.Join(db.path, datasetFile(db.opts.Name, metaName)), blob)
+}
+
+// GetMeta returns the blob stored by SetMeta, or nil if none has been set.
+func (db *database) GetMeta() ([]byte, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	blob, err := readFileFS(db.fs, filepath.Join(db.path, datasetFile(db.opts.Name, metaName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return blob, err
+}
@@ -0,0 +1,192 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// metricsName is the name of the file, within the database directory, which
+// holds the counters of Metrics, with Options.PersistMetrics.
+const metricsName = "billy.metrics"
+
+// Metrics holds statistics about a database, see Database.Metrics.
+type Metrics struct {
+	Shelves []ShelfMetrics // One per shelf, in order of slot size
+
+	// The counters cover the database since it was opened, or with
+	// Options.PersistMetrics, since it was created. Puts counts the items
+	// stored by Put, PutEx and PutCompressed, Gets the items returned by Get
+	// and the methods built on it, such as GetTimeout. The byte counts are
+	// the sizes of those items, before compression.
+	Puts         uint64
+	Gets         uint64
+	BytesWritten uint64
+	BytesRead    uint64
+}
+
+// ShelfMetrics holds statistics about a shelf. The size statistics are only
+// collected with Options.TrackSizeHistogram, and cover the items written since
+// the database was opened, by Put, PutAt, Update and the like. The sizes are as
+// stored, that is, after compression.
+type ShelfMetrics struct {
+	SlotSize uint32
+	Writes   uint64  // Number of items written
+	AvgSize  float64 // Average size of the items written, 0 if none
+	P99Size  uint32  // Approximate 99th percentile of the sizes, 0 if none
+}
+
+// sizeHistogramBuckets is the number of size buckets of a sizeHistogram.
+const sizeHistogramBuckets = 64
+
+// sizeHistogram counts the sizes of the items written to a shelf, in buckets
+// of equal width spanning the capacity of the slots. It's updated with atomic
+// operations only, so reading it while items are written may see counts not
+// quite in sync with each other.
+type sizeHistogram struct {
+	// The counters are kept first, for the alignment 64-bit atomic
+	// operations need on 32-bit platforms.
+	count   uint64
+	sum     uint64
+	buckets [sizeHistogramBuckets]uint64
+	width   uint32 // Range of sizes of each bucket
+	max     uint32 // Largest size which can be added
+}
+
+func newSizeHistogram(capacity uint32) *sizeHistogram {
+	return &sizeHistogram{
+		width: capacity/sizeHistogramBuckets + 1,
+		max:   capacity,
+	}
+}
+
+// add counts an item of the given size.
+func (h *sizeHistogram) add(size uint32) {
+	atomic.AddUint64(&h.buckets[size/h.width], 1)
+	atomic.AddUint64(&h.sum, uint64(size))
+	atomic.AddUint64(&h.count, 1)
+}
+
+// metrics fills in the size statistics of m.
+func (h *sizeHistogram) metrics(m *ShelfMetrics) {
+	m.Writes = atomic.LoadUint64(&h.count)
+	if m.Writes == 0 {
+		return
+	}
+	m.AvgSize = float64(atomic.LoadUint64(&h.sum)) / float64(m.Writes)
+	m.P99Size = h.percentile(m.Writes, 0.99)
+}
+
+// percentile returns the upper end of the bucket holding the given fraction of
+// the count sizes added.
+func (h *sizeHistogram) percentile(count uint64, p float64) uint32 {
+	var (
+		want = uint64(float64(count)*p + 0.5)
+		have uint64
+	)
+	for i := range h.buckets {
+		if have += atomic.LoadUint64(&h.buckets[i]); have >= want {
+			if top := uint32(i+1)*h.width - 1; top < h.max {
+				return top
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// counters are the database-wide counters of Metrics, updated with atomic
+// operations.
+type counters struct {
+	Puts         uint64 `json:"puts"`
+	Gets         uint64 `json:"gets"`
+	BytesWritten uint64 `json:"bytesWritten"`
+	BytesRead    uint64 `json:"bytesRead"`
+}
+
+// put counts an item stored.
+func (c *counters) put(size int) {
+	atomic.AddUint64(&c.Puts, 1)
+	atomic.AddUint64(&c.BytesWritten, uint64(size))
+}
+
+// get counts an item returned.
+func (c *counters) get(size int) {
+	atomic.AddUint64(&c.Gets, 1)
+	atomic.AddUint64(&c.BytesRead, uint64(size))
+}
+
+// load returns a copy of the counters.
+func (c *counters) load() counters {
+	return counters{
+		Puts:         atomic.LoadUint64(&c.Puts),
+		Gets:         atomic.LoadUint64(&c.Gets),
+		BytesWritten: atomic.LoadUint64(&c.BytesWritten),
+		BytesRead:    atomic.LoadUint64(&c.BytesRead),
+	}
+}
+
+// loadMetrics resumes the counters from the metrics file, if it exists.
+func (db *database) loadMetrics() error {
+	data, err := readFileFS(db.fs, filepath.Join(db.path, datasetFile(db.opts.Name, metricsName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, db.counters); err != nil {
+		return fmt.Errorf("%w: metrics: %v", ErrCorruptData, err)
+	}
+	return nil
+}
+
+// saveMetrics writes the counters to the metrics file, with
+// Options.PersistMetrics.
+func (db *database) saveMetrics() error {
+	if !db.opts.PersistMetrics || db.readonly {
+		return nil
+	}
+	c := db.counters.load()
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(db.path, datasetFile(db.opts.Name, metricsName))
+	if err := writeFileFS(db.fs, name+".tmp", data); err != nil {
+		return err
+	}
+	return db.fs.Rename(name+".tmp", name)
+}
+
+// Metrics returns statistics about the shelves of the database.
+func (db *database) Metrics() Metrics {
+	if db.checkOpen() != nil {
+		return Metrics{}
+	}
+	var (
+		shelves = db.snapshot()
+		c       = db.counters.load()
+		m       = Metrics{
+			Shelves:      make([]ShelfMetrics, len(shelves)),
+			Puts:         c.Puts,
+			Gets:         c.Gets,
+			BytesWritten: c.BytesWritten,
+			BytesRead:    c.BytesRead,
+		}
+	)
+	for i, shelf := range shelves {
+		m.Shelves[i].SlotSize = shelf.slotSize
+		if shelf.sizes != nil {
+			shelf.sizes.metrics(&m.Shelves[i])
+		}
+	}
+	return m
+}
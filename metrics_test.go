@@ -0,0 +1,110 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "testing"
+
+func TestMetricsSizes(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), TrackSizeHistogram: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Sizes 1 to 96 end up in the first shelf, the rest in the second
+	for size := 1; size <= 150; size++ {
+		if _, err := db.Put(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := db.Metrics()
+	if len(m.Shelves) != 2 {
+		t.Fatalf("have %d shelves, want 2", len(m.Shelves))
+	}
+	first := m.Shelves[0]
+	if first.SlotSize != 100 || first.Writes != 96 {
+		t.Fatalf("unexpected first shelf %+v", first)
+	}
+	if first.AvgSize != 48.5 {
+		t.Errorf("have average %v, want 48.5", first.AvgSize)
+	}
+	// The 99th percentile is 95, approximated to the upper end of a bucket
+	// two sizes wide
+	if first.P99Size < 95 || first.P99Size > 96 {
+		t.Errorf("have p99 %d, want 95 or 96", first.P99Size)
+	}
+	second := m.Shelves[1]
+	if second.SlotSize != 200 || second.Writes != 54 {
+		t.Fatalf("unexpected second shelf %+v", second)
+	}
+	if second.AvgSize != 123.5 {
+		t.Errorf("have average %v, want 123.5", second.AvgSize)
+	}
+	if second.P99Size < 150 || second.P99Size > 153 {
+		t.Errorf("have p99 %d, want about 150", second.P99Size)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	for i, shelf := range db.Metrics().Shelves {
+		if shelf.Writes != 0 || shelf.AvgSize != 0 || shelf.P99Size != 0 {
+			t.Errorf("shelf %d: unexpected sizes %+v", i, shelf)
+		}
+	}
+}
+
+func TestPersistMetrics(t *testing.T) {
+	var (
+		p    = t.TempDir()
+		opts = Options{Path: p, PersistMetrics: true}
+	)
+	db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Put(make([]byte, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := Metrics{Puts: 1, Gets: 3, BytesWritten: 50, BytesRead: 150}
+	if m := db.Metrics(); m.Puts != want.Puts || m.Gets != want.Gets || m.BytesWritten != want.BytesWritten || m.BytesRead != want.BytesRead {
+		t.Fatalf("have counters %+v, want %+v", m, want)
+	}
+	db.Close()
+	// The counters resume on open
+	db, err = Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Put(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	want = Metrics{Puts: 2, Gets: 3, BytesWritten: 60, BytesRead: 150}
+	if m := db.Metrics(); m.Puts != want.Puts || m.Gets != want.Gets || m.BytesWritten != want.BytesWritten || m.BytesRead != want.BytesRead {
+		t.Fatalf("have counters %+v, want %+v", m, want)
+	}
+	db.Close()
+	// Without the option, they start from zero
+	db, err = Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if m := db.Metrics(); m.Puts != 0 || m.Gets != 0 {
+		t.Fatalf("have counters %+v, want none", m)
+	}
+}
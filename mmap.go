@@ -0,0 +1,66 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "io"
+
+// mappedFile is a read-only shelf file, whose content is served from a memory
+// mapping instead of read with syscalls. Writes go to the underlying file,
+// which is opened read-only, so they fail.
+type mappedFile struct {
+	File
+	data  []byte
+	unmap func([]byte) error
+}
+
+func (f *mappedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *mappedFile) Close() error {
+	err := f.unmap(f.data)
+	if e := f.File.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// fdFile is implemented by files backed by an OS file descriptor, such as
+// *os.File.
+type fdFile interface {
+	Fd() uintptr
+}
+
+// mapFile maps the content of the read-only file into memory. Files which are
+// empty or which can't be mapped, e.g. because they are not backed by an OS
+// file, are returned as is.
+func mapFile(f File) (File, error) {
+	fd, ok := f.(fdFile)
+	if !ok || !mmapSupported {
+		return f, nil
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 || int64(int(stat.Size())) != stat.Size() {
+		return f, nil
+	}
+	data, err := mmap(fd.Fd(), int(stat.Size()))
+	if err != nil {
+		return nil, err
+	}
+	return &mappedFile{File: f, data: data, unmap: munmap}, nil
+}
@@ -0,0 +1,19 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package billy
+
+import "errors"
+
+const mmapSupported = false
+
+func mmap(fd uintptr, size int) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
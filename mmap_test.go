@@ -0,0 +1,74 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReadonlyMmap(t *testing.T) {
+	p := t.TempDir()
+	if _, err := Open(Options{Path: p, Mmap: true}, SlotSizeLinear(100, 3), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+	db, err := Open(Options{Path: p, Checksum: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64][]byte)
+	for i := 0; i < 60; i++ {
+		data := fill(byte(i), 1+i*3%180)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	db.Close()
+
+	db, err = Open(Options{Path: p, Checksum: true, Readonly: true, Mmap: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if mmapSupported {
+		for i, shelf := range db.(*database).shelves {
+			if _, ok := shelf.f.(*mappedFile); !ok {
+				t.Fatalf("shelf %d not mapped", i)
+			}
+		}
+	}
+	for key, data := range want {
+		have, err := db.Get(key)
+		if err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("key %x: have %x (err %v), want %x", key, have, err, data)
+		}
+		// The data returned is a copy, not a view into the mapping.
+		if len(have) > 0 {
+			have[0]++
+			if again, _ := db.Get(key); !bytes.Equal(again, data) {
+				t.Fatalf("key %x: modifying the result changed the stored data", key)
+			}
+		}
+	}
+	n := 0
+	db.Iterate(func(key uint64, data []byte) {
+		if !bytes.Equal(data, want[key]) {
+			t.Errorf("iterate key %x: have %x, want %x", key, data, want[key])
+		}
+		n++
+	})
+	if n != len(want) {
+		t.Fatalf("iterated %d items, want %d", n, len(want))
+	}
+	if _, err := db.Put([]byte("data")); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("put: expected %v, got %v", ErrReadOnly, err)
+	}
+	if err := db.Delete(0); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("delete: expected %v, got %v", ErrReadOnly, err)
+	}
+}
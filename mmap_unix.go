@@ -0,0 +1,19 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package billy
+
+import "syscall"
+
+const mmapSupported = true
+
+func mmap(fd uintptr, size int) ([]byte, error) {
+	return syscall.Mmap(int(fd), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,217 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// legacyShelfName returns the file name of a shelf in the original naming
+// scheme, bkt_<slot size>.bag.
+func legacyShelfName(slotSize uint32) string {
+	return fmt.Sprintf("bkt_%08d.bag", slotSize)
+}
+
+// shelfName returns the file name of a shelf in the naming scheme used with
+// Options.EncodeSlotSizeInName, shelf_<index>_<slot size>.bin.
+func shelfName(index int, slotSize uint32) string {
+	return fmt.Sprintf("shelf_%02d_%d.bin", index, slotSize)
+}
+
+// datasetFile returns the name of the given file of a database, prefixed with
+// the dataset name of the database, see Options.Name.
+func datasetFile(dataset, file string) string {
+	if dataset == "" {
+		return file
+	}
+	return dataset + "." + file
+}
+
+// splitDatasetFile splits the name of a file of a database into the dataset
+// name and the name of the file within the database. Files which are not part
+// of a named dataset are reported with an empty dataset name.
+func splitDatasetFile(name string) (dataset, file string) {
+	if i := strings.IndexByte(name, '.'); i > 0 && validDatasetName(name[:i]) && isDatabaseFile(name[i+1:]) {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// datasetFileOf returns the name of the file within the database, if the file
+// belongs to the given dataset.
+func datasetFileOf(dataset, name string) (string, bool) {
+	have, file := splitDatasetFile(name)
+	return file, have == dataset
+}
+
+// validDatasetName reports whether the name may be used as Options.Name: it
+// must be non-empty, and consist of ASCII letters, digits, '-' and '_'.
+func validDatasetName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// isDatabaseFile reports whether the name, without a dataset prefix, is the
+// name of one of the files of a database.
+func isDatabaseFile(name string) bool {
+	if _, _, ok := ParseShelfName(name); ok {
+		return true
+	}
+	for _, ext := range []string{".journal", ".free"} {
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		// Journals and gap-lists are named after their shelf, in either
+		// scheme
+		base := strings.TrimSuffix(name, ext)
+		if _, _, ok := ParseShelfName(base + ".bag"); ok {
+			return true
+		}
+		_, _, ok := ParseShelfName(base + ".bin")
+		return ok
+	}
+	switch name {
+	case manifestName, manifestName + manifestBackupSuffix, metaName, metricsName:
+		return true
+	}
+	return false
+}
+
+// ListDatasets returns the names of the datasets which have shelf files in the
+// given directory, see Options.Name, in sorted order. A database opened without
+// a name is listed as the empty string. Files which don't belong to any
+// database are ignored.
+func ListDatasets(path string) ([]string, error) {
+	return listDatasets(osFS{}, path)
+}
+
+func listDatasets(fsys FS, path string) ([]string, error) {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var datasets []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		dataset, file := splitDatasetFile(entry.Name())
+		if _, _, ok := ParseShelfName(file); !ok || seen[dataset] {
+			continue
+		}
+		seen[dataset] = true
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+	return datasets, nil
+}
+
+// ParseShelfName parses the file name of a shelf, in either naming scheme, and
+// returns the shelf index and slot size encoded in it. The legacy scheme does
+// not encode the index, which is then reported as -1.
+func ParseShelfName(name string) (index int, slotSize uint32, ok bool) {
+	parseSize := func(s string) (uint32, bool) {
+		size, err := strconv.ParseUint(s, 10, 32)
+		return uint32(size), err == nil
+	}
+	if strings.HasPrefix(name, "bkt_") && strings.HasSuffix(name, ".bag") {
+		size, ok := parseSize(strings.TrimSuffix(strings.TrimPrefix(name, "bkt_"), ".bag"))
+		if !ok || legacyShelfName(size) != name {
+			return 0, 0, false
+		}
+		return -1, size, true
+	}
+	if strings.HasPrefix(name, "shelf_") && strings.HasSuffix(name, ".bin") {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "shelf_"), ".bin"), "_")
+		if len(parts) != 2 {
+			return 0, 0, false
+		}
+		index, err := strconv.Atoi(parts[0])
+		size, ok := parseSize(parts[1])
+		if err != nil || !ok || index < 0 || shelfName(index, size) != name {
+			return 0, 0, false
+		}
+		return index, size, true
+	}
+	return 0, 0, false
+}
+
+// findShelfFiles lists the shelf files of the dataset in the given directory,
+// in either naming scheme, by slot size.
+func findShelfFiles(fsys FS, path, dataset string) (map[uint32]string, error) {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[uint32]string)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		file, ours := datasetFileOf(dataset, entry.Name())
+		if !ours {
+			continue
+		}
+		_, size, ok := ParseShelfName(file)
+		if !ok {
+			continue
+		}
+		if prev, exists := names[size]; exists {
+			return nil, fmt.Errorf("%w: both %v and %v have slot size %d", ErrLayoutMismatch, prev, entry.Name(), size)
+		}
+		names[size] = entry.Name()
+	}
+	return names, nil
+}
+
+// OrphanedFiles returns the paths of the shelf files in the database directory
+// which don't belong to any of the shelves the slotSizeFn yields, e.g. because
+// it has been changed to produce fewer shelves. Such files are never opened,
+// and can be removed once their data is no longer needed. Nothing is removed
+// by this function, and the database need not be opened.
+func OrphanedFiles(opts Options, slotSizeFn SlotSizeFn) ([]string, error) {
+	fsys := opts.FS
+	if fsys == nil {
+		fsys = osFS{}
+	}
+	sizes, err := slotSizes(slotSizeFn, opts)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[uint32]bool, len(sizes))
+	for _, size := range sizes {
+		wanted[size] = true
+	}
+	entries, err := fsys.ReadDir(opts.Path)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		file, ours := datasetFileOf(opts.Name, entry.Name())
+		if !ours {
+			continue
+		}
+		if _, size, ok := ParseShelfName(file); ok && !wanted[size] {
+			orphans = append(orphans, filepath.Join(opts.Path, entry.Name()))
+		}
+	}
+	return orphans, nil
+}
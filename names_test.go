@@ -0,0 +1,208 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseShelfName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		index int
+		size  uint32
+		ok    bool
+	}{
+		{"bkt_00000100.bag", -1, 100, true},
+		{"bkt_4294967295.bag", -1, 0xffffffff, true},
+		{"shelf_00_4096.bin", 0, 4096, true},
+		{"shelf_123_16.bin", 123, 16, true},
+		{"bkt_100.bag", 0, 0, false},
+		{"bkt_00000100.journal", 0, 0, false},
+		{"shelf_0_4096.bin", 0, 0, false},
+		{"shelf_00_04096.bin", 0, 0, false},
+		{"shelf_00_4096_1.bin", 0, 0, false},
+		{"shelf_-1_4096.bin", 0, 0, false},
+		{"shelf_00_4294967296.bin", 0, 0, false},
+		{"billy.manifest", 0, 0, false},
+	} {
+		index, size, ok := ParseShelfName(tt.name)
+		if ok != tt.ok || (ok && (index != tt.index || size != tt.size)) {
+			t.Errorf("%s: have (%d, %d, %v), want (%d, %d, %v)", tt.name, index, size, ok, tt.index, tt.size, tt.ok)
+		}
+		if ok {
+			if tt.index < 0 && legacyShelfName(size) != tt.name {
+				t.Errorf("%s: does not round-trip", tt.name)
+			} else if tt.index >= 0 && shelfName(index, size) != tt.name {
+				t.Errorf("%s: does not round-trip", tt.name)
+			}
+		}
+	}
+}
+
+func TestEncodeSlotSizeInName(t *testing.T) {
+	p := t.TempDir()
+	// Start out with the legacy names
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, _ := db.Put(fill(1, 50))
+	k2, _ := db.Put(fill(2, 150))
+	db.Close()
+	// Add a shelf with the new scheme
+	opts := Options{Path: p, EncodeSlotSizeInName: true}
+	db, err = Open(opts, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k3, _ := db.Put(fill(3, 250))
+	db.Close()
+	var names []string
+	entries, _ := os.ReadDir(p)
+	for _, e := range entries {
+		if _, _, ok := ParseShelfName(e.Name()); ok {
+			names = append(names, e.Name())
+		}
+	}
+	want := []string{"bkt_00000100.bag", "bkt_00000200.bag", "shelf_02_300.bin"}
+	if len(names) != len(want) {
+		t.Fatalf("have files %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("have files %v, want %v", names, want)
+		}
+	}
+	// Both schemes are found when reopening, with or without the setting
+	for _, encode := range []bool{false, true} {
+		db, err = Open(Options{Path: p, EncodeSlotSizeInName: encode}, SlotSizeLinear(100, 4), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, data := range map[uint64][]byte{k1: fill(1, 50), k2: fill(2, 150), k3: fill(3, 250)} {
+			have, err := db.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(have, data) {
+				t.Fatalf("encode=%v, key %#x: wrong data", encode, key)
+			}
+		}
+		db.Close()
+	}
+	// Two files for the same slot size are ambiguous
+	if err := os.WriteFile(filepath.Join(p, "shelf_00_100.bin"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(opts, SlotSizeLinear(100, 4), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+}
+
+func TestOrphanedFiles(t *testing.T) {
+	p := t.TempDir()
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put(fill(1, 50))
+	db.Close()
+	// Stray shelf files, in both schemes, and an unrelated file.
+	for _, name := range []string{"bkt_00000500.bag", "shelf_07_700.bin", "other.bag"} {
+		if err := os.WriteFile(filepath.Join(p, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	have, err := OrphanedFiles(Options{Path: p}, SlotSizeLinear(100, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(p, "bkt_00000500.bag"), filepath.Join(p, "shelf_07_700.bin")}
+	if len(have) != len(want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("have %v, want %v", have, want)
+		}
+	}
+	// With fewer shelves, the files of the dropped ones are reported too.
+	have, err = OrphanedFiles(Options{Path: p}, SlotSizeLinear(100, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != 3 || have[0] != filepath.Join(p, "bkt_00000300.bag") {
+		t.Fatalf("have %v", have)
+	}
+	// Nothing was removed.
+	for _, name := range []string{"bkt_00000300.bag", "bkt_00000500.bag", "shelf_07_700.bin"} {
+		if _, err := os.Stat(filepath.Join(p, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListDatasets(t *testing.T) {
+	p := t.TempDir()
+	for _, name := range []string{"alpha", "beta"} {
+		db, err := Open(Options{Path: p, Name: name}, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Put([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SetMeta([]byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	// Files no database uses
+	for _, name := range []string{"notes.txt", "gamma.bkt_100.bag", "delta.billy.manifest", "x.y.bkt_00000100.bag"} {
+		if err := os.WriteFile(filepath.Join(p, name), []byte("junk"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	datasets, err := ListDatasets(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(datasets) != 2 || datasets[0] != "alpha" || datasets[1] != "beta" {
+		t.Fatalf("have datasets %q, want [alpha beta]", datasets)
+	}
+	// The datasets are independent of each other, and of an unnamed one
+	for _, name := range []string{"alpha", "beta"} {
+		db, err := Open(Options{Path: p, Name: name}, SlotSizeLinear(100, 3), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err := db.Get(0); err != nil || string(data) != name {
+			t.Errorf("%s: have %q, %v", name, data, err)
+		}
+		if meta, err := db.GetMeta(); err != nil || string(meta) != name {
+			t.Errorf("%s: have meta %q, %v", name, meta, err)
+		}
+		db.Close()
+	}
+	db, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(0); !errors.Is(err, ErrNeverWritten) {
+		t.Errorf("expected %v, got %v", ErrNeverWritten, err)
+	}
+	db.Close()
+	if datasets, err = ListDatasets(p); err != nil || len(datasets) != 3 || datasets[0] != "" {
+		t.Fatalf("have datasets %q, %v, want the unnamed one first", datasets, err)
+	}
+	if _, err := Open(Options{Path: p, Name: "a.b"}, SlotSizeLinear(100, 3), nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
@@ -0,0 +1,149 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// overflowBit is set in the keys of values stored in the overflow directory.
+// It's far above the bits used by the keys of the shelves.
+const overflowBit = 1 << 63
+
+// overflowSuffix is the file name suffix of the overflow values, which are
+// named by the hex-encoded id of their key.
+const overflowSuffix = ".blob"
+
+// overflowStore stores values too large for any shelf, one file per value,
+// in the directory given by Options.OverflowDir.
+type overflowStore struct {
+	fs   FS
+	dir  string
+	next uint64 // Id of the next value stored (atomic)
+}
+
+// openOverflow opens the overflow store in the given directory, which must
+// exist.
+func openOverflow(fsys FS, dir string) (*overflowStore, error) {
+	if finfo, err := fsys.Stat(dir); err != nil {
+		return nil, err
+	} else if !finfo.IsDir() {
+		return nil, fmt.Errorf("%w: '%v'", ErrNotDirectory, dir)
+	}
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	o := &overflowStore{fs: fsys, dir: dir}
+	for _, entry := range entries {
+		if id, ok := parseOverflowName(entry.Name()); ok && id >= o.next {
+			o.next = id + 1
+		}
+	}
+	return o, nil
+}
+
+// overflowName returns the file name of the value with the given id.
+func overflowName(id uint64) string {
+	return fmt.Sprintf("%016x%s", id, overflowSuffix)
+}
+
+// parseOverflowName returns the id of the value stored in the named file.
+func parseOverflowName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, overflowSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, overflowSuffix), 16, 63)
+	if err != nil || overflowName(id) != name {
+		return 0, false
+	}
+	return id, true
+}
+
+// path returns the path of the file of the value stored at the given key.
+func (o *overflowStore) path(key uint64) string {
+	return filepath.Join(o.dir, overflowName(key&^overflowBit))
+}
+
+// put stores the data in a new file, and returns its key. The data is written
+// to a temporary file first, which is renamed once synced, so that a crash
+// can't leave a truncated value behind. The temporary file doesn't have the
+// suffix of the values, so a leftover one is ignored. The directory is synced
+// after the rename, on file systems which need it, see DirSyncer.
+func (o *overflowStore) put(data []byte) (uint64, error) {
+	key := (atomic.AddUint64(&o.next, 1) - 1) | overflowBit
+	name := o.path(key)
+	if err := writeFileFS(o.fs, name+".tmp", data); err != nil {
+		return 0, err
+	}
+	if err := o.fs.Rename(name+".tmp", name); err != nil {
+		o.fs.Remove(name + ".tmp")
+		return 0, err
+	}
+	if syncer, ok := o.fs.(DirSyncer); ok {
+		if err := syncer.SyncDir(o.dir); err != nil {
+			return 0, err
+		}
+	}
+	return key, nil
+}
+
+// get returns the data stored at the given key.
+func (o *overflowStore) get(key uint64) ([]byte, error) {
+	data, err := readFileFS(o.fs, o.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: overflow key %#x", ErrBadIndex, key)
+	}
+	return data, err
+}
+
+// size returns the length of the data stored at the given key.
+func (o *overflowStore) size(key uint64) (int, error) {
+	finfo, err := o.fs.Stat(o.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%w: overflow key %#x", ErrBadIndex, key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(finfo.Size()), nil
+}
+
+// delete removes the value stored at the given key.
+func (o *overflowStore) delete(key uint64) error {
+	err := o.fs.Remove(o.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: overflow key %#x", ErrBadIndex, key)
+	}
+	return err
+}
+
+// iterate invokes onData for every value in the store, in ascending key order,
+// or descending if reverse is set.
+func (o *overflowStore) iterate(reverse bool, onData OnDataFn) {
+	entries, err := o.fs.ReadDir(o.dir)
+	if err != nil {
+		return
+	}
+	for i := range entries {
+		entry := entries[i]
+		if reverse {
+			entry = entries[len(entries)-1-i]
+		}
+		id, ok := parseOverflowName(entry.Name())
+		if !ok {
+			continue
+		}
+		if data, err := o.get(id | overflowBit); err == nil {
+			onData(id|overflowBit, data)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverflow(t *testing.T) {
+	var (
+		p        = t.TempDir()
+		overflow = t.TempDir()
+		opts     = Options{Path: p, OverflowDir: overflow}
+	)
+	db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, _ := db.Put(fill(1, 50))
+	big := fill(2, 5000)
+	key, err := db.Put(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key&overflowBit == 0 || small&overflowBit != 0 {
+		t.Fatalf("have keys %#x and %#x, want only the large one routed to overflow", small, key)
+	}
+	if have, err := db.Get(key); err != nil || !bytes.Equal(have, big) {
+		t.Fatalf("have %d bytes (err %v), want %d", len(have), err, len(big))
+	}
+	if n, err := db.Len(key); err != nil || n != len(big) {
+		t.Fatalf("have len %d (err %v), want %d", n, err, len(big))
+	}
+	if _, err := os.Stat(filepath.Join(overflow, overflowName(0))); err != nil {
+		t.Fatal(err)
+	}
+	items := make(map[uint64]int)
+	db.Iterate(func(key uint64, data []byte) { items[key] = len(data) })
+	if len(items) != 2 || items[key] != len(big) || items[small] != 50 {
+		t.Fatalf("iterated %v", items)
+	}
+	db.Close()
+
+	// The store survives a reopen, and new keys don't collide.
+	db, err = Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if have, err := db.Get(key); err != nil || !bytes.Equal(have, big) {
+		t.Fatalf("have %d bytes (err %v), want %d", len(have), err, len(big))
+	}
+	key2, err := db.Put(fill(3, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key2 != key+1 {
+		t.Fatalf("have key %#x, want %#x", key2, key+1)
+	}
+	if err := db.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+	if err := db.Delete(key); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+	// Without the store, large values are rejected as before.
+	plain, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.Put(big); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("expected %v, got %v", ErrValueTooLarge, err)
+	}
+}
+
+func TestOverflowPartialWrite(t *testing.T) {
+	overflow := t.TempDir()
+	db, err := Open(Options{Path: t.TempDir(), OverflowDir: overflow}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A value partially written before a crash, as left by put
+	if err := os.WriteFile(filepath.Join(overflow, overflowName(0)+".tmp"), fill(1, 10), 0666); err != nil {
+		t.Fatal(err)
+	}
+	key, err := db.Put(fill(2, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(overflow, overflowName(0)+".tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+	var n int
+	db.Iterate(func(k uint64, data []byte) {
+		if k != key || !bytes.Equal(data, fill(2, 1000)) {
+			t.Errorf("unexpected item %#x of %d bytes", k, len(data))
+		}
+		n++
+	})
+	if n != 1 {
+		t.Fatalf("have %d items, want 1", n)
+	}
+}
+
+func TestOverflowUnsupported(t *testing.T) {
+	fsys := &dirSyncFS{newMemFS("db", "overflow"), make(map[string]int)}
+	db, err := Open(Options{Path: "db", FS: fsys, OverflowDir: "overflow", Sequence: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put(fill(1, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// The rename of the value is synced
+	if fsys.syncs["overflow"] != 1 {
+		t.Fatalf("have %d directory syncs, want 1", fsys.syncs["overflow"])
+	}
+	// The operations which only cover the shelves refuse to skip the value
+	if err := db.Backup("backup"); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("backup: expected %v, got %v", ErrInvalidOptions, err)
+	}
+	if err := db.ReplayInSequence(func(key uint64, data []byte) {}); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("replay: expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
@@ -0,0 +1,110 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "fmt"
+
+// KeyRange is a range of keys, [Lo, Hi], with both ends included.
+type KeyRange struct {
+	Lo, Hi uint64
+}
+
+// SplitRanges partitions the key space into up to n contiguous ranges, holding
+// roughly the same number of items each, e.g. to spread an iteration over
+// parallel workers with IterateKeyRange. The ranges cover all keys, from 0 to
+// the largest possible one, so items added meanwhile fall into one of them.
+// The item counts are taken from CountByShelf, and items are assumed to be
+// spread evenly over the slots of a shelf, so no data is read. Fewer than n
+// ranges are returned if there are fewer items than that. Values in
+// Options.OverflowDir are not counted, and fall into the last range.
+func (db *database) SplitRanges(n int) []KeyRange {
+	if db.checkOpen() != nil {
+		return nil
+	}
+	if n < 1 {
+		n = 1
+	}
+	var (
+		shelves = db.snapshot()
+		counts  = make([]uint64, len(shelves))
+		tails   = make([]uint64, len(shelves))
+		total   uint64
+	)
+	for i, shelf := range shelves {
+		gaps, tail := shelf.slotCounts()
+		counts[i], tails[i] = tail-gaps, tail
+		total += counts[i]
+	}
+	if total == 0 {
+		return []KeyRange{{0, ^uint64(0)}}
+	}
+	var (
+		ranges []KeyRange
+		lo     uint64
+		shelf  int
+		before uint64 // Number of items in the shelves before the current one
+	)
+	for k := 1; k < n; k++ {
+		// The boundary falls on the item with the index below. Since that
+		// is always less than total, a shelf holding it is found.
+		item := total * uint64(k) / uint64(n)
+		for before+counts[shelf] <= item {
+			before += counts[shelf]
+			shelf++
+		}
+		slot := (item - before) * tails[shelf] / counts[shelf]
+		if boundary := db.MakeKey(shelf, slot); boundary > lo {
+			ranges = append(ranges, KeyRange{lo, boundary - 1})
+			lo = boundary
+		}
+	}
+	return append(ranges, KeyRange{lo, ^uint64(0)})
+}
+
+// IterateKeyRange is like IterateRange, for a range returned by SplitRanges.
+func (db *database) IterateKeyRange(r KeyRange, onData OnDataFn) error {
+	return db.IterateRange(r.Lo, r.Hi, onData)
+}
+
+// IterateRange is like Iterate, but only visits the items with keys in [lo, hi],
+// in ascending key order. Since the shelf index makes up the high bits of a
+// key, the range maps to a contiguous run of slots, from the slot of lo in its
+// shelf to the slot of hi in its shelf, and only those slots are read.
+func (db *database) IterateRange(lo, hi uint64, onData OnDataFn) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if lo > hi {
+		return fmt.Errorf("%w: inverted key range [%#x, %#x]", ErrBadIndex, lo, hi)
+	}
+	defer startSpan(db.tracer, "Iterate").End()
+	var (
+		shelves         = db.snapshot()
+		maxSlot         = uint64(1)<<db.slotBits - 1
+		loShelf, loSlot = db.ParseKey(lo)
+		hiShelf, hiSlot = db.ParseKey(hi)
+	)
+	if hi&overflowBit != 0 || hiShelf >= len(shelves) {
+		hiShelf, hiSlot = len(shelves)-1, maxSlot
+	}
+	for i := loShelf; i <= hiShelf; i++ {
+		var first, last uint64 = 0, maxSlot
+		if i == loShelf {
+			first = loSlot
+		}
+		if i == hiShelf {
+			last = hiSlot
+		}
+		shelves[i].IterateSlots(first, last, db.wrapShelfDataFn(i, onData))
+	}
+	if db.overflow != nil && hi&overflowBit != 0 {
+		db.overflow.iterate(false, func(key uint64, data []byte) {
+			if key >= lo && key <= hi {
+				onData(key, data)
+			}
+		})
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSplitRanges(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(50, 5), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if ranges := db.SplitRanges(4); len(ranges) != 1 || ranges[0] != (KeyRange{0, ^uint64(0)}) {
+		t.Fatalf("empty database: have %v", ranges)
+	}
+	var keys []uint64
+	for i := 0; i < 1000; i++ {
+		key, err := db.Put(fill(byte(i), 1+i*i%11*17))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < len(keys); i += 5 {
+		db.Delete(keys[i])
+	}
+	live := make(map[uint64]bool)
+	db.Iterate(func(key uint64, data []byte) { live[key] = true })
+
+	ranges := db.SplitRanges(4)
+	if len(ranges) != 4 {
+		t.Fatalf("have %d ranges, want 4", len(ranges))
+	}
+	if ranges[0].Lo != 0 || ranges[len(ranges)-1].Hi != ^uint64(0) {
+		t.Fatalf("ranges %v don't cover the key space", ranges)
+	}
+	seen := make(map[uint64]bool)
+	for i, r := range ranges {
+		if r.Lo > r.Hi || i > 0 && r.Lo != ranges[i-1].Hi+1 {
+			t.Fatalf("range %d %v not contiguous with %v", i, r, ranges[i-1])
+		}
+		n := 0
+		err := db.IterateKeyRange(r, func(key uint64, data []byte) {
+			if key < r.Lo || key > r.Hi {
+				t.Errorf("range %d: key %#x outside %v", i, key, r)
+			}
+			if seen[key] {
+				t.Errorf("range %d: key %#x visited twice", i, key)
+			}
+			seen[key] = true
+			n++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := len(live) / 4; n < want*3/4 || n > want*5/4 {
+			t.Errorf("range %d: have %d items, want about %d", i, n, want)
+		}
+	}
+	if len(seen) != len(live) {
+		t.Fatalf("have %d keys in the ranges, want %d", len(seen), len(live))
+	}
+	if err := db.IterateKeyRange(KeyRange{10, 5}, nil); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+}
+
+func TestIterateRange(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(50, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for i := 0; i < 200; i++ {
+		key, err := db.Put(fill(byte(i), 1+i*7%140))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	for i := 0; i < len(keys); i += 3 {
+		db.Delete(keys[i])
+	}
+	var all []uint64
+	db.Iterate(func(key uint64, data []byte) { all = append(all, key) })
+	for _, r := range []KeyRange{
+		{0, ^uint64(0)},
+		{0, 0},
+		{5, 17},
+		{10, 2<<slotBits + 3},
+		{1<<slotBits - 1, 1 << slotBits},
+		{3 << slotBits, 3<<slotBits + 1000},
+		{4 << slotBits, ^uint64(0)},
+	} {
+		var want, have []uint64
+		for _, key := range all {
+			if key >= r.Lo && key <= r.Hi {
+				want = append(want, key)
+			}
+		}
+		if err := db.IterateRange(r.Lo, r.Hi, func(key uint64, data []byte) {
+			have = append(have, key)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("range %#x: have %d items, want %d", r, len(have), len(want))
+		}
+		for i := range have {
+			if have[i] != want[i] {
+				t.Fatalf("range %#x, item %d: have key %#x, want %#x", r, i, have[i], want[i])
+			}
+		}
+	}
+	if err := db.IterateRange(10, 5, nil); !errors.Is(err, ErrBadIndex) {
+		t.Fatalf("expected %v, got %v", ErrBadIndex, err)
+	}
+}
@@ -0,0 +1,256 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The raw export stream starts with rawMagic, followed by a frame per file:
+// [ uint32: slot size | uint16: name length | name | uint64: length | <content> ]
+// The slot size is 0 for files which are not shelves, such as the manifest.
+// A frame with an empty name ends the stream. All fields are big-endian.
+const (
+	rawMagic          = "billyraw\x01"
+	rawFrameHeaderLen = 4 + 2
+)
+
+// ExportRaw writes the files of the database to w, in a framed stream which
+// ImportRaw can turn back into a database directory. The shelf files are
+// copied verbatim, except that the deleted slots are marked as such, as Close
+// would do, so the exact slot layout is preserved. Writes to a shelf wait while it's
+// being exported; for a consistent snapshot across shelves, the database
+// should be quiesced.
+func (db *database) ExportRaw(w io.Writer) error {
+	return db.exportRaw(w, false)
+}
+
+// exportRaw implements ExportRaw. For a Backup, the tracking of changed slots
+// starts over.
+func (db *database) exportRaw(w io.Writer, backup bool) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if db.opts.FixedValueSize != 0 {
+		// The deleted slots can't be marked as such without headers.
+		return fmt.Errorf("%w: raw export with fixed value size", ErrInvalidOptions)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if _, err := io.WriteString(w, rawMagic); err != nil {
+		return err
+	}
+	if err := db.writeMetaFrames(w); err != nil {
+		return err
+	}
+	for _, shelf := range db.shelves {
+		if err := shelf.exportRaw(w, backup); err != nil {
+			return err
+		}
+	}
+	return writeRawFrame(w, 0, "", 0)
+}
+
+// writeMetaFrames writes a frame each for the manifest and the metadata blob,
+// if they exist. The caller must hold db.mu.
+func (db *database) writeMetaFrames(w io.Writer) error {
+	for _, file := range []string{manifestName, metaName} {
+		name := datasetFile(db.opts.Name, file)
+		data, err := readFileFS(db.fs, filepath.Join(db.path, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := writeRawFrame(w, 0, name, uint64(len(data))); err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRawFrame writes the header of a frame of the raw export stream.
+func writeRawFrame(w io.Writer, slotSize uint32, name string, length uint64) error {
+	hdr := make([]byte, rawFrameHeaderLen+len(name)+8)
+	binary.BigEndian.PutUint32(hdr, slotSize)
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(name)))
+	copy(hdr[rawFrameHeaderLen:], name)
+	binary.BigEndian.PutUint64(hdr[rawFrameHeaderLen+len(name):], length)
+	_, err := w.Write(hdr)
+	return err
+}
+
+// exportRaw writes a frame with the content of the shelf file, up to the tail,
+// with the gaps marked as deleted. For a backup, the changes are tracked from
+// then on, see exportPatch.
+func (s *shelf) exportRaw(w io.Writer, backup bool) error {
+	// Holding compactMu keeps Put, Update and Compact out.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.gapsMu.Lock()
+	var (
+		tail = s.tail
+		gaps = append(sortedUniqueInts(nil), s.gaps...)
+	)
+	if backup {
+		s.dirtyMu.Lock()
+		s.dirty = make(map[uint64]bool)
+		s.dirtyMu.Unlock()
+	}
+	s.gapsMu.Unlock()
+
+	if err := writeRawFrame(w, s.slotSize, s.id, tail*uint64(s.slotSize)); err != nil {
+		return err
+	}
+	perChunk := uint64(warmupChunkSize / s.slotSize)
+	if perChunk == 0 {
+		perChunk = 1
+	}
+	buf := make([]byte, perChunk*uint64(s.slotSize))
+	for first := uint64(0); first < tail; first += perChunk {
+		n := tail - first
+		if n > perChunk {
+			n = perChunk
+		}
+		chunk := buf[:n*uint64(s.slotSize)]
+		if err := s.readChunk(chunk, first); err != nil {
+			return err
+		}
+		for _, gap := range gaps {
+			if gap >= first && gap < first+n {
+				off := (gap - first) * uint64(s.slotSize)
+				copy(chunk[off:], s.tombstone())
+			}
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunk reads the slots starting at the given one into buf.
+func (s *shelf) readChunk(buf []byte, slot uint64) error {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	n, err := s.f.ReadAt(buf, int64(slot)*int64(s.slotSize))
+	if err == io.EOF {
+		// The file ends with a partially written last slot
+		for i := n; i < len(buf); i++ {
+			buf[i] = 0
+		}
+		return nil
+	}
+	return err
+}
+
+// ImportRaw reads a stream written by ExportRaw, and recreates the files of the
+// database in dstDir, which must exist and not contain any of them already.
+// The database can then be opened with the slot sizes and options it was
+// exported with.
+func ImportRaw(r io.Reader, dstDir string) error {
+	return importRaw(osFS{}, r, dstDir)
+}
+
+func importRaw(fsys FS, r io.Reader, dstDir string) error {
+	magic := make([]byte, len(rawMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return fmt.Errorf("%w: reading magic: %v", ErrCorruptData, err)
+	}
+	if string(magic) != rawMagic {
+		return fmt.Errorf("%w: not a raw export", ErrCorruptData)
+	}
+	hdr := make([]byte, rawFrameHeaderLen)
+	for {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return fmt.Errorf("%w: reading frame: %v", ErrCorruptData, err)
+		}
+		slotSize := binary.BigEndian.Uint32(hdr)
+		name := make([]byte, int(binary.BigEndian.Uint16(hdr[4:]))+8)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return fmt.Errorf("%w: reading frame: %v", ErrCorruptData, err)
+		}
+		length := binary.BigEndian.Uint64(name[len(name)-8:])
+		name = name[:len(name)-8]
+		if len(name) == 0 {
+			return nil
+		}
+		if err := checkRawFrame(string(name), slotSize, length); err != nil {
+			return err
+		}
+		if err := importRawFile(fsys, io.LimitReader(r, int64(length)), filepath.Join(dstDir, string(name)), length); err != nil {
+			return err
+		}
+	}
+}
+
+// checkRawFrame verifies that a frame of the raw export stream describes a file
+// of a database, which guards against writing outside the target directory.
+// The file may be prefixed with a dataset name, see Options.Name.
+func checkRawFrame(name string, slotSize uint32, length uint64) error {
+	_, file := splitDatasetFile(name)
+	if slotSize == 0 {
+		if file != manifestName && file != metaName {
+			return fmt.Errorf("%w: unexpected file %q", ErrCorruptData, name)
+		}
+		return nil
+	}
+	if _, size, ok := ParseShelfName(file); !ok || size != slotSize {
+		return fmt.Errorf("%w: unexpected shelf file %q with slot size %d", ErrCorruptData, name, slotSize)
+	}
+	if length%uint64(slotSize) != 0 {
+		return fmt.Errorf("%w: shelf file %q of %d bytes, slot size %d", ErrCorruptData, name, length, slotSize)
+	}
+	return nil
+}
+
+// importRawFile creates the named file, with the given length of content read
+// from r.
+func importRawFile(fsys FS, r io.Reader, name string, length uint64) error {
+	if _, err := fsys.Stat(name); err == nil {
+		return fmt.Errorf("%w: %v", os.ErrExist, name)
+	}
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, warmupChunkSize)
+	for off := uint64(0); off < length; {
+		chunk := buf
+		if rest := length - off; rest < uint64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := io.ReadFull(r, chunk)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%w: reading %v: %v", ErrCorruptData, name, err)
+		}
+		if _, err := f.WriteAt(buf[:n], int64(off)); err != nil {
+			f.Close()
+			return err
+		}
+		off += uint64(n)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,99 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportImportRaw(t *testing.T) {
+	var (
+		src = t.TempDir()
+		dst = t.TempDir()
+	)
+	db, err := Open(Options{Path: src, Checksum: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[uint64][]byte)
+	for i := 0; i < 100; i++ {
+		data := fill(byte(i), 10+i*2)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	for key := range want {
+		if key%3 == 0 {
+			db.Delete(key)
+			delete(want, key)
+		}
+	}
+	if err := db.SetMeta([]byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := db.ExportRaw(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Closing blanks the deleted slots, just like the export does.
+	db.Close()
+	if err := ImportRaw(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		have, err := os.ReadFile(filepath.Join(dst, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := os.ReadFile(filepath.Join(src, entry.Name()))
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%v differs: have %d bytes, want %d", entry.Name(), len(have), len(want))
+		}
+	}
+	// Importing again fails, since the files exist.
+	if err := ImportRaw(bytes.NewReader(buf.Bytes()), dst); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected %v, got %v", os.ErrExist, err)
+	}
+	// Opening compacts the shelves, so the keys may change.
+	have := make(map[string]bool)
+	db, err = Open(Options{Path: dst, Checksum: true}, SlotSizeLinear(100, 4), func(key uint64, data []byte) {
+		have[string(data)] = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if len(have) != len(want) {
+		t.Fatalf("have %d items, want %d", len(have), len(want))
+	}
+	for _, data := range want {
+		if !have[string(data)] {
+			t.Fatalf("missing item %x", data)
+		}
+	}
+}
+
+func TestImportRawCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(rawMagic)
+	writeRawFrame(&buf, 0, "../escape", 1)
+	buf.WriteString("x")
+	if err := ImportRaw(&buf, t.TempDir()); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrCorruptData, err)
+	}
+	if err := ImportRaw(bytes.NewReader([]byte("garbage")), t.TempDir()); !errors.Is(err, ErrCorruptData) {
+		t.Fatalf("expected %v, got %v", ErrCorruptData, err)
+	}
+}
@@ -0,0 +1,85 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"io"
+)
+
+// Reload picks up the items appended to the shelf files by another process,
+// e.g. in a read-only replica of a database written elsewhere. It is strictly
+// additive: each shelf is extended to the end of its file, and the empty slots
+// found beyond the previous end are added to the gap-list, but nothing already
+// known is changed, so local writes are never lost. Items updated in place
+// are seen anyway, since reads go to the files. If a file has become shorter
+// than the shelf, ErrFileShrunk is returned; the other shelves are still
+// reloaded. A partially written slot at the end of a file is left for the next
+// Reload. It can't be used with Options.Mmap.
+func (db *database) Reload() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if db.opts.Mmap {
+		return fmt.Errorf("%w: reload with mmap", ErrInvalidOptions)
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var err error
+	for i, shelf := range db.shelves {
+		if e := shelf.reload(); e != nil && err == nil {
+			err = fmt.Errorf("shelf %d: %w", i, e)
+		}
+	}
+	return err
+}
+
+// reload extends the shelf to the end of its file, see Reload.
+func (s *shelf) reload() error {
+	// Holding compactMu keeps Put, Update and Compact out, so every slot
+	// below the tail has been written, once the write buffer is flushed.
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	end := (uint64(stat.Size()) + uint64(s.slotSize) - 1) / uint64(s.slotSize)
+	if end < s.tail {
+		return fmt.Errorf("%w: %d slots, had %d", ErrFileShrunk, end, s.tail)
+	}
+	hdr := make([]byte, s.hdrSize)
+	for slot := s.tail; slot < end; slot++ {
+		if n, err := s.readSlot(hdr, slot); err == io.EOF && n < len(hdr) {
+			// Still being written
+			end = slot
+			break
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+		if s.getSize(hdr) == 0 {
+			if s.maxGaps == 0 || len(s.gaps) < s.maxGaps {
+				s.gaps.Append(slot)
+			}
+		} else if s.seq != nil {
+			s.getSeq(hdr)
+		}
+	}
+	for slot := s.tail; slot < end; slot++ {
+		s.markDirty(slot)
+	}
+	s.tail = end
+	return nil
+}
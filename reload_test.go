@@ -0,0 +1,128 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	p := t.TempDir()
+	writer, err := Open(Options{Path: p}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	want := make(map[uint64][]byte)
+	put := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			data := fill(byte(len(want)), 1+len(want)*7%150)
+			key, err := writer.Put(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[key] = data
+		}
+		if err := writer.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(50)
+	replica, err := Open(Options{Path: p, Readonly: true}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	old := make(map[uint64][]byte)
+	for key, data := range want {
+		old[key] = data
+	}
+	// Read the items known from the start, while reloading.
+	var (
+		wg   sync.WaitGroup
+		stop = make(chan struct{})
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for key, data := range old {
+					if have, err := replica.Get(key); err != nil || !bytes.Equal(have, data) {
+						t.Errorf("key %x: have %d bytes (err %v), want %d", key, len(have), err, len(data))
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		put(20)
+		if err := replica.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	for key, data := range want {
+		if have, err := replica.Get(key); err != nil || !bytes.Equal(have, data) {
+			t.Fatalf("key %x: have %d bytes (err %v), want %d", key, len(have), err, len(data))
+		}
+	}
+	n := 0
+	replica.Iterate(func(key uint64, data []byte) { n++ })
+	if n != len(want) {
+		t.Fatalf("have %d items, want %d", n, len(want))
+	}
+	// A file which gets shorter is reported.
+	name := filepath.Join(p, legacyShelfName(100))
+	if err := os.Truncate(name, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := replica.Reload(); !errors.Is(err, ErrFileShrunk) {
+		t.Fatalf("expected %v, got %v", ErrFileShrunk, err)
+	}
+}
+
+func TestReloadReserved(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Put(fill(1, 50)); err != nil {
+		t.Fatal(err)
+	}
+	block, err := db.ReserveBlock(3, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file covers the reserved slots, so it hasn't shrunk
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range block {
+		if _, err := db.Get(key); !errors.Is(err, ErrNeverWritten) {
+			t.Fatalf("key %d: expected %v, got %v", key, ErrNeverWritten, err)
+		}
+	}
+	if err := db.PutAt(block[1], fill(2, 50)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := db.Get(block[1]); err != nil || !bytes.Equal(data, fill(2, 50)) {
+		t.Fatalf("have %x, %v", data, err)
+	}
+}
@@ -0,0 +1,48 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+const (
+	// retryBackoff is the delay before the first retry of a failed write. It
+	// doubles with every retry, up to maxRetryBackoff.
+	retryBackoff    = time.Millisecond
+	maxRetryBackoff = 100 * time.Millisecond
+)
+
+// isRetryable reports whether the error from a write may be transient, such
+// as a full disk which may be cleaned up, or a network filesystem hiccup. EIO
+// is not: the data may be lost already, and a retry could hide that.
+func isRetryable(err error) bool {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// withRetry calls fn, and retries it up to the given number of times, with
+// exponential backoff, as long as it fails with a retryable error. It must not
+// be used for Sync: after a failed fsync, the kernel may have dropped the dirty
+// pages already, so a retry could succeed without the data being on disk.
+func withRetry(retries int, fn func() error) error {
+	backoff := retryBackoff
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= retries || !isRetryable(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -5,79 +5,213 @@
 package billy
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // itemHeaderSize is 4 bytes: each piece of data is stored as
 // [ uint32: size |  <data> ]
+// Shelves using the compact header store the size as an uint16 instead:
+// [ uint16: size |  <data> ]
+// If sequence numbers are enabled, the size is followed by an uint64
+// sequence number:
+// [ uint32: size | uint64: seq | <data> ]
+// If compression is enabled, it's followed by the codec of the data:
+// [ uint32: size | uint64: seq (optional) | uint8: codec | <data> ]
+// If timestamps are enabled, they follow, in nanoseconds since the Unix epoch:
+// [ uint32: size | uint64: seq (optional) | uint8: codec (optional) | int64: time | <data> ]
+// If checksums are enabled, the header ends with the CRC32 of the stored data:
+// [ uint32: size | ... | uint32: crc | <data> ]
+// If tail lengths are enabled, the size is repeated in the last bytes of the
+// slot, so that a write which didn't reach the end of the slot is detected:
+// [ uint32: size | ... | <data> | <unused> | uint32: size ]
+// The size is the size of the data as stored, that is, after compression.
+// All header fields are big-endian, regardless of the platform, so shelf files
+// can be moved between architectures. Changing the byte order would make
+// existing files unreadable.
 const (
-	itemHeaderSize = 4
-	maxSlotSize    = uint64(0xffffffff)
+	itemHeaderSize        = 4
+	compactItemHeaderSize = 2
+	seqSize               = 8
+	checksumSize          = 4
+	codecSize             = 1
+	timestampSize         = 8
+	tailLengthSize        = 4
+	// maxCompactSlotSize is the largest slot size for which the compact header
+	// can be used.
+	maxCompactSlotSize = 0xffff
+	maxSlotSize        = uint64(0xffffffff)
 	// minSlotSize is the minimum size of a slot. It needs to fit the header,
 	// and then some actual data too.
 	minSlotSize = itemHeaderSize * 2
 )
 
-var (
-	ErrClosed      = errors.New("shelf closed")
-	ErrOversized   = errors.New("data too large for shelf")
-	ErrBadIndex    = errors.New("bad index")
-	ErrEmptyData   = errors.New("empty data")
-	ErrReadonly    = errors.New("read-only mode")
-	ErrCorruptData = errors.New("corrupt data")
-)
-
 // A shelf represents a collection of similarly-sized items. The shelf uses
 // a number of slots, where each slot is of the exact same size.
 type shelf struct {
 	id       string
 	slotSize uint32 // Size of the slots, up to 4GB
 
+	// compactMu is held for reading by writers, from reserving a slot until
+	// the data is written, and for writing by Compact, so that compaction
+	// never sees a reserved but unwritten slot. It's obtained before gapsMu.
+	compactMu sync.RWMutex
+
 	gapsMu sync.Mutex // Mutex for operating on 'gaps' and 'tail'
 	// A slice of indices to slots that are free to use. The
 	// gaps are always sorted lowest numbers first.
 	gaps sortedUniqueInts
 	tail uint64 // First free slot
+	// synced is the tail as of the last Sync, and created whether the file
+	// has been created since, see grownSinceSync.
+	synced  uint64
+	created bool
 
 	fileMu   sync.RWMutex // Mutex for file operations on 'f' (rw versus Close) and closed
-	f        *os.File     // The file backing the data
+	f        File         // The file backing the data
 	closed   bool
 	readonly bool
+	hdrSize  uint32         // Size of the item header
+	lenSize  uint32         // Size of the length field in the item header
+	seq      *uint64        // Database-wide sequence counter, nil unless enabled
+	strict   bool           // Whether Get should report deleted slots
+	checksum bool           // Whether the header ends with a CRC32 of the data
+	trailer  uint32         // Size of the tail length at the end of the slot, 0 if not stored
+	retries  int            // Number of retries of writes failing with transient errors
+	journal  *journal       // Write-ahead journal, nil unless enabled
+	maxGaps  int            // Max number of slots in the gap-list, 0 for no limit
+	eagerDel bool           // Whether Delete blanks the header on disk right away
+	wbuf     *writeBuffer   // Buffer for appended slots, nil unless enabled
+	direct   File           // The file opened for direct I/O, nil unless enabled
+	codecOff uint32         // Offset of the codec in the item header, 0 if not stored
+	codec    Codec          // Codec used by Put for this shelf
+	clock    *clock         // Source of the timestamps, nil unless enabled
+	timeOff  uint32         // Offset of the timestamp in the item header, 0 if not stored
+	sizes    *sizeHistogram // Sizes of the items written, nil unless enabled
+	fs       FS             // Filesystem the shelf is on
+	free     string         // Path of the saved gap-list, "" unless the values have a fixed size
+
+	// savedFree are the slots listed in the saved gap-list, see claimFree.
+	// It's protected by gapsMu.
+	savedFree sortedUniqueInts
+
+	// reserved are the slots reserved by reserveBlock, and not written or
+	// deleted since. Compact must leave them in place. It's protected by
+	// gapsMu.
+	reserved sortedUniqueInts
+
+	onGrow onShelfGrowFn // Optional callback invoked when the tail is extended
+
+	// dirtyMu protects dirty, the slots changed since the last Backup, nil
+	// unless a Backup has been made. It's obtained after the other locks.
+	dirtyMu sync.Mutex
+	dirty   map[uint64]bool
+
+	// unavailable is why the shelf could not be opened, for the
+	// placeholders of Options.SkipMissingShelves, which are closed.
+	unavailable error
+}
+
+// shelfConfig contains the settings of a shelf which are not derived from the
+// slot size.
+type shelfConfig struct {
+	readonly      bool
+	compactHeader bool          // Use a 2-byte item header, if the slot size permits
+	onGrow        onShelfGrowFn // Optional callback invoked when the tail is extended
+	strictDelete  bool          // Make Get return ErrDeleted for slots in the gap-list
+	skipScan      bool          // Don't compact or scan the shelf on open
+	seq           *uint64       // Sequence counter, if sequence numbers are enabled
+	clock         *clock        // Source of the timestamps, if timestamps are enabled
+	checksum      bool          // Store and verify a CRC32 of the data
+	tailLength    bool          // Repeat the item size at the end of the slot
+	retries       int           // Number of retries of writes failing with transient errors
+	journal       bool          // Journal slot writes, to redo torn writes on open
+	name          string        // File name of the shelf, defaults to the legacy name
+	maxGaps       int           // Max number of slots in the gap-list, 0 for no limit
+	tombstones    bool          // Make Delete blank the header on disk right away
+	codecs        bool          // Store the codec of every item in its header
+	codec         Codec         // Codec used by Put for this shelf
+	writeBuffer   int           // Size of the buffer for appended slots, 0 for none
+	mmap          bool          // Map the file into memory; requires readonly
+	files         *filePool     // Pool limiting the number of open files, nil for no limit
+	directIO      bool          // Iterate with direct I/O, where supported
+	onWarning     func(error)   // Optional callback for problems which are worked around
+	sizeHistogram bool          // Track the sizes of the items written
+	fixed         bool          // Store the values without item header, see Options.FixedValueSize
+	fs            FS            // Filesystem to open the shelf on, defaults to the OS one
 }
 
+// onShelfGrowFn is invoked when a Put extends the shelf.
+type onShelfGrowFn func(oldSlots, newSlots uint64)
+
 // openShelf opens a (new or existing) shelf with the given slot size.
 // If the shelf already exists, it's opened and read, which populates the
 // internal gap-list.
 // The onData callback is optional, and can be nil.
-func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool) (*shelf, error) {
+func openShelf(path string, slotSize uint32, onData onShelfDataFn, cfg shelfConfig) (*shelf, error) {
 	if slotSize < minSlotSize {
-		return nil, fmt.Errorf("slot size %d smaller than minimum (%d)", slotSize, minSlotSize)
+		return nil, fmt.Errorf("%w: %d smaller than minimum (%d)", ErrSlotTooSmall, slotSize, minSlotSize)
 	}
-	if finfo, err := os.Stat(path); err != nil {
+	fsys := cfg.fs
+	if fsys == nil {
+		fsys = osFS{}
+	}
+	if finfo, err := fsys.Stat(path); err != nil {
 		return nil, err
 	} else if !finfo.IsDir() {
-		return nil, fmt.Errorf("not a directory: '%v'", path)
+		return nil, fmt.Errorf("%w: '%v'", ErrNotDirectory, path)
 	}
 	var (
-		id     = fmt.Sprintf("bkt_%08d.bag", slotSize)
-		f      *os.File
-		err    error
-		nSlots uint64
+		id      = cfg.name
+		f       File
+		err     error
+		nSlots  uint64
+		created bool // Whether the file is new, see grownSinceSync
 	)
-	if readonly {
-		f, err = os.OpenFile(filepath.Join(path, fmt.Sprintf("%v", id)), os.O_RDONLY, 0666)
+	if id == "" {
+		id = legacyShelfName(slotSize)
+	}
+	openFile := fsys.OpenFile
+	if cfg.files != nil && !cfg.mmap {
+		openFile = func(name string, flag int, perm os.FileMode) (File, error) {
+			return cfg.files.open(fsys, name, flag, perm)
+		}
+	}
+	if cfg.readonly {
+		f, err = openFile(filepath.Join(path, fmt.Sprintf("%v", id)), os.O_RDONLY, 0666)
+		if err == nil && cfg.mmap {
+			var mapped File
+			if mapped, err = mapFile(f); err != nil {
+				f.Close()
+			}
+			f = mapped
+		}
 	} else {
-		f, err = os.OpenFile(filepath.Join(path, fmt.Sprintf("%v", id)), os.O_RDWR|os.O_CREATE, 0666)
+		_, statErr := fsys.Stat(filepath.Join(path, id))
+		created = errors.Is(statErr, os.ErrNotExist)
+		f, err = openFile(filepath.Join(path, fmt.Sprintf("%v", id)), os.O_RDWR|os.O_CREATE, 0666)
 	}
 	if err != nil {
 		return nil, err
 	}
+	var jrnl *journal
+	if cfg.journal && !cfg.readonly {
+		name := filepath.Join(path, strings.TrimSuffix(id, filepath.Ext(id))+".journal")
+		if jrnl, err = openJournal(fsys, name, f, slotSize); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
 	if stat, err := f.Stat(); err != nil {
 		return nil, err
 	} else {
@@ -89,7 +223,85 @@ func openShelf(path string, slotSize uint32, onData onShelfDataFn, readonly bool
 		slotSize: slotSize,
 		tail:     nSlots,
 		f:        f,
-		readonly: readonly,
+		readonly: cfg.readonly,
+		lenSize:  itemHeaderSize,
+		seq:      cfg.seq,
+		clock:    cfg.clock,
+		onGrow:   cfg.onGrow,
+		strict:   cfg.strictDelete,
+		checksum: cfg.checksum,
+		retries:  cfg.retries,
+		journal:  jrnl,
+		maxGaps:  cfg.maxGaps,
+		eagerDel: cfg.tombstones,
+		codec:    cfg.codec,
+		fs:       fsys,
+		synced:   nSlots,
+		created:  created,
+	}
+	if cfg.writeBuffer > 0 && !cfg.readonly && jrnl == nil {
+		sh.wbuf = &writeBuffer{limit: cfg.writeBuffer}
+	}
+	if cfg.directIO {
+		// Without direct I/O, the shelf still works, through the page
+		// cache.
+		direct, err := openDirect(fsys, filepath.Join(path, id))
+		if err != nil && cfg.onWarning != nil {
+			cfg.onWarning(fmt.Errorf("shelf %v: %w", id, err))
+		}
+		sh.direct = direct
+	}
+	if cfg.compactHeader && slotSize <= maxCompactSlotSize {
+		sh.lenSize = compactItemHeaderSize
+	}
+	if cfg.fixed {
+		sh.lenSize = 0
+		sh.free = filepath.Join(path, freeListName(id))
+	}
+	sh.hdrSize = sh.lenSize
+	if sh.seq != nil {
+		sh.hdrSize += seqSize
+	}
+	if cfg.codecs {
+		sh.codecOff = sh.hdrSize
+		sh.hdrSize += codecSize
+	}
+	if sh.clock != nil {
+		sh.timeOff = sh.hdrSize
+		sh.hdrSize += timestampSize
+	}
+	if sh.checksum {
+		sh.hdrSize += checksumSize
+	}
+	if cfg.tailLength {
+		sh.trailer = tailLengthSize
+	}
+	if slotSize <= sh.hdrSize+sh.trailer {
+		sh.closeFiles()
+		return nil, fmt.Errorf("%w: %d too small for header size %d", ErrSlotTooSmall, slotSize, sh.hdrSize+sh.trailer)
+	}
+	if cfg.sizeHistogram {
+		sh.sizes = newSizeHistogram(sh.capacity())
+	}
+	if sh.free != "" {
+		// Without headers, there is nothing to scan or compact.
+		if err := sh.loadFreeList(onData); err != nil {
+			sh.closeFiles()
+			return nil, err
+		}
+		return sh, nil
+	}
+	if cfg.skipScan {
+		// The gap-list stays empty, all slots below the tail are
+		// assumed to be in use. The sequence counter still needs to
+		// be brought up to date, though.
+		if sh.seq != nil {
+			if err := sh.iterateSeq(nil); err != nil {
+				sh.closeFiles()
+				return nil, err
+			}
+		}
+		return sh, nil
 	}
 	// Compact + iterate
 	sh.compact(onData)
@@ -108,8 +320,11 @@ func (s *shelf) Close() error {
 		return nil
 	}
 	s.closed = true
+	if s.direct != nil {
+		s.direct.Close()
+	}
 	if s.readonly {
-		return nil
+		return s.f.Close()
 	}
 	var err error
 	setErr := func(e error) {
@@ -117,64 +332,310 @@ func (s *shelf) Close() error {
 			err = e
 		}
 	}
+	// The buffer is flushed first, so it doesn't overwrite the blanked gaps.
+	setErr(s.flushHeld())
 	// Before closing the file, we overwrite all gaps with
 	// blank space in the headers. Later on, when opening, we can reconstruct the
-	// gaps by skimming through the slots and checking the headers.
-	hdr := make([]byte, 4)
-	for _, gap := range s.gaps {
-		_, e := s.f.WriteAt(hdr, int64(gap)*int64(s.slotSize))
-		setErr(e)
+	// gaps by skimming through the slots and checking the headers. Fixed-size
+	// values have no headers, their gap-list is saved instead.
+	if s.free != "" {
+		setErr(s.saveFreeList())
+	} else {
+		hdr := s.tombstone()
+		for _, gap := range s.gaps {
+			_, e := s.f.WriteAt(hdr, int64(gap)*int64(s.slotSize))
+			setErr(e)
+		}
 	}
 	s.gaps = s.gaps[:0]
 	setErr(s.f.Sync())
 	setErr(s.f.Close())
+	if s.journal != nil {
+		setErr(s.journal.Close())
+	}
 	return err
 }
 
+// unavailableShelf returns a placeholder for a shelf which could not be opened,
+// see Options.SkipMissingShelves. It holds no items, and its operations fail
+// with the given error.
+func unavailableShelf(slotSize, hdrSize uint32, err error) *shelf {
+	return &shelf{
+		id:          legacyShelfName(slotSize),
+		slotSize:    slotSize,
+		hdrSize:     hdrSize,
+		closed:      true,
+		unavailable: err,
+	}
+}
+
+// errClosed returns the error for operations on the shelf once it's closed:
+// ErrClosed, or for a placeholder, why it's unavailable.
+func (s *shelf) errClosed() error {
+	if s.unavailable != nil {
+		return s.unavailable
+	}
+	return ErrClosed
+}
+
+// grownSinceSync reports whether the shelf file has been created or extended
+// since the previous call, which is made by the database on Sync.
+func (s *shelf) grownSinceSync() bool {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	grown := s.created || s.tail > s.synced
+	s.created, s.synced = false, s.tail
+	return grown
+}
+
+// Sync flushes the shelf file to disk, and saves the gap-list of fixed-size
+// values.
+func (s *shelf) Sync() error {
+	if s.free != "" {
+		s.gapsMu.Lock()
+		defer s.gapsMu.Unlock()
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	if s.readonly {
+		return nil
+	}
+	if err := s.flushHeld(); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	return s.saveFreeList()
+}
+
+// closeFiles closes the shelf file and the journal, if any, without any of the
+// cleanup done by Close. It's used when opening the shelf fails.
+func (s *shelf) closeFiles() {
+	s.f.Close()
+	if s.direct != nil {
+		s.direct.Close()
+	}
+	if s.journal != nil {
+		s.journal.Close()
+	}
+}
+
+// ShrinkTail truncates the backing file down to the high-water mark, and
+// returns the number of bytes freed. Slots below the high-water mark are not
+// touched.
+func (s *shelf) ShrinkTail() (uint64, error) {
+	if s.readonly {
+		return 0, ErrReadOnly
+	}
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.Lock()
+	defer s.fileMu.Unlock()
+	if s.closed {
+		return 0, s.errClosed()
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		have = uint64(stat.Size())
+		want = s.tail * uint64(s.slotSize)
+	)
+	if have <= want {
+		return 0, nil
+	}
+	if err := s.f.Truncate(int64(want)); err != nil {
+		return 0, err
+	}
+	return have - want, nil
+}
+
+// capacity returns the largest item that fits in a slot of this shelf.
+func (s *shelf) capacity() uint32 {
+	return s.slotSize - s.hdrSize - s.trailer
+}
+
+// getSize decodes the item size from the header in buf.
+func (s *shelf) getSize(buf []byte) uint32 {
+	if s.lenSize == 0 {
+		return s.slotSize // Fixed-size values fill the slot
+	}
+	if s.lenSize == compactItemHeaderSize {
+		return uint32(binary.BigEndian.Uint16(buf))
+	}
+	return binary.BigEndian.Uint32(buf)
+}
+
+// putSize encodes the item size into the header in buf.
+func (s *shelf) putSize(buf []byte, size uint32) {
+	if s.lenSize == 0 {
+		return
+	}
+	if s.lenSize == compactItemHeaderSize {
+		binary.BigEndian.PutUint16(buf, uint16(size))
+		return
+	}
+	binary.BigEndian.PutUint32(buf, size)
+}
+
+// getSeq decodes the sequence number from the header in buf, and bumps the
+// sequence counter past it.
+func (s *shelf) getSeq(buf []byte) uint64 {
+	seq := binary.BigEndian.Uint64(buf[s.lenSize:])
+	for {
+		cur := atomic.LoadUint64(s.seq)
+		if cur >= seq || atomic.CompareAndSwapUint64(s.seq, cur, seq) {
+			return seq
+		}
+	}
+}
+
 // Update overwrites the existing data at the given slot. This operation is more
 // efficient than Delete + Put, since it does not require managing slot availability
 // but instead just overwrites in-place.
 func (s *shelf) Update(data []byte, slot uint64) error {
-	if s.readonly {
-		return ErrReadonly
+	return s.UpdateCodec(data, CodecNone, slot)
+}
+
+// UpdateCodec is like Update, but records that the data is encoded with the
+// given codec.
+func (s *shelf) UpdateCodec(data []byte, codec Codec, slot uint64) error {
+	if err := s.checkWrite(data, codec); err != nil {
+		return err
 	}
-	// Validations
-	if len(data) == 0 {
-		return ErrEmptyData
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+	return s.writeFile(data, codec, slot)
+}
+
+// Swap overwrites the data at the given slot, like UpdateCodec, and returns the
+// data it held before, decompressed. The shelf is locked exclusively in
+// between, so no other write to the slot can interleave. If the old data can't
+// be read, nothing is written.
+func (s *shelf) Swap(data []byte, codec Codec, slot uint64) ([]byte, error) {
+	if err := s.checkWrite(data, codec); err != nil {
+		return nil, err
 	}
-	if have, max := uint32(len(data)+itemHeaderSize), s.slotSize; have > max {
-		return ErrOversized
+	if s.strict && s.isGap(slot) {
+		return nil, fmt.Errorf("%w: shelf %d, slot %d", ErrDeleted, s.slotSize, slot)
 	}
-	return s.writeFile(data, slot)
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	old, oldCodec, err := s.readFile(slot)
+	if err != nil {
+		return nil, err
+	}
+	if old, err = oldCodec.decompress(old); err != nil {
+		return nil, fmt.Errorf("shelf %d, slot %d: %w", s.slotSize, slot, err)
+	}
+	if err := s.writeFile(data, codec, slot); err != nil {
+		return nil, err
+	}
+	return old, nil
 }
 
 // Put writes the given data and returns a slot identifier. The caller may
 // modify the data after this method returns.
 func (s *shelf) Put(data []byte) (uint64, error) {
+	return s.PutCodec(data, CodecNone)
+}
+
+// PutCodec is like Put, but records that the data is encoded with the given
+// codec.
+func (s *shelf) PutCodec(data []byte, codec Codec) (uint64, error) {
+	if err := s.checkWrite(data, codec); err != nil {
+		return 0, err
+	}
+	// Find a free slot
+	s.compactMu.RLock()
+	slot, grown, err := s.getSlot()
+	if err == nil {
+		err = s.writeFile(data, codec, slot)
+	}
+	s.compactMu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if grown && s.onGrow != nil {
+		s.onGrow(slot, slot+1)
+	}
+	return slot, nil
+}
+
+// PutAt writes the data into the given slot, which is taken out of the
+// gap-list. A slot beyond the tail extends the shelf, and the slots skipped
+// over become gaps. A slot in use is overwritten.
+func (s *shelf) PutAt(data []byte, codec Codec, slot uint64) error {
+	if err := s.checkWrite(data, codec); err != nil {
+		return err
+	}
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+	s.gapsMu.Lock()
+	if err := s.claimFree(slot, 1); err != nil {
+		s.gapsMu.Unlock()
+		return err
+	}
+	oldTail := s.tail
+	s.reserved.Remove(slot)
+	if slot < s.tail {
+		s.gaps.Remove(slot)
+	} else {
+		for gap := s.tail; gap < slot; gap++ {
+			if s.maxGaps > 0 && len(s.gaps) >= s.maxGaps {
+				// Left untracked; the file is extended with blank
+				// slots, which the compaction on open reclaims.
+				break
+			}
+			s.gaps.Append(gap)
+		}
+		s.tail = slot + 1
+	}
+	newTail := s.tail
+	s.gapsMu.Unlock()
+	if err := s.writeFile(data, codec, slot); err != nil {
+		return err
+	}
+	if newTail > oldTail && s.onGrow != nil {
+		s.onGrow(oldTail, newTail)
+	}
+	return nil
+}
+
+// checkWrite validates data to be written with the given codec.
+func (s *shelf) checkWrite(data []byte, codec Codec) error {
 	if s.readonly {
-		return 0, ErrReadonly
+		return ErrReadOnly
 	}
-	// Validations
 	if len(data) == 0 {
-		return 0, ErrEmptyData
+		return ErrEmptyData
 	}
-	if have, max := uint32(len(data)+itemHeaderSize), s.slotSize; have > max {
-		return 0, ErrOversized
+	if s.free != "" && uint32(len(data)) != s.slotSize {
+		return fmt.Errorf("%w: %d bytes, values have %d", ErrWrongSize, len(data), s.slotSize)
 	}
-	// Find a free slot
-	slot := s.getSlot()
-	if err := s.writeFile(data, slot); err != nil {
-		return 0, err
+	if uint32(len(data)) > s.capacity() {
+		return ErrOversized
 	}
-	return slot, nil
+	if codec != CodecNone && s.codecOff == 0 {
+		return fmt.Errorf("%w: compression not enabled", ErrInvalidOptions)
+	}
+	return nil
 }
 
 // Delete marks the data at the given slot of deletion.
 // Delete does not touch the disk. When the shelf is Close():d, any remaining
 // gaps will be marked as such in the backing file.
+// If the gap-list is full, the slot is instead marked as deleted on disk right
+// away, and not reused until the shelf is compacted on open. With tombstones,
+// the slot is marked as deleted on disk as well as added to the gap-list.
 func (s *shelf) Delete(slot uint64) error {
 	if s.readonly {
-		return ErrReadonly
+		return ErrReadOnly
 	}
 	// Mark gap
 	s.gapsMu.Lock()
@@ -183,6 +644,11 @@ func (s *shelf) Delete(slot uint64) error {
 	if slot >= s.tail {
 		return fmt.Errorf("%w: shelf %d, slot %d, tail %d", ErrBadIndex, s.slotSize, slot, s.tail)
 	}
+	s.markDirty(slot)
+	s.reserved.Remove(slot)
+	if s.maxGaps > 0 && len(s.gaps) >= s.maxGaps && !s.gaps.Contains(slot) {
+		return s.clearSlot(slot)
+	}
 	// We try to keep writes going to the early parts of the file, to have the
 	// possibility of trimming the file when/if the tail becomes unused.
 	s.gaps.Append(slot)
@@ -193,7 +659,7 @@ func (s *shelf) Delete(slot uint64) error {
 		if s.closed {
 			// Undo (not really important, but correct) and back out again
 			s.gaps = s.gaps[:0]
-			return ErrClosed
+			return s.errClosed()
 		}
 		for len(s.gaps) > 0 && s.tail == s.gaps.Last() {
 			s.gaps = s.gaps[:len(s.gaps)-1]
@@ -202,78 +668,379 @@ func (s *shelf) Delete(slot uint64) error {
 		if err := s.f.Truncate(int64(s.tail * uint64(s.slotSize))); err != nil {
 			return err
 		}
+		return nil
+	}
+	if s.eagerDel {
+		// The gap-list lock is still held, so that the slot can't be
+		// reused before the header is blanked.
+		return s.clearSlot(slot)
 	}
 	return nil
 }
 
+// clearSlot blanks the header of the given slot on disk, which marks it as
+// deleted for the compaction on open.
+func (s *shelf) clearSlot(slot uint64) error {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	hdr := s.tombstone()
+	if s.bufferPatch(hdr, slot) {
+		return nil
+	}
+	return withRetry(s.retries, func() error {
+		_, err := s.f.WriteAt(hdr, int64(slot)*int64(s.slotSize))
+		return err
+	})
+}
+
+// tombstoneMark follows the blank header of a deleted slot, see tombstone.
+const tombstoneMark = 0xde
+
+// tombstone returns what is written over the start of a deleted slot: a blank
+// header, which the scan on open recognizes as a free slot, followed by
+// tombstoneMark, by which Get tells deleted slots from ones never written to.
+// Every slot has room for at least one byte of data, so the mark always fits.
+func (s *shelf) tombstone() []byte {
+	buf := make([]byte, s.hdrSize+1)
+	buf[s.hdrSize] = tombstoneMark
+	return buf
+}
+
 // Get returns the data at the given slot. If the slot has been deleted, the returndata
 // this method is undefined: it may return the original data, or some newer data
 // which has been written into the slot after Delete was called.
+// In strict mode, Get returns ErrDeleted for slots which are in the gap-list.
+// Otherwise, it returns ErrDeleted once the slot has been marked as deleted on
+// disk, which is on Close, or right away with DeleteTombstone. For slots
+// beyond the tail, and slots no item has been written to, it returns
+// ErrNeverWritten.
 func (s *shelf) Get(slot uint64) ([]byte, error) {
-	data, err := s.readFile(slot)
+	if s.strict && s.isGap(slot) {
+		return nil, fmt.Errorf("%w: shelf %d, slot %d", ErrDeleted, s.slotSize, slot)
+	}
+	data, codec, err := s.readFile(slot)
 	if err != nil {
-		return nil, fmt.Errorf("%w: %v", ErrBadIndex, err)
+		return nil, err
+	}
+	if data, err = codec.decompress(data); err != nil {
+		return nil, fmt.Errorf("shelf %d, slot %d: %w", s.slotSize, slot, err)
 	}
 	return data, nil
 }
 
-func (s *shelf) readFile(slot uint64) ([]byte, error) {
+// getCodec decodes the codec from the header in buf.
+func (s *shelf) getCodec(buf []byte) Codec {
+	if s.codecOff == 0 {
+		return CodecNone
+	}
+	return Codec(buf[s.codecOff])
+}
+
+// decodeItem returns the data of the item in buf, which holds a slot with the
+// given item size, decompressed if needed. It's used by the iterations, which
+// have no way to report errors, so items which fail to decompress are passed
+// on as stored.
+func (s *shelf) decodeItem(buf []byte, size uint32) []byte {
+	data := buf[s.hdrSize : s.hdrSize+size]
+	if codec := s.getCodec(buf); codec != CodecNone {
+		if dec, err := codec.decompress(data); err == nil {
+			return dec
+		}
+	}
+	return data
+}
+
+// Len returns the size of the data at the given slot, reading only the item
+// header.
+func (s *shelf) Len(slot uint64) (uint32, error) {
+	if s.strict && s.isGap(slot) {
+		return 0, fmt.Errorf("%w: shelf %d, slot %d", ErrDeleted, s.slotSize, slot)
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return 0, s.errClosed()
+	}
+	hdr := make([]byte, s.hdrSize)
+	if _, err := s.readSlot(hdr, slot); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	size := s.getSize(hdr)
+	if size > s.capacity() {
+		return 0, fmt.Errorf("%w: shelf %d, slot %d, size %d", ErrCorruptHeader, s.slotSize, slot, size)
+	}
+	return size, nil
+}
+
+// Timestamp returns the time the data at the given slot was written, in
+// nanoseconds since the Unix epoch, reading only the item header.
+func (s *shelf) Timestamp(slot uint64) (int64, error) {
+	if s.strict && s.isGap(slot) {
+		return 0, fmt.Errorf("%w: shelf %d, slot %d", ErrDeleted, s.slotSize, slot)
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return 0, s.errClosed()
+	}
+	hdr := make([]byte, s.hdrSize)
+	if _, err := s.readSlot(hdr, slot); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
+	}
+	return int64(binary.BigEndian.Uint64(hdr[s.timeOff:])), nil
+}
+
+// readFile reads the data stored at the given slot, and the codec it's encoded
+// with.
+func (s *shelf) readFile(slot uint64) ([]byte, Codec, error) {
 	// We're read-locking this to prevent the file from being closed while we're
 	// reading from it
+	if _, tail := s.slotCounts(); slot >= tail {
+		return nil, 0, fmt.Errorf("%w: shelf %d, slot %d", ErrNeverWritten, s.slotSize, slot)
+	}
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
 	if s.closed {
-		return nil, ErrClosed
+		return nil, 0, s.errClosed()
 	}
-	offset := int64(slot) * int64(s.slotSize)
 	// Read the entire slot at once -- this might mean we read a bit more
 	// than strictly necessary, but it saves us one syscall.
 	slotData := make([]byte, s.slotSize)
-	_, err := s.f.ReadAt(slotData, offset)
-	if err != nil {
-		return nil, err
+	if n, err := s.readSlot(slotData, slot); err == io.EOF && n == 0 {
+		// Reserved by a Put, but not written yet
+		return nil, 0, fmt.Errorf("%w: shelf %d, slot %d", ErrNeverWritten, s.slotSize, slot)
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrBadIndex, err)
 	}
-	// Check data size
-	itemSize := binary.BigEndian.Uint32(slotData)
-	if itemHeaderSize+itemSize >= uint32(s.slotSize) {
-		return nil, ErrCorruptData
+	// Check data size. This must not be computed as hdrSize+itemSize, which
+	// could overflow for a corrupt header.
+	itemSize := s.getSize(slotData)
+	if itemSize == 0 {
+		if slotData[s.hdrSize] == tombstoneMark {
+			return nil, 0, fmt.Errorf("%w: shelf %d, slot %d", ErrDeleted, s.slotSize, slot)
+		}
+		return nil, 0, fmt.Errorf("%w: shelf %d, slot %d", ErrNeverWritten, s.slotSize, slot)
+	}
+	if itemSize > s.capacity() {
+		return nil, 0, fmt.Errorf("%w: shelf %d, slot %d, size %d", ErrCorruptHeader, s.slotSize, slot, itemSize)
+	}
+	if s.trailer != 0 {
+		if tail := binary.BigEndian.Uint32(slotData[s.slotSize-tailLengthSize:]); tail != itemSize {
+			return nil, 0, fmt.Errorf("%w: shelf %d, slot %d, size %d, tail length %d", ErrTornWrite, s.slotSize, slot, itemSize, tail)
+		}
 	}
-	return slotData[itemHeaderSize : itemHeaderSize+itemSize], nil
+	data := slotData[s.hdrSize : s.hdrSize+itemSize]
+	if s.checksum {
+		want := binary.BigEndian.Uint32(slotData[s.hdrSize-checksumSize:])
+		if have := crc32.ChecksumIEEE(data); have != want {
+			return nil, 0, fmt.Errorf("%w: shelf %d, slot %d", ErrChecksumMismatch, s.slotSize, slot)
+		}
+	}
+	return data, s.getCodec(slotData), nil
 }
 
-func (s *shelf) writeFile(data []byte, slot uint64) error {
+func (s *shelf) writeFile(data []byte, codec Codec, slot uint64) error {
 	// We're read-locking this to prevent the file from being closed while we're
 	// writing to it
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
 	if s.closed {
-		return ErrClosed
+		return s.errClosed()
 	}
 	buf := make([]byte, s.slotSize)
 	// Write header
-	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	s.putSize(buf, uint32(len(data)))
+	if s.seq != nil {
+		binary.BigEndian.PutUint64(buf[s.lenSize:], atomic.AddUint64(s.seq, 1))
+	}
+	if s.codecOff != 0 {
+		buf[s.codecOff] = byte(codec)
+	}
+	if s.clock != nil {
+		binary.BigEndian.PutUint64(buf[s.timeOff:], uint64(s.clock.now()))
+	}
+	if s.checksum {
+		binary.BigEndian.PutUint32(buf[s.hdrSize-checksumSize:], crc32.ChecksumIEEE(data))
+	}
+	if s.trailer != 0 {
+		binary.BigEndian.PutUint32(buf[s.slotSize-tailLengthSize:], uint32(len(data)))
+	}
 	// Write data
-	copy(buf[itemHeaderSize:], data)
-	if _, err := s.f.WriteAt(buf, int64(slot)*int64(s.slotSize)); err != nil {
+	copy(buf[s.hdrSize:], data)
+	s.markDirty(slot)
+	if s.sizes != nil {
+		s.sizes.add(uint32(len(data)))
+	}
+	write := func() error {
+		_, err := s.f.WriteAt(buf, int64(slot)*int64(s.slotSize))
 		return err
 	}
-	return nil
+	if s.wbuf != nil {
+		if buffered, err := s.bufferWrite(buf, slot); buffered || err != nil {
+			return err
+		}
+	}
+	if s.journal == nil {
+		return withRetry(s.retries, write)
+	}
+	return s.journal.write(slot, buf, s.retries, func() error {
+		if err := withRetry(s.retries, write); err != nil {
+			return err
+		}
+		return s.f.Sync()
+	})
 }
 
-func (s *shelf) getSlot() uint64 {
-	var slot uint64
+// getSlot reserves a slot for writing, and reports whether the tail had to be
+// extended to do so. The lowest slot in the gap-list is used first, which keeps
+// the key assignment deterministic, and writes towards the start of the file.
+func (s *shelf) getSlot() (uint64, bool, error) {
 	// Locate the first free slot
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
 	if nGaps := s.gaps.Len(); nGaps > 0 {
-		slot = s.gaps[0]
+		slot := s.gaps[0]
+		if err := s.claimFree(slot, 1); err != nil {
+			return 0, false, err
+		}
 		s.gaps = s.gaps[1:]
-		return slot
+		return slot, false, nil
 	}
 	// No gaps available: Expand the tail
-	slot = s.tail
+	slot := s.tail
+	if err := s.claimFree(slot, 1); err != nil {
+		return 0, false, err
+	}
 	s.tail++
-	return slot
+	return slot, true, nil
+}
+
+// reserveBlock extends the tail by count slots, and returns the first of them.
+// The file is extended as well, so that it's not shorter than the shelf.
+func (s *shelf) reserveBlock(count uint64) (uint64, error) {
+	s.gapsMu.Lock()
+	first := s.tail
+	if err := s.claimFree(first, count); err != nil {
+		s.gapsMu.Unlock()
+		return 0, err
+	}
+	if err := s.extendFile(first + count); err != nil {
+		s.gapsMu.Unlock()
+		return 0, err
+	}
+	s.tail += count
+	for slot := first; slot < s.tail; slot++ {
+		s.reserved = append(s.reserved, slot)
+	}
+	s.gapsMu.Unlock()
+	if s.onGrow != nil {
+		s.onGrow(first, first+count)
+	}
+	return first, nil
+}
+
+// extendFile makes the file at least as long as the given number of slots. The
+// caller must hold gapsMu.
+func (s *shelf) extendFile(slots uint64) error {
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	stat, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if size := int64(slots) * int64(s.slotSize); stat.Size() < size {
+		return s.f.Truncate(size)
+	}
+	return nil
+}
+
+// isGap returns true if the given slot is in the gap-list.
+func (s *shelf) isGap(slot uint64) bool {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	return s.gaps.Contains(slot)
+}
+
+// isLive reports whether the slot is below the high-water mark, and not in the
+// gap-list.
+func (s *shelf) isLive(slot uint64) bool {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	return slot < s.tail && !s.gaps.Contains(slot)
+}
+
+// slotCounts returns the number of gaps and the high-water mark (the total
+// number of slots, including gaps).
+func (s *shelf) slotCounts() (gaps, tail uint64) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	return uint64(len(s.gaps)), s.tail
+}
+
+// freeSlotsChunk is the number of free slots copied per lock acquisition by
+// freeSlots.
+const freeSlotsChunk = 1024
+
+// freeSlots invokes fn with the slots in the gap-list, in increasing order,
+// until fn returns false. The gap-list is copied in chunks, and fn is called
+// without holding the lock, so the result is not a consistent snapshot if the
+// shelf is modified concurrently.
+func (s *shelf) freeSlots(fn func(slot uint32) bool) {
+	var (
+		chunk = make([]uint64, 0, freeSlotsChunk)
+		next  uint64 // Lowest slot not yet visited
+	)
+	for {
+		s.gapsMu.Lock()
+		i := sort.Search(len(s.gaps), func(i int) bool { return s.gaps[i] >= next })
+		end := i + freeSlotsChunk
+		if end > len(s.gaps) {
+			end = len(s.gaps)
+		}
+		chunk = append(chunk[:0], s.gaps[i:end]...)
+		s.gapsMu.Unlock()
+
+		if len(chunk) == 0 {
+			return
+		}
+		for _, slot := range chunk {
+			if !fn(uint32(slot)) {
+				return
+			}
+		}
+		next = chunk[len(chunk)-1] + 1
+	}
+}
+
+// liveRange returns the lowest and highest slot in use, or ok=false if the
+// shelf is empty.
+func (s *shelf) liveRange() (lo, hi uint64, ok bool) {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	// The gaps are sorted, so the lowest live slot is the first one not
+	// matched by a gap counting up from zero, and vice versa for the highest.
+	for _, gap := range s.gaps {
+		if gap != lo {
+			break
+		}
+		lo++
+	}
+	if lo >= s.tail {
+		return 0, 0, false
+	}
+	hi = s.tail - 1
+	for i := len(s.gaps) - 1; i >= 0 && s.gaps[i] >= hi; i-- {
+		if s.gaps[i] == hi {
+			hi--
+		}
+	}
+	return lo, hi, true
 }
 
 // onShelfDataFn is used to iterate the entire dataset in the shelf.
@@ -281,63 +1048,333 @@ func (s *shelf) getSlot() uint64 {
 // the iterator, so it needs to be copied if it is to be used later.
 type onShelfDataFn func(slot uint64, data []byte)
 
+// Iterate invokes onData for every item in the shelf. The high-water mark and
+// the gap-list are snapshotted when the iteration starts, so concurrent writers
+// are not blocked: items added after that point are not visited, and a slot
+// which is concurrently being reused may be visited with either its old or its
+// new content.
 func (s *shelf) Iterate(onData onShelfDataFn) {
+	s.iterateOrdered(0, ^uint64(0), false, onData)
+}
+
+// IterateReverse is like Iterate, but visits the slots from the high-water mark
+// down to zero.
+func (s *shelf) IterateReverse(onData onShelfDataFn) {
+	s.iterateOrdered(0, ^uint64(0), true, onData)
+}
+
+// IterateSlots is like Iterate, but only visits the slots in [first, last].
+func (s *shelf) IterateSlots(first, last uint64, onData onShelfDataFn) {
+	s.iterateOrdered(first, last, false, onData)
+}
 
+// iterateOrdered implements Iterate, IterateReverse and IterateSlots.
+func (s *shelf) iterateOrdered(first, last uint64, reverse bool, onData onShelfDataFn) {
+	s.gapsMu.Lock()
+	var (
+		end  = s.tail
+		gaps = append(sortedUniqueInts(nil), s.gaps...)
+	)
+	s.gapsMu.Unlock()
+	if last < end {
+		end = last + 1
+	}
+	if first >= end {
+		return
+	}
+	newGaps := s.iterate(first, end, gaps, reverse, onData)
+	if len(newGaps) == 0 {
+		return
+	}
+	// The file lock has been released by now, since gapsMu must always be
+	// obtained before fileMu.
 	s.gapsMu.Lock()
 	defer s.gapsMu.Unlock()
+	for _, g := range newGaps {
+		s.gaps.Append(g)
+	}
+}
 
+// iterate scans the slots in [first, end), in ascending order unless reverse is
+// set, skipping the given gaps, and returns the slots which were found to be
+// empty.
+func (s *shelf) iterate(first, end uint64, gaps sortedUniqueInts, reverse bool, onData onShelfDataFn) []uint64 {
 	s.fileMu.RLock()
 	defer s.fileMu.RUnlock()
 	if s.closed {
-		return
+		return nil
 	}
 
 	buf := make([]byte, s.slotSize)
+	if s.direct != nil {
+		buf = alignedBuffer(int(s.slotSize))
+	}
 	var (
 		nextGap = uint64(0xffffffffffffffff)
-		gapIdx  = 0
+		gapIdx  = sort.Search(len(gaps), func(i int) bool { return gaps[i] >= first })
+		step    = 1
 	)
-
-	if s.gaps.Len() > 0 {
-		nextGap = s.gaps[0]
+	if reverse {
+		gapIdx = sort.Search(len(gaps), func(i int) bool { return gaps[i] >= end }) - 1
+		step = -1
+	}
+	if gapIdx >= 0 && gapIdx < len(gaps) {
+		nextGap = gaps[gapIdx]
 	}
 	var newGaps []uint64
-	for slot := uint64(0); slot < s.tail; slot++ {
+	for i := first; i < end; i++ {
+		slot := i
+		if reverse {
+			slot = end - 1 - (i - first)
+		}
 		if slot == nextGap {
 			// We've reached a gap. Skip it
-			gapIdx++
-			if gapIdx < len(s.gaps) {
-				nextGap = s.gaps[gapIdx]
+			gapIdx += step
+			if gapIdx >= 0 && gapIdx < len(gaps) {
+				nextGap = gaps[gapIdx]
 			} else {
 				nextGap = 0xffffffffffffffff
 			}
 			continue
 		}
-		n, _ := s.f.ReadAt(buf, int64(slot)*int64(s.slotSize))
-		if n < itemHeaderSize {
-			panic(fmt.Sprintf("too short, need %d bytes, got %d", itemHeaderSize, n))
+		n, _ := s.readSlotDirect(buf, slot)
+		if n < int(s.hdrSize) {
+			// The slot has been reserved by a concurrent Put, but not
+			// written yet.
+			continue
 		}
-		blobLen := binary.BigEndian.Uint32(buf)
+		blobLen := s.getSize(buf)
 		if blobLen == 0 {
 			// Here's an item which has been deleted, but not marked as a gap.
-			// Mark it now
-			newGaps = append(newGaps, slot)
+			// In read-write mode, this may also be a slot which a concurrent
+			// Put has reserved but not yet written, so it's only marked as a
+			// gap in read-only mode.
+			if s.readonly {
+				newGaps = append(newGaps, slot)
+			}
 			continue
 		}
 		if onData == nil {
 			// onData can be nil, it's used on 'Open' to reconstruct the gaps
 			continue
 		}
-		if blobLen+uint32(itemHeaderSize) > uint32(n) {
-			panic(fmt.Sprintf("too short, need %d bytes, got %d", blobLen+itemHeaderSize, n))
+		if blobLen > uint32(n)-s.hdrSize {
+			panic(fmt.Sprintf("too short, need %d bytes, got %d", uint64(blobLen)+uint64(s.hdrSize), n))
 		}
-		onData(slot, buf[itemHeaderSize:itemHeaderSize+blobLen])
+		onData(slot, s.decodeItem(buf, blobLen))
 	}
-	for _, g := range newGaps {
-		s.gaps.Append(g)
+	return newGaps
+}
+
+// IterateGaps invokes onData for every slot in the gap-list, with whatever
+// content the slot currently holds. If the header still holds a plausible size,
+// only that many bytes are passed, otherwise the entire slot after the header.
+// The gap-list is snapshotted when the iteration starts.
+func (s *shelf) IterateGaps(onData onShelfDataFn) {
+	s.gapsMu.Lock()
+	gaps := append(sortedUniqueInts(nil), s.gaps...)
+	s.gapsMu.Unlock()
+
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return
+	}
+	buf := make([]byte, s.slotSize)
+	for _, slot := range gaps {
+		n, _ := s.readSlot(buf, slot)
+		if n < int(s.hdrSize) {
+			continue
+		}
+		data := buf[s.hdrSize:n]
+		if size := s.getSize(buf); size > 0 && size <= uint32(len(data)) {
+			data = data[:size]
+		}
+		onData(slot, data)
 	}
 }
 
+// scrub verifies the checksum of every slot in use, and invokes onBad for those
+// which fail, or whose header is corrupt. Slots which are reserved but not yet
+// written are skipped. It stops early if the context is cancelled.
+func (s *shelf) scrub(ctx context.Context, onBad func(slot uint64)) error {
+	s.gapsMu.Lock()
+	var (
+		tail = s.tail
+		gaps = append(sortedUniqueInts(nil), s.gaps...)
+	)
+	s.gapsMu.Unlock()
+
+	for slot := uint64(0); slot < tail; slot++ {
+		if slot%1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if gaps.Contains(slot) {
+			continue
+		}
+		_, _, err := s.readFile(slot)
+		switch {
+		case err == nil, errors.Is(err, ErrBadIndex), errors.Is(err, ErrDeleted):
+		case errors.Is(err, ErrCorruptData):
+			onBad(slot)
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// warmupChunkSize is the size of the reads done by Warmup.
+const warmupChunkSize = 1024 * 1024
+
+// Warmup reads the shelf file, up to the tail, in large sequential chunks to
+// pull it into the OS page cache. The file lock is released between chunks, so
+// other operations are not blocked for the whole duration.
+func (s *shelf) Warmup(ctx context.Context) error {
+	s.gapsMu.Lock()
+	end := int64(s.tail) * int64(s.slotSize)
+	s.gapsMu.Unlock()
+
+	buf := make([]byte, warmupChunkSize)
+	for off := int64(0); off < end; off += warmupChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.fileMu.RLock()
+		if s.closed {
+			s.fileMu.RUnlock()
+			return s.errClosed()
+		}
+		n := end - off
+		if n > warmupChunkSize {
+			n = warmupChunkSize
+		}
+		// The last slot may not be fully written, so a short read is fine
+		_, err := s.f.ReadAt(buf[:n], off)
+		s.fileMu.RUnlock()
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterateSeq reads the header of every slot below the tail, and invokes onSeq
+// (if non-nil) with the sequence number of every non-empty slot. As a side
+// effect, the sequence counter is bumped past all sequence numbers found.
+func (s *shelf) iterateSeq(onSeq func(slot, seq uint64)) error {
+	return s.iterateHeaders(func(slot uint64, hdr []byte) {
+		seq := s.getSeq(hdr)
+		if onSeq != nil {
+			onSeq(slot, seq)
+		}
+	})
+}
+
+// iterateHeaders invokes onHeader with the item header of every item in the
+// shelf, in slot order. The header is overwritten after onHeader returns.
+func (s *shelf) iterateHeaders(onHeader func(slot uint64, hdr []byte)) error {
+	s.gapsMu.Lock()
+	var (
+		tail = s.tail
+		gaps = append(sortedUniqueInts(nil), s.gaps...)
+	)
+	s.gapsMu.Unlock()
+
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	hdr := make([]byte, s.hdrSize)
+	for slot := uint64(0); slot < tail; slot++ {
+		if gaps.Contains(slot) {
+			continue
+		}
+		if _, err := s.readSlot(hdr, slot); err != nil {
+			// Reserved by a concurrent Put, but not written yet
+			continue
+		}
+		if s.getSize(hdr) == 0 {
+			continue
+		}
+		onHeader(slot, hdr)
+	}
+	return nil
+}
+
+// scanGaps reads the header of every slot below the tail, and adds the empty
+// ones to the gap-list. Unlike compact, it does not move any data around.
+func (s *shelf) scanGaps() error {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	hdr := make([]byte, s.hdrSize)
+	for slot := uint64(0); slot < s.tail; slot++ {
+		if _, err := s.readSlot(hdr, slot); err != nil {
+			return err
+		}
+		if s.getSize(hdr) == 0 && (s.maxGaps == 0 || len(s.gaps) < s.maxGaps) {
+			s.gaps.Append(slot)
+		}
+	}
+	return nil
+}
+
+// scanChunkSlots is the number of slots scanned by scanGapsLive between
+// checking for cancellation and updating the gap-list.
+const scanChunkSlots = 4096
+
+// scanGapsLive is like scanGaps, but only locks the shelf briefly for every
+// slot, so the shelf can be used meanwhile. The free slots found are added to
+// the gap-list a chunk at a time, and take part in Put and Delete from then
+// on. It stops early, without an error, once stop is closed.
+func (s *shelf) scanGapsLive(stop <-chan struct{}) error {
+	var (
+		_, end = s.slotCounts()
+		hdr    = make([]byte, s.hdrSize)
+		free   []uint64
+	)
+	for first := uint64(0); first < end; first += scanChunkSlots {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		free = free[:0]
+		for slot := first; slot < first+scanChunkSlots && slot < end; slot++ {
+			s.fileMu.RLock()
+			if s.closed {
+				s.fileMu.RUnlock()
+				return s.errClosed()
+			}
+			_, err := s.readSlot(hdr, slot)
+			s.fileMu.RUnlock()
+			if err != nil {
+				return err
+			}
+			if s.getSize(hdr) == 0 {
+				free = append(free, slot)
+			}
+		}
+		s.gapsMu.Lock()
+		for _, slot := range free {
+			// The tail may have been truncated meanwhile, by a Delete.
+			if slot < s.tail && (s.maxGaps == 0 || len(s.gaps) < s.maxGaps) {
+				s.gaps.Append(slot)
+			}
+		}
+		s.gapsMu.Unlock()
+	}
+	return nil
+}
+
 // compact moves data 'up' to fill gaps, and truncates the file afterwards.
 // This operation must only be performed during the opening of the shelf.
 func (s *shelf) compact(onData onShelfDataFn) {
@@ -352,10 +1389,14 @@ func (s *shelf) compact(onData onShelfDataFn) {
 	// The data is placed into 'buf'
 	readSlot := func(slot uint64) uint32 {
 		n, _ := s.f.ReadAt(buf, int64(slot)*int64(s.slotSize))
-		if n < itemHeaderSize {
-			panic(fmt.Sprintf("failed reading slot %d, need %d bytes, got %d", slot, itemHeaderSize, n))
+		if n < int(s.hdrSize) {
+			panic(fmt.Sprintf("failed reading slot %d, need %d bytes, got %d", slot, s.hdrSize, n))
+		}
+		size := s.getSize(buf)
+		if size != 0 && s.seq != nil {
+			s.getSeq(buf)
 		}
-		return binary.BigEndian.Uint32(buf)
+		return size
 	}
 	writeBuf := func(slot uint64) {
 		n, _ := s.f.WriteAt(buf, int64(slot)*int64(s.slotSize))
@@ -370,7 +1411,7 @@ func (s *shelf) compact(onData onShelfDataFn) {
 				// We've found a gap
 				return slot
 			} else if onData != nil {
-				onData(slot, buf[itemHeaderSize:itemHeaderSize+size])
+				onData(slot, s.decodeItem(buf, size))
 			}
 		}
 		return slot
@@ -381,12 +1422,13 @@ func (s *shelf) compact(onData onShelfDataFn) {
 				// We've found a slot of data. Copy it to the gap
 				writeBuf(gap)
 				if onData != nil {
-					onData(gap, buf[itemHeaderSize:itemHeaderSize+size])
+					onData(gap, s.decodeItem(buf, size))
 				}
 				return slot
 			}
 		}
-		return 0
+		// No data between the gap and the end: the gap is the new tail
+		return gap
 	}
 	var (
 		gapSlot  = uint64(0)
@@ -436,6 +1478,79 @@ func (s *shelf) compact(onData onShelfDataFn) {
 	}
 }
 
+// Compact moves the items at the end of the shelf into the gaps, and truncates
+// the file, while the shelf stays in use. The onMove callback (if non-nil) is
+// invoked for every item moved, after the shelf has been unlocked.
+func (s *shelf) Compact(onMove func(oldSlot, newSlot uint64)) error {
+	if s.readonly {
+		return ErrReadOnly
+	}
+	type move struct{ from, to uint64 }
+	var moves []move
+	err := func() error {
+		s.compactMu.Lock()
+		defer s.compactMu.Unlock()
+		s.gapsMu.Lock()
+		defer s.gapsMu.Unlock()
+		s.fileMu.RLock()
+		defer s.fileMu.RUnlock()
+		if s.closed {
+			return s.errClosed()
+		}
+		if len(s.gaps) == 0 {
+			return nil
+		}
+		if err := s.flushHeld(); err != nil {
+			return err
+		}
+		buf := make([]byte, s.slotSize)
+		for len(s.gaps) > 0 {
+			last := s.tail - 1
+			if s.gaps.Last() >= last {
+				// The last slot is free already, just drop it
+				s.gaps = s.gaps[:len(s.gaps)-1]
+				s.tail = last
+				continue
+			}
+			if s.reserved.Contains(last) {
+				// Reserved, the caller of ReserveBlock holds the key
+				break
+			}
+			gap := s.gaps[0]
+			if n, err := s.f.ReadAt(buf, int64(last)*int64(s.slotSize)); err == io.EOF {
+				// The file ends before the tail, the rest is empty, see readChunk
+				for i := n; i < len(buf); i++ {
+					buf[i] = 0
+				}
+			} else if err != nil {
+				return err
+			}
+			if s.getSize(buf) == 0 {
+				// Deleted, but not in the gap-list since it was full
+				s.tail = last
+				continue
+			}
+			if err := s.claimFree(gap, 1); err != nil {
+				return err
+			}
+			if _, err := s.f.WriteAt(buf, int64(gap)*int64(s.slotSize)); err != nil {
+				return err
+			}
+			s.markDirty(gap)
+			s.gaps = s.gaps[1:]
+			s.tail = last
+			moves = append(moves, move{last, gap})
+		}
+		return s.f.Truncate(int64(s.tail) * int64(s.slotSize))
+	}()
+	if onMove != nil {
+		for _, m := range moves {
+			onMove(m.from, m.to)
+		}
+	}
+	return err
+}
+
 // sortedUniqueInts is a helper structure to maintain an ordered slice
 // of gaps. We keep them ordered to make writes prefer early slots, to increase
 // the chance of trimming the end of files upon deletion.
@@ -446,6 +1561,14 @@ func (u sortedUniqueInts) Less(i, j int) bool { return u[i] < u[j] }
 func (u sortedUniqueInts) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
 func (u sortedUniqueInts) Last() uint64       { return u[len(u)-1] }
 
+// Contains returns true if elem is in the set.
+func (u sortedUniqueInts) Contains(elem uint64) bool {
+	idx := sort.Search(len(u), func(i int) bool {
+		return elem <= u[i]
+	})
+	return idx < len(u) && u[idx] == elem
+}
+
 func (u *sortedUniqueInts) Append(elem uint64) {
 	s := *u
 	size := len(s)
@@ -457,3 +1580,16 @@ func (u *sortedUniqueInts) Append(elem uint64) {
 	}
 	*u = append(s[:idx], append([]uint64{elem}, s[idx:]...)...)
 }
+
+// Remove removes elem from the set, and reports whether it was there.
+func (u *sortedUniqueInts) Remove(elem uint64) bool {
+	s := *u
+	idx := sort.Search(len(s), func(i int) bool {
+		return elem <= s[i]
+	})
+	if idx == len(s) || s[idx] != elem {
+		return false
+	}
+	*u = append(s[:idx], s[idx+1:]...)
+	return true
+}
@@ -0,0 +1,72 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "context"
+
+// Record is an item delivered by Stream or All.
+type Record struct {
+	Key   uint64
+	Value []byte // A copy, owned by the receiver
+}
+
+// Stream delivers every item in the database on the returned channel, which
+// holds up to bufSize records, so a slow consumer holds back the iteration.
+// The record channel is closed when all items have been delivered, or the
+// context is cancelled. The error channel then receives the error, if any,
+// such as the context error, and is closed as well.
+// Since Iterate can't be interrupted, a cancellation takes effect at once for
+// the consumer, but the remaining items of the current shelf are still read.
+func (db *database) Stream(ctx context.Context, bufSize int) (<-chan Record, <-chan error) {
+	var (
+		records = make(chan Record, bufSize)
+		errc    = make(chan error, 1)
+	)
+	go func() {
+		defer close(errc)
+		defer close(records)
+		if err := db.checkOpen(); err != nil {
+			errc <- err
+			return
+		}
+		send := func(key uint64, data []byte) {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case records <- Record{Key: key, Value: append([]byte(nil), data...)}:
+			case <-ctx.Done():
+			}
+		}
+		for i, shelf := range db.snapshot() {
+			if ctx.Err() != nil {
+				break
+			}
+			shelf.Iterate(db.wrapShelfDataFn(i, send))
+		}
+		// Values in Options.OverflowDir come last, as with Iterate
+		if db.overflow != nil && ctx.Err() == nil {
+			db.overflow.iterate(false, send)
+		}
+		if err := ctx.Err(); err != nil {
+			errc <- err
+		}
+	}()
+	return records, errc
+}
+
+// All returns every item in the database, in the order of Iterate. The values
+// are copies, so the whole database is materialized in memory: this is meant
+// for small databases, and tests. Use Iterate or Stream otherwise.
+func (db *database) All() ([]Record, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	var records []Record
+	db.Iterate(func(key uint64, data []byte) {
+		records = append(records, Record{Key: key, Value: append([]byte(nil), data...)})
+	})
+	return records, nil
+}
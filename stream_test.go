@@ -0,0 +1,139 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	want := make(map[uint64][]byte)
+	for i := 0; i < 100; i++ {
+		data := fill(byte(i), 10+i)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	// Consume the stream fully.
+	records, errc := db.Stream(context.Background(), 4)
+	have := make(map[uint64][]byte)
+	for rec := range records {
+		have[rec.Key] = rec.Value
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %d records, want %d", len(have), len(want))
+	}
+	for key, data := range want {
+		if !bytes.Equal(have[key], data) {
+			t.Fatalf("key %x: have %x, want %x", key, have[key], data)
+		}
+	}
+	// Consume it partially, then cancel.
+	ctx, cancel := context.WithCancel(context.Background())
+	records, errc = db.Stream(ctx, 0)
+	for i := 0; i < 10; i++ {
+		rec, ok := <-records
+		if !ok {
+			t.Fatal("stream closed early")
+		}
+		if !bytes.Equal(rec.Value, want[rec.Key]) {
+			t.Fatalf("key %x: have %x, want %x", rec.Key, rec.Value, want[rec.Key])
+		}
+	}
+	cancel()
+	n := 0
+	for range records {
+		n++
+	}
+	if n > 1 {
+		t.Fatalf("have %d records after cancel", n)
+	}
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestStreamOverflow(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir(), OverflowDir: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys []uint64
+	for _, size := range []int{50, 500, 1000} {
+		key, err := db.Put(fill(byte(size), size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	// The values too large for the shelves come last.
+	records, errc := db.Stream(context.Background(), 0)
+	var have []uint64
+	for rec := range records {
+		if !bytes.Equal(rec.Value, fill(byte(len(rec.Value)), len(rec.Value))) {
+			t.Fatalf("key %#x: wrong data", rec.Key)
+		}
+		have = append(have, rec.Key)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(keys) {
+		t.Fatalf("have %d records, want %d", len(have), len(keys))
+	}
+	for i, key := range keys {
+		if have[i] != key {
+			t.Fatalf("record %d: have key %#x, want %#x", i, have[i], key)
+		}
+	}
+	if keys[1]&overflowBit == 0 || keys[2]&overflowBit == 0 {
+		t.Fatalf("values not in the overflow directory: %#x", keys)
+	}
+}
+
+func TestAll(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		db.Put(fill(byte(i), 10+i*3))
+	}
+	db.Delete(7)
+	var want []Record
+	db.Iterate(func(key uint64, data []byte) {
+		want = append(want, Record{key, append([]byte(nil), data...)})
+	})
+	have, err := db.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("have %d records, want %d", len(have), len(want))
+	}
+	for i := range want {
+		if have[i].Key != want[i].Key || !bytes.Equal(have[i].Value, want[i].Value) {
+			t.Fatalf("record %d: have %x: %x, want %x: %x", i, have[i].Key, have[i].Value, want[i].Key, want[i].Value)
+		}
+	}
+	db.Close()
+	if _, err := db.All(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected %v, got %v", ErrClosed, err)
+	}
+}
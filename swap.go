@@ -0,0 +1,176 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// SwapIn replaces the entire dataset with the database stored in srcDir, e.g.
+// one built offline. srcDir must hold a closed database with the same slot
+// sizes and layout options (CompactHeader, Sequence, Checksum). Shelf files
+// without a manifest are taken to have the legacy layout, without any of those.
+// srcDir must not be the database directory.
+//
+// The database is locked exclusively while its shelves are closed, the files
+// of srcDir are renamed into place, and the shelves are reopened, so that
+// operations on single items see either the old or the new dataset, never a
+// mix. An iteration which is in progress during the swap stops delivering
+// items from the remaining (old) shelves.
+//
+// The renames are only atomic if srcDir is on the same filesystem as the
+// database. The swap is not crash-safe: a crash while the files are being
+// moved may leave a mix of old and new shelf files on disk. Since reopening
+// scans the new shelves, the onData callback of Open is not invoked for them.
+// If reopening fails, the database is closed, and the error is returned.
+func (db *database) SwapIn(srcDir string) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if db.readonly {
+		return ErrReadOnly
+	}
+	finfo, err := db.fs.Stat(srcDir)
+	if err != nil {
+		return err
+	} else if !finfo.IsDir() {
+		return fmt.Errorf("%w: '%v'", ErrNotDirectory, srcDir)
+	}
+	// Swapping in the database directory itself would remove its files.
+	if same, err := db.isDatabaseDir(srcDir, finfo); err != nil {
+		return err
+	} else if same {
+		return fmt.Errorf("%w: '%v' is the database directory", ErrInvalidOptions, srcDir)
+	}
+	// Verify the replacement before touching anything.
+	if m, err := readLayoutManifest(db.fs, srcDir, db.opts.Name); err != nil {
+		return err
+	} else if m != nil {
+		if err := m.check(db.opts); err != nil {
+			return err
+		}
+	}
+	names, err := findShelfFiles(db.fs, srcDir, db.opts.Name)
+	if err != nil {
+		return err
+	}
+	for size, name := range names {
+		if !db.hasSlotSize(size) {
+			return fmt.Errorf("%w: %v has slot size %d, which is not in use", ErrLayoutMismatch, name, size)
+		}
+	}
+	srcFiles, err := swapFiles(db.fs, srcDir, db.opts.Name)
+	if err != nil {
+		return err
+	}
+	dstFiles, err := swapFiles(db.fs, db.path, db.opts.Name)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	for _, shelf := range db.shelves {
+		if err := shelf.Close(); err != nil {
+			return db.failSwap(err)
+		}
+	}
+	db.shelves = nil
+	// Deletes still queued refer to the old dataset.
+	db.pendingMu.Lock()
+	db.pending = nil
+	db.pendingMu.Unlock()
+	for _, name := range dstFiles {
+		if err := db.fs.Remove(filepath.Join(db.path, name)); err != nil {
+			return db.failSwap(err)
+		}
+	}
+	for _, name := range srcFiles {
+		if err := db.fs.Rename(filepath.Join(srcDir, name), filepath.Join(db.path, name)); err != nil {
+			return db.failSwap(err)
+		}
+	}
+	atomic.StoreUint64(&db.seq, 0)
+	atomic.StoreInt32(&db.lastShelf, 0)
+	if err := db.openShelves(nil); err != nil {
+		return db.failSwap(err)
+	}
+	return nil
+}
+
+// isDatabaseDir reports whether dir, with the given file info, is the directory
+// of the database.
+func (db *database) isDatabaseDir(dir string, finfo os.FileInfo) (bool, error) {
+	a, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	b, err := filepath.Abs(db.path)
+	if err != nil {
+		return false, err
+	}
+	if a == b {
+		return true, nil
+	}
+	dbInfo, err := db.fs.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(finfo, dbInfo), nil
+}
+
+// failSwap closes the database after SwapIn failed midway, and returns the
+// error. The caller must hold db.mu.
+func (db *database) failSwap(err error) error {
+	for _, shelf := range db.shelves {
+		shelf.Close()
+	}
+	db.shelves = nil
+	if atomic.CompareAndSwapInt32(&db.closed, 0, 1) {
+		// The background goroutines can't be waited for while holding
+		// db.mu, but they exit on their own.
+		close(db.stop)
+		if db.onClose != nil {
+			db.onClose()
+		}
+	}
+	return fmt.Errorf("swap failed, database closed: %w", err)
+}
+
+// hasSlotSize reports whether one of the shelves has the given slot size.
+func (db *database) hasSlotSize(size uint32) bool {
+	for _, s := range db.currentSlotSizes() {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// swapFiles lists the files in the given directory which make up the database
+// of the dataset: the shelf files, their journals, the manifest and the
+// metadata blob.
+func swapFiles(fsys FS, path, dataset string) ([]string, error) {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if file, ours := datasetFileOf(dataset, entry.Name()); ours && isDatabaseFile(file) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,159 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapIn(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		src  = t.TempDir()
+		opts = Options{Path: dir, Checksum: true}
+	)
+	db, err := Open(opts, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := db.Put([]byte(fmt.Sprintf("old-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Build the replacement.
+	want := make(map[uint64]string)
+	repl, err := Open(Options{Path: src, Checksum: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		data := fmt.Sprintf("new-%d-%s", i, make([]byte, 100*(i%3)))
+		key, err := repl.Put([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	if err := repl.SetMeta([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	repl.Close()
+
+	if err := db.SwapIn(src); err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[uint64]string)
+	db.Iterate(func(key uint64, data []byte) {
+		have[key] = string(data)
+	})
+	if len(have) != len(want) {
+		t.Fatalf("have %d items, want %d", len(have), len(want))
+	}
+	for key, data := range want {
+		if have[key] != data {
+			t.Fatalf("key %x: have %q, want %q", key, have[key], data)
+		}
+	}
+	if meta, err := db.GetMeta(); err != nil || string(meta) != "new" {
+		t.Fatalf("have meta %q (err %v), want %q", meta, err, "new")
+	}
+	if entries, _ := os.ReadDir(src); len(entries) != 0 {
+		t.Fatalf("expected %v to be empty, have %d entries", src, len(entries))
+	}
+	// The swapped-in database must be usable, and survive a reopen.
+	key, err := db.Put([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[key] = "after"
+	db.Close()
+	db, err = Open(opts, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, data := range want {
+		if have, err := db.Get(key); err != nil || string(have) != data {
+			t.Fatalf("key %x: have %q (err %v), want %q", key, have, err, data)
+		}
+	}
+}
+
+func TestSwapInMismatch(t *testing.T) {
+	db, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, err := db.Put([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A replacement with different layout options is rejected.
+	src := t.TempDir()
+	repl, err := Open(Options{Path: src, Checksum: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repl.Close()
+	if err := db.SwapIn(src); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	// As is one with other slot sizes.
+	src = t.TempDir()
+	repl, err = Open(Options{Path: src}, SlotSizeLinear(150, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repl.Close()
+	if err := db.SwapIn(src); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	// The old data is untouched.
+	if data, err := db.Get(key); err != nil || string(data) != "old" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "old")
+	}
+}
+
+func TestSwapInChecks(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(Options{Path: dir, Checksum: true}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, err := db.Put([]byte("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The database directory itself can't be swapped in.
+	for _, src := range []string{dir, dir + string(filepath.Separator) + "."} {
+		if err := db.SwapIn(src); !errors.Is(err, ErrInvalidOptions) {
+			t.Fatalf("%v: expected %v, got %v", src, ErrInvalidOptions, err)
+		}
+	}
+	// Shelf files without a manifest have the legacy layout, without checksums.
+	src := t.TempDir()
+	repl, err := Open(Options{Path: src}, SlotSizeLinear(100, 4), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repl.Close()
+	if err := os.Remove(filepath.Join(src, manifestName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SwapIn(src); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	if data, err := db.Get(key); err != nil || string(data) != "old" {
+		t.Fatalf("have %q (err %v), want %q", data, err, "old")
+	}
+}
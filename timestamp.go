@@ -0,0 +1,64 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// clock is the source of the item timestamps. It follows the wall clock, but
+// never goes backwards, so that the timestamps of a database are strictly
+// increasing in the order the items are written, within a process.
+type clock struct {
+	last int64 // Last timestamp handed out, in ns since the epoch (atomic)
+}
+
+// now returns the current time, in nanoseconds since the Unix epoch, or one
+// more than the previous timestamp if the wall clock has moved backwards.
+func (c *clock) now() int64 {
+	for {
+		t, last := time.Now().UnixNano(), atomic.LoadInt64(&c.last)
+		if t <= last {
+			t = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&c.last, last, t) {
+			return t
+		}
+	}
+}
+
+// CreatedAt returns the time the item with the given key was written, by Put,
+// or by the latest write in place (Append, Swap, PutAt); moving the item during
+// compaction keeps the time. It requires Options.Timestamps. The time has
+// nanosecond precision, and is returned in the local time zone. For values in
+// Options.OverflowDir, it's the modification time of their file.
+func (db *database) CreatedAt(key uint64) (time.Time, error) {
+	if err := db.checkOpen(); err != nil {
+		return time.Time{}, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if !db.timestamps {
+		return time.Time{}, fmt.Errorf("%w: timestamps not enabled", ErrInvalidOptions)
+	}
+	if key&overflowBit != 0 && db.overflow != nil {
+		finfo, err := db.fs.Stat(db.overflow.path(key))
+		if err != nil {
+			return time.Time{}, err
+		}
+		return finfo.ModTime(), nil
+	}
+	shelf, slot, err := db.shelfFor(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ns, err := shelf.Timestamp(slot)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ns), nil
+}
@@ -0,0 +1,82 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimestamps(t *testing.T) {
+	var (
+		p    = t.TempDir()
+		opts = Options{Path: p, Timestamps: true, Checksum: true}
+	)
+	db, err := Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		keys  []uint64
+		times []time.Time
+	)
+	for i := 0; i < 20; i++ {
+		before := time.Now()
+		key, err := db.Put(fill(byte(i), 10+i*5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := time.Now()
+		have, err := db.CreatedAt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Allow for the nanoseconds added to keep the timestamps unique.
+		if have.Before(before) || have.After(after.Add(time.Microsecond)) {
+			t.Fatalf("have time %v, want between %v and %v", have, before, after)
+		}
+		if n := len(times); n > 0 && !have.After(times[n-1]) {
+			t.Fatalf("have time %v, not after previous %v", have, times[n-1])
+		}
+		keys, times = append(keys, key), append(times, have)
+	}
+	if data, err := db.Get(keys[3]); err != nil || !bytes.Equal(data, fill(3, 25)) {
+		t.Fatalf("have %x (err %v)", data, err)
+	}
+	// Writing in place updates the time.
+	if _, err := db.Swap(keys[0], fill(9, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := db.CreatedAt(keys[0]); !have.After(times[len(times)-1]) {
+		t.Fatalf("have time %v after swap, want later than %v", have, times[len(times)-1])
+	}
+	db.Close()
+
+	// The timestamps survive a reopen, and the setting can't change.
+	if _, err := Open(Options{Path: p, Checksum: true}, SlotSizeLinear(100, 3), nil); !errors.Is(err, ErrLayoutMismatch) {
+		t.Fatalf("expected %v, got %v", ErrLayoutMismatch, err)
+	}
+	db, err = Open(opts, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i < len(keys); i++ {
+		if have, err := db.CreatedAt(keys[i]); err != nil || !have.Equal(times[i]) {
+			t.Fatalf("key %#x: have time %v (err %v), want %v", keys[i], have, err, times[i])
+		}
+	}
+	plain, err := Open(Options{Path: t.TempDir()}, SlotSizeLinear(100, 3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	key, _ := plain.Put([]byte("data"))
+	if _, err := plain.CreatedAt(key); !errors.Is(err, ErrInvalidOptions) {
+		t.Fatalf("expected %v, got %v", ErrInvalidOptions, err)
+	}
+}
@@ -0,0 +1,36 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+// Tracer can be used to trace database operations, e.g. by bridging to
+// OpenTelemetry, without billy depending on any tracing library. When set in
+// the Options, a span is started and ended around each Put, Get, Delete,
+// Iterate and Compact, and around the compaction of each shelf on open.
+// Spans are started and ended from the goroutines of the callers, and from the
+// workers of CompactParallel, so a Tracer and its spans must be safe for
+// concurrent use.
+type Tracer interface {
+	// StartSpan starts a span for the operation with the given name.
+	StartSpan(name string) Span
+}
+
+// Span represents a single traced operation.
+type Span interface {
+	// End marks the operation as finished.
+	End()
+}
+
+// noopSpan is used when no tracer is configured.
+type noopSpan struct{}
+
+func (noopSpan) End() {}
+
+// startSpan starts a span on the given tracer, which may be nil.
+func startSpan(tracer Tracer, name string) Span {
+	if tracer == nil {
+		return noopSpan{}
+	}
+	return tracer.StartSpan(name)
+}
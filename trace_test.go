@@ -0,0 +1,63 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"sync"
+	"testing"
+)
+
+type testTracer struct {
+	mu      sync.Mutex
+	started map[string]int
+	ended   map[string]int
+}
+
+type testSpan struct {
+	tracer *testTracer
+	name   string
+}
+
+func (t *testTracer) StartSpan(name string) Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.started[name]++
+	return &testSpan{t, name}
+}
+
+func (s *testSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.ended[s.name]++
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{started: make(map[string]int), ended: make(map[string]int)}
+	db, err := Open(Options{Path: t.TempDir(), Tracer: tracer}, SlotSizePowerOfTwo(128, 500), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key, _ := db.Put(fill(1, 100))
+	_, _ = db.Get(key)
+	_ = db.Delete(key)
+	db.(*database).Iterate(nil)
+	// One span per shelf: on open, on Compact, and from the concurrent
+	// workers of CompactParallel.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CompactParallel(3); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]int{"Put": 1, "Get": 1, "Delete": 1, "Iterate": 1, "Compact": 9} {
+		if have := tracer.started[name]; have != want {
+			t.Errorf("%s: started %d spans, want %d", name, have, want)
+		}
+		if have := tracer.ended[name]; have != want {
+			t.Errorf("%s: ended %d spans, want %d", name, have, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import "sync"
+
+// writeBuffer accumulates the content of a contiguous range of slots, so that
+// appended slots can be written to the shelf file with a single write. The
+// buffer is authoritative for the slots in its range: they are read from and
+// written to the buffer, until it's flushed.
+// The lock order is fileMu before writeBuffer.mu.
+type writeBuffer struct {
+	mu    sync.Mutex
+	buf   []byte // Content of the buffered slots
+	start uint64 // First slot in the buffer
+	limit int    // Max number of bytes to buffer
+}
+
+// contains reports whether the slot is in the buffer. The caller must hold
+// b.mu.
+func (b *writeBuffer) contains(slot uint64, slotSize uint32) bool {
+	return len(b.buf) > 0 && slot >= b.start && slot < b.start+uint64(len(b.buf))/uint64(slotSize)
+}
+
+// bufferWrite writes the slot content into the write buffer, if the slot is in
+// the buffer, or directly follows it. A full buffer is flushed first. It
+// reports whether the write was buffered. The caller must hold fileMu.
+func (s *shelf) bufferWrite(data []byte, slot uint64) (bool, error) {
+	b := s.wbuf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.contains(slot, s.slotSize) {
+		copy(b.buf[(slot-b.start)*uint64(s.slotSize):], data)
+		return true, nil
+	}
+	if len(data) > b.limit {
+		return false, nil
+	}
+	if len(b.buf) > 0 && slot != b.start+uint64(len(b.buf))/uint64(s.slotSize) {
+		// Not contiguous, e.g. a concurrent Put which reserved an earlier
+		// slot, or a reused gap. Written directly.
+		return false, nil
+	}
+	if len(b.buf)+len(data) > b.limit {
+		if err := s.flushLocked(); err != nil {
+			return false, err
+		}
+	}
+	if len(b.buf) == 0 {
+		b.start = slot
+	}
+	b.buf = append(b.buf, data...)
+	return true, nil
+}
+
+// bufferPatch writes p at the start of the slot, if the slot is in the write
+// buffer, and reports whether it did. The caller must hold fileMu.
+func (s *shelf) bufferPatch(p []byte, slot uint64) bool {
+	if s.wbuf == nil {
+		return false
+	}
+	b := s.wbuf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.contains(slot, s.slotSize) {
+		return false
+	}
+	copy(b.buf[(slot-b.start)*uint64(s.slotSize):], p)
+	return true
+}
+
+// readSlot reads the start of the slot into dst, from the write buffer if the
+// slot is in it, otherwise from the file. The caller must hold fileMu.
+func (s *shelf) readSlot(dst []byte, slot uint64) (int, error) {
+	if s.bufferRead(dst, slot) {
+		return len(dst), nil
+	}
+	return s.f.ReadAt(dst, int64(slot)*int64(s.slotSize))
+}
+
+// bufferRead copies the content of the slot into dst, if the slot is in the
+// write buffer, and reports whether it did. The caller must hold fileMu.
+func (s *shelf) bufferRead(dst []byte, slot uint64) bool {
+	if s.wbuf == nil {
+		return false
+	}
+	b := s.wbuf
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.contains(slot, s.slotSize) {
+		return false
+	}
+	copy(dst, b.buf[(slot-b.start)*uint64(s.slotSize):])
+	return true
+}
+
+// flush writes the content of the write buffer, if any, to the shelf file.
+func (s *shelf) flush() error {
+	if s.wbuf == nil {
+		return nil
+	}
+	s.fileMu.RLock()
+	defer s.fileMu.RUnlock()
+	if s.closed {
+		return s.errClosed()
+	}
+	return s.flushHeld()
+}
+
+// flushHeld is like flush, but the caller must hold fileMu.
+func (s *shelf) flushHeld() error {
+	if s.wbuf == nil {
+		return nil
+	}
+	s.wbuf.mu.Lock()
+	defer s.wbuf.mu.Unlock()
+	return s.flushLocked()
+}
+
+// flushLocked implements flush. The caller must hold fileMu and wbuf.mu.
+func (s *shelf) flushLocked() error {
+	b := s.wbuf
+	if b == nil || len(b.buf) == 0 {
+		return nil
+	}
+	err := withRetry(s.retries, func() error {
+		_, err := s.f.WriteAt(b.buf, int64(b.start)*int64(s.slotSize))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	b.buf = b.buf[:0]
+	return nil
+}
@@ -0,0 +1,140 @@
+// bagdb: Simple datastorage
+// Copyright 2021 billy authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package billy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	var (
+		p    = t.TempDir()
+		opts = Options{Path: p, WriteBufferBytes: 64 * 1024}
+	)
+	db, err := OpenFixed(opts, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat(filepath.Join(p, legacyShelfName(100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	want := make(map[uint64][]byte)
+	for i := 0; i < 100; i++ {
+		data := fill(byte(i), 50)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	if size := fileSize(); size != 0 {
+		t.Fatalf("have file size %d, expected nothing flushed", size)
+	}
+	// The unflushed data can be read, updated and iterated.
+	if _, err := db.Append(5, []byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	want[5] = append(fill(5, 50), "more"...)
+	check := func() {
+		t.Helper()
+		for key, data := range want {
+			if have, err := db.Get(key); err != nil || !bytes.Equal(have, data) {
+				t.Fatalf("key %d: have %x (err %v), want %x", key, have, err, data)
+			}
+			if n, err := db.Len(key); err != nil || n != len(data) {
+				t.Fatalf("key %d: have len %d (err %v), want %d", key, n, err, len(data))
+			}
+		}
+		n := 0
+		db.Iterate(func(key uint64, data []byte) {
+			if !bytes.Equal(data, want[key]) {
+				t.Errorf("iterate key %d: have %x, want %x", key, data, want[key])
+			}
+			n++
+		})
+		if n != len(want) {
+			t.Fatalf("iterated %d items, want %d", n, len(want))
+		}
+	}
+	check()
+	// A deleted slot is reused, and must not be clobbered by the flush.
+	if err := db.Delete(10); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, 10)
+	key, err := db.Put([]byte("reused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != 10 {
+		t.Fatalf("have key %d, want 10", key)
+	}
+	want[key] = []byte("reused")
+	check()
+	if err := db.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if size := fileSize(); size != 100*100 {
+		t.Fatalf("have file size %d, want %d", size, 100*100)
+	}
+	check()
+	// Overflowing the buffer flushes it.
+	for i := 0; i < 1000; i++ {
+		data := fill(byte(i), 20)
+		key, err := db.Put(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[key] = data
+	}
+	if size := fileSize(); size <= 100*100 || size >= 1100*100 {
+		t.Fatalf("have file size %d, expected partial flush", size)
+	}
+	check()
+	db.Close()
+	items := 0
+	db, err = OpenFixed(opts, 100, func(key uint64, data []byte) {
+		if !bytes.Equal(data, want[key]) {
+			t.Errorf("key %d: have %x, want %x", key, data, want[key])
+		}
+		items++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if items != len(want) {
+		t.Fatalf("have %d items, want %d", items, len(want))
+	}
+}
+
+func BenchmarkWriteBuffer(b *testing.B) {
+	data := fill(1, 50)
+	for _, size := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			db, err := OpenFixed(Options{Path: b.TempDir(), WriteBufferBytes: size}, 64, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.Put(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}